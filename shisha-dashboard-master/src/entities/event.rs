@@ -27,6 +27,10 @@ pub enum EventType {
     TRANSFER,
     #[sea_orm(string_value = "BUY")]
     BUY,
+    #[sea_orm(string_value = "REVERSAL")]
+    REVERSAL,
+    #[sea_orm(string_value = "REFUND")]
+    REFUND,
 }
 
 #[derive(Copy, Clone, Debug, EnumIter, DeriveRelation)]
@@ -6,17 +6,21 @@ use crate::entities::{event::Model as EventModel};
 use sea_orm::*;
 use sea_orm::prelude::Expr;
 use crate::entities::event::EventType;
-use crate::entities::event::EventType::{BUY, UPLOAD, TRANSFER};
+use crate::entities::event::EventType::{BUY, UPLOAD, TRANSFER, REVERSAL, REFUND};
 use crate::messages::ShishaMessage;
 
 pub struct Query;
 
 impl Query {
     pub async fn insert_message(message: ShishaMessage, db: &DatabaseConnection) -> Result<(), DbErr> {
+        let Some(event_type) = Self::convert_to_type(message.r#type.as_str()) else {
+            log::info!("Skipping event of type {}", message.r#type);
+            return Ok(());
+        };
         let model = event::ActiveModel {
             actor: ActiveValue::Set(message.user),
             event_date: ActiveValue::Set(Utc::now().naive_utc()),
-            event_type: ActiveValue::Set(Self::convert_to_type(message.r#type.as_str())),
+            event_type: ActiveValue::Set(event_type),
             target: ActiveValue::Set(message.target),
             amount: ActiveValue::Set(message.amount),
             image: ActiveValue::Set(message.image_uuid),
@@ -26,15 +30,14 @@ impl Query {
         Ok(())
     }
 
-    fn convert_to_type(message_type: &str) -> EventType {
+    fn convert_to_type(message_type: &str) -> Option<EventType> {
         match message_type {
-            "upload" => UPLOAD,
-            "buy" => BUY,
-            "transfer" => TRANSFER,
-            t => {
-                log::error!("Unknown event type: {}, defaulting to UPLOAD", t);
-                UPLOAD
-            }
+            "upload" => Some(UPLOAD),
+            "buy" => Some(BUY),
+            "transfer" => Some(TRANSFER),
+            "reversal" => Some(REVERSAL),
+            "refund" => Some(REFUND),
+            _ => None
         }
     }
     pub async fn last_10_events(db: &DatabaseConnection) -> Result<Vec<EventModel>, DbErr> {
@@ -90,8 +93,9 @@ impl Query {
     fn money_earned_query() -> Select<Event> {
         Event::find()
             .select_only()
-            .column_as(event::Column::Amount.sum(), "total")
-            .filter(event::Column::EventType.eq(BUY))
+            // Refunded purchases give the money back
+            .column_as(Expr::cust("SUM(CASE WHEN `event`.`event_type` = 'REFUND' THEN -`event`.`amount` ELSE `event`.`amount` END)"), "total")
+            .filter(event::Column::EventType.is_in([BUY, REFUND]))
     }
 
     fn top_n_by_column(col: event::Column, t: EventType, count: u64) -> Select<Event> {
@@ -150,9 +154,9 @@ mod tests {
     #[test]
     fn money_earned_query_test() {
         let query = "SELECT \
-        SUM(`event`.`amount`) AS `total` \
+        SUM(CASE WHEN `event`.`event_type` = 'REFUND' THEN -`event`.`amount` ELSE `event`.`amount` END) AS `total` \
         FROM `event` \
-        WHERE `event`.`event_type` = 'BUY'";
+        WHERE `event`.`event_type` IN ('BUY', 'REFUND')";
         assert_eq!(Query::money_earned_query().build(DatabaseBackend::MySql).to_string(), query);
     }
 }
\ No newline at end of file
@@ -18,9 +18,22 @@ const Login = () => {
       headers: { 'Content-Type': 'application/json' },
       body: JSON.stringify({ username, password })
     });
-    const data = await response.json();
+    let data = await response.json();
+    if (response.ok && data.mfa_required) {
+      const code = window.prompt('Enter your two-factor code or a recovery code');
+      const mfaResponse = await fetch('/api/login/2fa', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ mfa_token: data.mfa_token, code })
+      });
+      data = await mfaResponse.json();
+      if (!mfaResponse.ok) {
+        toast.error(data.error);
+        return;
+      }
+    }
     if (response.ok) {
-      login({ username, token: data.token, coins: data.coins });
+      login({ username, token: data.token, refreshToken: data.refresh_token, coins: data.coins });
       toast.success('Login successful');
       navigate('/');
     } else {
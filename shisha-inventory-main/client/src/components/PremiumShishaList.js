@@ -15,7 +15,9 @@ const PremiumShishaList = () => {
       .catch((error) => console.error('Error fetching images:', error));
 
     if (user) {
-      fetch(`/api/purchased/ids/${user.username}`)
+      fetch(`/api/purchased/ids/${user.username}`, {
+        headers: { 'Authorization': `Bearer ${user.token}` },
+      })
         .then(response => response.json())
         .then(data => {
           if (Array.isArray(data)) {
@@ -33,10 +35,10 @@ const PremiumShishaList = () => {
       method: 'POST',
       headers: {
         'Content-Type': 'application/json',
+        'Authorization': `Bearer ${user.token}`,
       },
       body: JSON.stringify({
         image_id: imageId,
-        user_name: user.username,
       }),
     })
       .then((response) => {
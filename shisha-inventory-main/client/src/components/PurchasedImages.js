@@ -8,7 +8,9 @@ const PurchasedImages = () => {
 
     useEffect(() => {
         if (user) {
-            fetch(`/api/purchased/${user.username}`)
+            fetch(`/api/purchased/${user.username}`, {
+                headers: { 'Authorization': `Bearer ${user.token}` },
+            })
                 .then((response) => response.json())
                 .then((data) => setImages(data))
                 .catch((error) => console.error('Error fetching purchased images:', error));
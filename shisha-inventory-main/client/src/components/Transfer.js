@@ -13,9 +13,11 @@ const Transfer = () => {
     try {
       const response = await fetch('/api/transfer', {
         method: 'POST',
-        headers: { 'Content-Type': 'application/json' },
+        headers: {
+          'Content-Type': 'application/json',
+          'Authorization': `Bearer ${user.token}`,
+        },
         body: JSON.stringify({
-          from_username: user.username,
           to_username: toUsername,
           amount: parseInt(amount, 10),
         }),
@@ -22,13 +22,11 @@ const Upload = () => {
 
     const formData = new FormData();
     formData.append('file', file);
-    if (localStorage.getItem('user')) {
-      formData.append('username', user.username);
-    }
 
     try {
       const response = await fetch('/api/upload', {
         method: 'POST',
+        headers: { 'Authorization': `Bearer ${user.token}` },
         body: formData,
       });
       const data = await response.json();
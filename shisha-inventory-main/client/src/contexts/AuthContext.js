@@ -11,16 +11,38 @@ export const AuthProvider = ({ children }) => {
     const loggedInUser = JSON.parse(localStorage.getItem('user'));
     if (loggedInUser) {
       setUser(loggedInUser);
-      fetchBalance(loggedInUser.username);
+      fetchBalance(loggedInUser);
     }
     setLoading(false);
   }, []);
 
-  const fetchBalance = async (username) => {
+  const refreshTokens = async (currentUser) => {
+    const response = await fetch('/api/token/refresh', {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ refresh_token: currentUser.refreshToken }),
+    });
+    if (!response.ok) {
+      return null;
+    }
+    const data = await response.json();
+    const refreshedUser = { ...currentUser, token: data.token, refreshToken: data.refresh_token };
+    setUser(refreshedUser);
+    localStorage.setItem('user', JSON.stringify(refreshedUser));
+    return refreshedUser;
+  };
+
+  const fetchBalance = async (currentUser, retry = true) => {
     try {
-      const response = await fetch(`/api/balance?username=${username}`);
+      const response = await fetch('/api/balance', {
+        headers: { 'Authorization': `Bearer ${currentUser.token}` },
+      });
       if (!response.ok) {
         if (response.status === 401) {
+          const refreshedUser = retry && currentUser.refreshToken ? await refreshTokens(currentUser) : null;
+          if (refreshedUser) {
+            return fetchBalance(refreshedUser, false);
+          }
           logout();
         }
         throw new Error('Failed to fetch balance');
@@ -36,7 +58,7 @@ export const AuthProvider = ({ children }) => {
     try {
       setUser(userData);
       localStorage.setItem('user', JSON.stringify(userData));
-      fetchBalance(userData.username);
+      fetchBalance(userData);
     } catch (error) {
       console.error('Login failed:', error);
       throw error;
@@ -44,12 +66,23 @@ export const AuthProvider = ({ children }) => {
   };
 
   const logout = () => {
+    const currentUser = JSON.parse(localStorage.getItem('user'));
+    if (currentUser) {
+      fetch('/api/logout', {
+        method: 'POST',
+        headers: {
+          'Content-Type': 'application/json',
+          'Authorization': `Bearer ${currentUser.token}`,
+        },
+        body: JSON.stringify({ refresh_token: currentUser.refreshToken }),
+      }).catch((error) => console.error('Logout failed:', error));
+    }
     localStorage.removeItem('user');
     setUser(null);
   };
 
   const updateUserBalance = async () => {
-    await fetchBalance(user.username);
+    await fetchBalance(user);
   };
 
   return (
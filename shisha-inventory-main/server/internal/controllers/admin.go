@@ -0,0 +1,49 @@
+// internal/controllers/admin.go
+package controllers
+
+import (
+	"server/internal/database"
+	"server/internal/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+	zlog "github.com/rs/zerolog/log"
+)
+
+func SetUserRole(c *fiber.Ctx) error {
+	type RoleRequest struct {
+		Role string `json:"role"`
+	}
+
+	var req RoleRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+	}
+	if !models.ValidRole(req.Role) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Unknown role"})
+	}
+
+	var user models.User
+	if err := database.DB.Where("username = ?", c.Params("username")).First(&user).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+
+	// Tokens carry the role, so force the user to pick up the new one
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&user).Updates(map[string]interface{}{
+			"role":          req.Role,
+			"token_version": gorm.Expr("token_version + 1"),
+		}).Error
+		if err != nil {
+			return err
+		}
+		return revokeSessions(tx, user.ID)
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update role"})
+	}
+
+	admin := c.Locals("user").(models.User)
+	zlog.Info().Str("admin", admin.Username).Str("user", user.Username).Str("role", req.Role).Msg("role changed")
+	return c.JSON(fiber.Map{"username": user.Username, "role": req.Role})
+}
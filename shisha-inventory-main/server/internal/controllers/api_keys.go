@@ -0,0 +1,144 @@
+// internal/controllers/api_keys.go
+package controllers
+
+import (
+	"time"
+
+	"server/internal/database"
+	"server/internal/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+	zlog "github.com/rs/zerolog/log"
+)
+
+// apiKeyAuth authenticates a request carrying an API key instead of a JWT.
+func apiKeyAuth(c *fiber.Ctx, prefix, key string, scopes []string) error {
+	var apiKey models.APIKey
+	result := database.DB.Where("prefix = ?", prefix).First(&apiKey)
+	if result.Error != nil {
+		if gorm.IsRecordNotFoundError(result.Error) {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Database error"})
+	}
+	now := time.Now()
+	if !apiKey.Check(key) || !apiKey.Active(now) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	if len(scopes) == 0 {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "API keys cannot be used here"})
+	}
+	for _, scope := range scopes {
+		if !apiKey.HasScope(scope) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "API key is missing the " + scope + " scope"})
+		}
+	}
+
+	var user models.User
+	if err := database.DB.First(&user, apiKey.UserID).Error; err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	if err := database.DB.Model(&apiKey).UpdateColumn("last_used_at", now).Error; err != nil {
+		zlog.Error().Err(err).Msg("api key last use")
+	}
+
+	c.Locals("user", user)
+	c.Locals("api_key", apiKey)
+	return c.Next()
+}
+
+func apiKeyResponse(apiKey models.APIKey) fiber.Map {
+	return fiber.Map{
+		"id":           apiKey.ID,
+		"name":         apiKey.Name,
+		"prefix":       apiKey.Prefix,
+		"scopes":       apiKey.ScopeList(),
+		"created_at":   apiKey.CreatedAt,
+		"last_used_at": apiKey.LastUsedAt,
+		"expires_at":   apiKey.ExpiresAt,
+		"revoked_at":   apiKey.RevokedAt,
+	}
+}
+
+func CreateAPIKey(c *fiber.Ctx) error {
+	type CreateAPIKeyRequest struct {
+		Name      string   `json:"name"`
+		Scopes    []string `json:"scopes"`
+		ExpiresIn int      `json:"expires_in"`
+	}
+
+	var req CreateAPIKeyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+	}
+	if len(req.Scopes) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "At least one scope is required"})
+	}
+	for _, scope := range req.Scopes {
+		if !models.ValidScope(scope) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Unknown scope " + scope})
+		}
+	}
+	if req.ExpiresIn < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "expires_in must not be negative"})
+	}
+
+	var expiresAt *time.Time
+	if req.ExpiresIn > 0 {
+		t := time.Now().Add(time.Duration(req.ExpiresIn) * time.Second)
+		expiresAt = &t
+	}
+
+	user := c.Locals("user").(models.User)
+	key, apiKey, err := models.NewAPIKey(user.ID, req.Name, req.Scopes, expiresAt)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate API key"})
+	}
+	if err := database.DB.Create(&apiKey).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to store API key"})
+	}
+
+	zlog.Info().Str("user", user.Username).Str("prefix", apiKey.Prefix).Strs("scopes", req.Scopes).Msg("api key created")
+	response := apiKeyResponse(apiKey)
+	// The key is only ever shown once
+	response["key"] = key
+	return c.Status(fiber.StatusCreated).JSON(response)
+}
+
+func ListAPIKeys(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.User)
+
+	var apiKeys []models.APIKey
+	if err := database.DB.Where("user_id = ?", user.ID).Order("id").Find(&apiKeys).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch API keys"})
+	}
+
+	keyList := make([]fiber.Map, 0, len(apiKeys))
+	for _, apiKey := range apiKeys {
+		keyList = append(keyList, apiKeyResponse(apiKey))
+	}
+	return c.JSON(keyList)
+}
+
+func RevokeAPIKey(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.User)
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid key id"})
+	}
+
+	result := database.DB.Model(&models.APIKey{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", id, user.ID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to revoke API key"})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "API key not found"})
+	}
+	return c.JSON(fiber.Map{"message": "API key revoked"})
+}
@@ -2,100 +2,407 @@
 package controllers
 
 import (
+	"errors"
+	"math"
 	"server/internal/database"
+	"server/internal/economy"
+	"server/internal/initializers"
+	"server/internal/ledger"
 	"server/internal/models"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
 	zlog "github.com/rs/zerolog/log"
-	"gorm.io/gorm"
+)
+
+var (
+	errUsernameTaken = errors.New("username already exists")
+	errForbidden     = fiber.NewError(fiber.StatusForbidden, "Forbidden")
+	errUserNotFound  = fiber.NewError(fiber.StatusNotFound, "User not found")
 )
 
 type Claims struct {
-	Username string `json:"username"`
+	Username     string `json:"username"`
+	TokenType    string `json:"typ"`
+	TokenVersion int    `json:"ver"`
+	Role         string `json:"role"`
+	SessionID    string `json:"sid,omitempty"`
 	jwt.StandardClaims
 }
 
-func Register(c *fiber.Ctx) error {
-	var user models.User
-	if err := c.BodyParser(&user); err != nil {
-		zlog.Error().Err(err).Msg("failed body parsed")
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
-	}
-	if err := user.HashPassword(); err != nil {
-		zlog.Error().Err(err).Msg("user password hash")
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
-	}
-	user.Coins = 100
-	if err := database.DB.Create(&user).Error; err != nil {
-		zlog.Error().Err(err).Msg("db create error")
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Username already exists"})
+// Register creates a user paid the signup bonus. A user registering with an
+// invite code is recorded as referred, a nil rf ignores invite codes.
+func Register(rf *Referrals) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var user models.User
+		if err := c.BodyParser(&user); err != nil {
+			zlog.Error().Err(err).Msg("failed body parsed")
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		var invite struct {
+			InviteCode string `json:"invite_code"`
+		}
+		if err := c.BodyParser(&invite); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := user.HashPassword(); err != nil {
+			zlog.Error().Err(err).Msg("user password hash")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		user.Coins = 0
+		user.Role = models.RoleUser
+		err := database.DB.Transaction(func(tx *gorm.DB) error {
+			policy, err := economy.Current(tx)
+			if err != nil {
+				return err
+			}
+			user.SignupBonus = policy.SignupBonus
+			if err := tx.Create(&user).Error; err != nil {
+				zlog.Error().Err(err).Msg("db create error")
+				return errUsernameTaken
+			}
+			if rf != nil && invite.InviteCode != "" {
+				if err := rf.attach(tx, user.Username, invite.InviteCode, c.IP()); err != nil {
+					return err
+				}
+			}
+			if policy.SignupBonus == 0 {
+				return nil
+			}
+			_, err = ledger.Move(tx, policy.Version(), ledger.AccountMint, ledger.UserAccount(user.Username), policy.SignupBonus, ledger.ReasonSignupBonus, "")
+			return err
+		})
+		if err == errUsernameTaken {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Username already exists"})
+		}
+		if err == errUnknownInviteCode {
+			return errorResponse(c, err)
+		}
+		if err != nil {
+			zlog.Error().Err(err).Msg("signup bonus")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to register user"})
+		}
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "User registered successfully"})
 	}
-	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "User registered successfully"})
 }
 
-func Login(jwtKey string) fiber.Handler {
+// dummyUser is checked against when the username does not exist, so that
+// unknown users take as long to reject as wrong passwords.
+var dummyUser = func() models.User {
+	user := models.User{Password: "dummy password"}
+	_ = user.HashPassword()
+	return user
+}()
+
+func Login(tm *TokenManager, guard *LoginGuard) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		var input models.User
 		var user models.User
 		if err := c.BodyParser(&input); err != nil {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 		}
-		if err := database.DB.Where("username = ?", input.Username).First(&user).Error; err != nil {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "User not found"})
+
+		retryAfter, err := guard.Locked(c.Context(), input.Username, c.IP())
+		if err != nil {
+			zlog.Error().Err(err).Msg("login lockout check")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to check login attempts"})
+		}
+		if retryAfter > 0 {
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "Too many failed login attempts, try again later"})
+		}
+
+		found := database.DB.Where("username = ?", input.Username).First(&user).Error == nil
+		if !found {
+			user = dummyUser
+		}
+		if !user.CheckPassword(input.Password) || !found {
+			if err := guard.Failed(c.Context(), input.Username, c.IP()); err != nil {
+				zlog.Error().Err(err).Msg("login failure record")
+			}
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid username or password"})
+		}
+		if err := guard.Succeeded(c.Context(), user.Username); err != nil {
+			zlog.Error().Err(err).Msg("login failure reset")
+		}
+
+		if user.TOTPEnabled {
+			mfaToken, err := tm.IssueMFA(user)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+			}
+			return c.Status(fiber.StatusOK).JSON(fiber.Map{"mfa_required": true, "mfa_token": mfaToken})
+		}
+		return loginResponse(c, tm, user)
+	}
+}
+
+func loginResponse(c *fiber.Ctx, tm *TokenManager, user models.User) error {
+	session, err := startSession(c, tm, user)
+	if err != nil {
+		zlog.Error().Err(err).Msg("session create")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create session"})
+	}
+	tokens, err := tm.Issue(user, session.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+		"coins":         user.Coins,
+	})
+}
+
+// AuthRequired accepts access tokens and API keys. API keys are only let
+// through when the route lists scopes and the key holds all of them, so
+// account management stays limited to interactive logins.
+func AuthRequired(tm *TokenManager, scopes ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		header := c.Get(fiber.HeaderAuthorization)
+		if !strings.HasPrefix(header, "Bearer ") {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Unauthorized",
+			})
+		}
+		token := strings.TrimPrefix(header, "Bearer ")
+		if prefix, ok := models.ParseAPIKey(token); ok {
+			return apiKeyAuth(c, prefix, token, scopes)
+		}
+
+		claims, err := tm.Parse(token, TokenTypeAccess)
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Unauthorized",
+			})
+		}
+		revoked, err := tm.Revoked(c.Context(), claims)
+		if err != nil {
+			zlog.Error().Err(err).Msg("revocation check")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to check token",
+			})
+		}
+		if revoked {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Unauthorized",
+			})
 		}
-		if !user.CheckPassword(input.Password) {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Incorrect password"})
+
+		// Verify the user still exists and has not logged out everywhere
+		var user models.User
+		result := database.DB.Where("username = ?", claims.Username).First(&user)
+		if result.Error != nil {
+			if gorm.IsRecordNotFoundError(result.Error) {
+				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+					"error": "Unauthorized",
+				})
+			}
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Database error",
+			})
 		}
-		expirationTime := time.Now().Add(72 * time.Hour)
-		claims := &Claims{
-			Username: user.Username,
-			StandardClaims: jwt.StandardClaims{
-				ExpiresAt: expirationTime.Unix(),
-			},
+		if claims.TokenVersion != user.TokenVersion {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Unauthorized",
+			})
 		}
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-		tokenString, err := token.SignedString([]byte(jwtKey))
+		_, active, err := activeSession(claims, user)
+		if err != nil {
+			zlog.Error().Err(err).Msg("session check")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to check session",
+			})
+		}
+		if !active {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Unauthorized",
+			})
+		}
+
+		c.Locals("user", user)
+		c.Locals("claims", claims)
+		return c.Next()
+	}
+}
+
+func RefreshToken(tm *TokenManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		type RefreshRequest struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+
+		var req RefreshRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+		}
+
+		claims, err := tm.Parse(req.RefreshToken, TokenTypeRefresh)
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+		}
+
+		var user models.User
+		if err := database.DB.Where("username = ?", claims.Username).First(&user).Error; err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+		}
+		if claims.TokenVersion != user.TokenVersion {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+		}
+		session, active, err := activeSession(claims, user)
+		if err != nil {
+			zlog.Error().Err(err).Msg("session check")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to check session"})
+		}
+		if !active {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+		}
+
+		// Refresh tokens are single use. Seeing one again means it leaked,
+		// so every token of the user is invalidated.
+		fresh, err := tm.Revoke(c.Context(), claims)
+		if err != nil {
+			zlog.Error().Err(err).Msg("refresh token revoke")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to rotate token"})
+		}
+		if !fresh {
+			zlog.Warn().Str("user", user.Username).Msg("refresh token reuse detected")
+			if err := revokeAllTokens(user); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to revoke tokens"})
+			}
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+		}
+
+		if claims.SessionID == "" {
+			// Move logins from before sessions existed onto one
+			if session, err = startSession(c, tm, user); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create session"})
+			}
+		} else {
+			err = database.DB.Model(&session).UpdateColumn("expires_at", time.Now().Add(tm.RefreshTTL)).Error
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to extend session"})
+			}
+		}
+
+		tokens, err := tm.Issue(user, session.ID)
 		if err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 		}
-		return c.Status(fiber.StatusOK).JSON(fiber.Map{"token": tokenString, "coins": user.Coins})
+		return c.JSON(tokens)
 	}
 }
-func AuthRequired(c *fiber.Ctx) error {
-	type AuthRequest struct {
-		Username string `json:"username"`
-		File     string `json:"file"`
+
+func Logout(tm *TokenManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		type LogoutRequest struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+
+		var req LogoutRequest
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&req); err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+			}
+		}
+
+		user := c.Locals("user").(models.User)
+		revoke := []*Claims{c.Locals("claims").(*Claims)}
+		if req.RefreshToken != "" {
+			claims, err := tm.Parse(req.RefreshToken, TokenTypeRefresh)
+			if err != nil || claims.Username != user.Username {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid refresh token"})
+			}
+			revoke = append(revoke, claims)
+		}
+
+		for _, claims := range revoke {
+			if _, err := tm.Revoke(c.Context(), claims); err != nil {
+				zlog.Error().Err(err).Msg("token revoke")
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to revoke token"})
+			}
+		}
+		if sessionID := revoke[0].SessionID; sessionID != "" {
+			if _, err := revokeSession(user.ID, sessionID); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to revoke session"})
+			}
+		}
+		return c.JSON(fiber.Map{"message": "Logged out"})
 	}
+}
 
-	var req AuthRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Unauthorized. JSON Problem",
-		})
+func LogoutAll(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.User)
+	if err := revokeAllTokens(user); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to revoke tokens"})
 	}
+	return c.JSON(fiber.Map{"message": "Logged out from all devices"})
+}
 
-	if req.Username == "" {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Unauthorized",
-		})
+// revokeAllTokens invalidates every token issued to the user so far by bumping
+// the version they were signed with, and ends their sessions.
+func revokeAllTokens(user models.User) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).UpdateColumn("token_version", gorm.Expr("token_version + 1")).Error; err != nil {
+			return err
+		}
+		return revokeSessions(tx, user.ID)
+	})
+}
+
+// actingUser returns the account a request acts on. A username taken from the
+// request body, query or path must name the caller unless the caller is an admin.
+func actingUser(c *fiber.Ctx, username string) (models.User, error) {
+	user := c.Locals("user").(models.User)
+	if username == "" || username == user.Username {
+		return user, nil
+	}
+	// API keys never act for other users, even when an admin created them
+	if !user.HasRole(models.RoleAdmin) || c.Locals("api_key") != nil {
+		return models.User{}, errForbidden
 	}
 
-	// Verify the user exists in the database
-	var user models.User
-	result := database.DB.Where("username = ?", req.Username).First(&user)
-	if result.Error != nil {
-		if result.Error == gorm.ErrRecordNotFound {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "Unauthorized",
-			})
+	var target models.User
+	if err := database.DB.Where("username = ?", username).First(&target).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return models.User{}, errUserNotFound
 		}
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Database error",
-		})
+		return models.User{}, err
 	}
+	return target, nil
+}
+
+// errorResponse renders err as a JSON error, using the status code of a *fiber.Error.
+func errorResponse(c *fiber.Ctx, err error) error {
+	code := fiber.StatusInternalServerError
+	var e *fiber.Error
+	if errors.As(err, &e) {
+		code = e.Code
+	}
+	return c.Status(code).JSON(fiber.Map{"error": err.Error()})
+}
 
-	c.Locals("user", user)
-	return c.Next()
+// RoleRequired only lets users holding one of the roles through. It must run
+// after AuthRequired.
+func RoleRequired(roles ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user := c.Locals("user").(models.User)
+		if !user.HasRole(roles...) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Forbidden"})
+		}
+		return c.Next()
+	}
+}
+
+// JWKS publishes the public keys tokens can be verified with.
+func JWKS(keys *initializers.KeySet) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+		return c.JSON(keys.JWKS())
+	}
 }
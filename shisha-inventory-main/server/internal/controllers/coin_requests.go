@@ -0,0 +1,355 @@
+// internal/controllers/coin_requests.go
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"server/internal/database"
+	"server/internal/initializers"
+	"server/internal/ledger"
+	"server/internal/models"
+	"server/internal/rules"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+	zlog "github.com/rs/zerolog/log"
+)
+
+var (
+	errCoinRequestNotFound = fiber.NewError(fiber.StatusNotFound, "Request not found")
+	errCoinRequestAnswered = fiber.NewError(fiber.StatusConflict, "Request was already answered")
+	errCoinRequestExpired  = fiber.NewError(fiber.StatusGone, "Request has expired")
+)
+
+// CoinRequests lets a user ask another one for coins. The payer accepts,
+// which pays through the same transfer path as Tranfser, or declines. Requests
+// left unanswered expire after TTL. Every state change is published.
+type CoinRequests struct {
+	RedPandaBroker []string
+	Topic          string
+	TwoFactor      *TwoFactor
+	Rules          *RuleGuard
+	TTL            time.Duration
+}
+
+func NewCoinRequests(redPandaBroker []string, topic string, tf *TwoFactor, rg *RuleGuard, ttl time.Duration) *CoinRequests {
+	return &CoinRequests{
+		RedPandaBroker: redPandaBroker,
+		Topic:          topic,
+		TwoFactor:      tf,
+		Rules:          rg,
+		TTL:            ttl,
+	}
+}
+
+func (cr *CoinRequests) Create(c *fiber.Ctx) error {
+	type CreateRequest struct {
+		Payer  string `json:"payer"`
+		Amount int    `json:"amount"`
+		Note   string `json:"note"`
+	}
+
+	var req CreateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+	}
+	if req.Amount <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Amount must be greater than zero"})
+	}
+	if utf8.RuneCountInString(req.Note) > maxMemoLength {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("Note must be at most %d characters", maxMemoLength)})
+	}
+
+	user := c.Locals("user").(models.User)
+	if req.Payer == user.Username {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Cannot request coins from yourself"})
+	}
+	var payer models.User
+	if err := database.DB.Where("username = ?", req.Payer).First(&payer).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Payer not found"})
+	}
+
+	request := models.CoinRequest{
+		Requester: user.Username,
+		Payer:     payer.Username,
+		Amount:    req.Amount,
+		Note:      req.Note,
+		Status:    models.CoinRequestPending,
+		ExpiresAt: time.Now().Add(cr.TTL),
+	}
+	if err := database.DB.Create(&request).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create request"})
+	}
+	cr.publish(request)
+
+	return c.Status(fiber.StatusCreated).JSON(request)
+}
+
+// List shows the caller's coin requests, newest first. direction picks the
+// incoming requests the caller is asked to pay or the outgoing ones they made,
+// status filters by state. Older pages are fetched by passing the last id seen
+// as before.
+func (cr *CoinRequests) List(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.User)
+
+	limit := c.QueryInt("limit", defaultTransferLimit)
+	if limit <= 0 || limit > maxTransferLimit {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "limit must be between 1 and 200"})
+	}
+	before := c.QueryInt("before", 0)
+	if before < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid cursor"})
+	}
+
+	query := database.DB.Model(&models.CoinRequest{})
+	switch c.Query("direction") {
+	case "":
+		query = query.Where("requester = ? OR payer = ?", user.Username, user.Username)
+	case "incoming":
+		query = query.Where("payer = ?", user.Username)
+	case "outgoing":
+		query = query.Where("requester = ?", user.Username)
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "direction must be incoming or outgoing"})
+	}
+
+	// Do not show requests as pending once they are past their expiry
+	if err := cr.expireOverdue(query); err != nil {
+		zlog.Error().Err(err).Msg("coin request expiry")
+	}
+
+	switch status := c.Query("status"); status {
+	case "":
+	case models.CoinRequestPending, models.CoinRequestAccepted, models.CoinRequestDeclined, models.CoinRequestExpired:
+		query = query.Where("status = ?", status)
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Unknown status"})
+	}
+	if before > 0 {
+		query = query.Where("id < ?", before)
+	}
+
+	var requests []models.CoinRequest
+	if err := query.Order("id desc").Limit(limit).Find(&requests).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch requests"})
+	}
+	if requests == nil {
+		requests = []models.CoinRequest{}
+	}
+
+	response := fiber.Map{"requests": requests}
+	if len(requests) == limit {
+		response["next"] = requests[len(requests)-1].ID
+	}
+	return c.JSON(response)
+}
+
+// Accept pays a pending request addressed to the caller. The transfer and the
+// state change commit together, so a request is paid at most once.
+func (cr *CoinRequests) Accept(c *fiber.Ctx) error {
+	type AcceptRequest struct {
+		OTPCode string `json:"otp_code"`
+	}
+
+	var req AcceptRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+		}
+	}
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request id"})
+	}
+
+	user := c.Locals("user").(models.User)
+	request, err := cr.pending(uint(id), user.Username)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	if cr.TwoFactor.RequiredForTransfer(request.Amount) {
+		if !user.TOTPEnabled {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": fmt.Sprintf("Two-factor authentication must be enabled for transfers above %d coins", cr.TwoFactor.TransferThreshold)})
+		}
+		if req.OTPCode == "" {
+			return errorResponse(c, errTwoFactorCodeRequired)
+		}
+		if err := cr.TwoFactor.Verify(c.Context(), user, req.OTPCode, c.IP()); err != nil {
+			return errorResponse(c, err)
+		}
+	}
+
+	var op rules.Operation
+	var decision rules.Decision
+	var transfer models.Transfer
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Set("gorm:query_option", "FOR UPDATE").Where("id = ?", request.ID).First(&request).Error
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if request.Overdue(now) {
+			return errCoinRequestExpired
+		}
+		if request.Status != models.CoinRequestPending {
+			return errCoinRequestAnswered
+		}
+
+		op, decision, err = cr.Rules.Evaluate(tx, rules.KindTransfer, request.Payer, request.Requester, request.Amount)
+		if err != nil || decision.Action != rules.Allow {
+			return err
+		}
+		transfer, err = ledger.TransferTx(tx, request.Payer, request.Requester, request.Amount, request.Note)
+		if err != nil {
+			return err
+		}
+		request.Status = models.CoinRequestAccepted
+		request.TransferID = &transfer.ID
+		request.RespondedAt = &now
+		return tx.Model(&request).Updates(map[string]interface{}{
+			"status":       request.Status,
+			"transfer_id":  transfer.ID,
+			"responded_at": now,
+		}).Error
+	})
+	if err == nil {
+		// A stopped payment leaves the request pending
+		if record := cr.Rules.Record(op, decision); decision.Action != rules.Allow {
+			return ruleResponse(c, record)
+		}
+	}
+	if err == ledger.ErrInsufficientFunds {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Insufficient coins"})
+	}
+	if err == errCoinRequestExpired {
+		cr.expire(request)
+		return errorResponse(c, err)
+	}
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	producer, err := initializers.NewProducer(cr.RedPandaBroker, cr.Topic)
+	if err == nil {
+		producer.SendTransferMessage(context.Background(), request.Payer, request.Requester, request.Amount)
+	}
+	cr.publish(request)
+
+	return c.JSON(fiber.Map{"message": "Request accepted", "request": request})
+}
+
+// Decline turns down a pending request addressed to the caller.
+func (cr *CoinRequests) Decline(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request id"})
+	}
+
+	user := c.Locals("user").(models.User)
+	now := time.Now()
+	result := database.DB.Model(&models.CoinRequest{}).
+		Where("id = ? AND payer = ? AND status = ? AND expires_at > ?", id, user.Username, models.CoinRequestPending, now).
+		Updates(map[string]interface{}{"status": models.CoinRequestDeclined, "responded_at": now})
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to decline request"})
+	}
+	if result.RowsAffected == 0 {
+		// Tell the caller why
+		_, err := cr.pending(uint(id), user.Username)
+		if err == nil {
+			err = errCoinRequestAnswered
+		}
+		return errorResponse(c, err)
+	}
+
+	var request models.CoinRequest
+	if err := database.DB.First(&request, id).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to load request"})
+	}
+	cr.publish(request)
+
+	return c.JSON(fiber.Map{"message": "Request declined", "request": request})
+}
+
+// pending loads a request addressed to payer that can still be answered.
+func (cr *CoinRequests) pending(id uint, payer string) (models.CoinRequest, error) {
+	var request models.CoinRequest
+	err := database.DB.Where("id = ? AND payer = ?", id, payer).First(&request).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return request, errCoinRequestNotFound
+	}
+	if err != nil {
+		return request, err
+	}
+	if request.Overdue(time.Now()) {
+		cr.expire(request)
+		return request, errCoinRequestExpired
+	}
+	if request.Status != models.CoinRequestPending {
+		return request, errCoinRequestAnswered
+	}
+	return request, nil
+}
+
+// ExpireOverdue expires every pending request past its expiry.
+func (cr *CoinRequests) ExpireOverdue() error {
+	return cr.expireOverdue(database.DB)
+}
+
+func (cr *CoinRequests) expireOverdue(query *gorm.DB) error {
+	var overdue []models.CoinRequest
+	err := query.Where("status = ? AND expires_at <= ?", models.CoinRequestPending, time.Now()).Find(&overdue).Error
+	if err != nil {
+		return err
+	}
+	for _, request := range overdue {
+		cr.expire(request)
+	}
+	return nil
+}
+
+// expire marks a pending request expired. The update is guarded by the status,
+// so when several replicas race only the one switching it publishes the event.
+func (cr *CoinRequests) expire(request models.CoinRequest) {
+	result := database.DB.Model(&models.CoinRequest{}).
+		Where("id = ? AND status = ?", request.ID, models.CoinRequestPending).
+		UpdateColumn("status", models.CoinRequestExpired)
+	if result.Error != nil {
+		zlog.Error().Err(result.Error).Uint("request", request.ID).Msg("coin request expiry")
+		return
+	}
+	if result.RowsAffected == 1 {
+		request.Status = models.CoinRequestExpired
+		cr.publish(request)
+	}
+}
+
+// Run expires overdue requests every interval until ctx is done.
+func (cr *CoinRequests) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := cr.ExpireOverdue(); err != nil {
+				zlog.Error().Err(err).Msg("coin request expiry")
+			}
+		}
+	}
+}
+
+func (cr *CoinRequests) publish(request models.CoinRequest) {
+	producer, err := initializers.NewProducer(cr.RedPandaBroker, cr.Topic)
+	if err != nil {
+		zlog.Error().Err(err).Uint("request", request.ID).Msg("coin request event")
+		return
+	}
+	// The record is produced asynchronously, so do not tie it to the request
+	producer.SendCoinRequestMessage(context.Background(), request.Requester, request.Payer, request.ID, request.Amount, request.Status)
+}
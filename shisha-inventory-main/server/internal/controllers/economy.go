@@ -0,0 +1,126 @@
+// internal/controllers/economy.go
+package controllers
+
+import (
+	"server/internal/database"
+	"server/internal/economy"
+	"server/internal/models"
+
+	"github.com/gofiber/fiber/v2"
+	zlog "github.com/rs/zerolog/log"
+)
+
+// EconomyPolicy shows the policy in force. Version 0 means no policy is
+// stored and the defaults apply.
+func EconomyPolicy(c *fiber.Ctx) error {
+	policy, err := economy.Current(database.DB)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch policy"})
+	}
+	return c.JSON(policy)
+}
+
+// UpdateEconomyPolicy stores a new policy version, which applies to every
+// movement from then on. Amounts left out keep their current value.
+func UpdateEconomyPolicy(c *fiber.Ctx) error {
+	current, err := economy.Current(database.DB)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch policy"})
+	}
+
+	type PolicyRequest struct {
+		SignupBonus           *int   `json:"signup_bonus"`
+		UploadReward          *int   `json:"upload_reward"`
+		PremiumPrice          *int   `json:"premium_price"`
+		DailyReward           *int   `json:"daily_reward"`
+		DailyRewardStep       *int   `json:"daily_reward_step"`
+		DailyRewardMax        *int   `json:"daily_reward_max"`
+		ReferralBonus         *int   `json:"referral_bonus"`
+		InviteeBonus          *int   `json:"invitee_bonus"`
+		MarketplaceCommission *int   `json:"marketplace_commission"`
+		Comment               string `json:"comment"`
+	}
+	var req PolicyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+	}
+	policy := models.EconomyPolicy{
+		SignupBonus:           current.SignupBonus,
+		UploadReward:          current.UploadReward,
+		PremiumPrice:          current.PremiumPrice,
+		DailyReward:           current.DailyReward,
+		DailyRewardStep:       current.DailyRewardStep,
+		DailyRewardMax:        current.DailyRewardMax,
+		ReferralBonus:         current.ReferralBonus,
+		InviteeBonus:          current.InviteeBonus,
+		MarketplaceCommission: current.MarketplaceCommission,
+		Comment:               req.Comment,
+	}
+	if req.SignupBonus != nil {
+		policy.SignupBonus = *req.SignupBonus
+	}
+	if req.UploadReward != nil {
+		policy.UploadReward = *req.UploadReward
+	}
+	if req.PremiumPrice != nil {
+		policy.PremiumPrice = *req.PremiumPrice
+	}
+	if req.DailyReward != nil {
+		policy.DailyReward = *req.DailyReward
+	}
+	if req.DailyRewardStep != nil {
+		policy.DailyRewardStep = *req.DailyRewardStep
+	}
+	if req.DailyRewardMax != nil {
+		policy.DailyRewardMax = *req.DailyRewardMax
+	}
+	if req.ReferralBonus != nil {
+		policy.ReferralBonus = *req.ReferralBonus
+	}
+	if req.InviteeBonus != nil {
+		policy.InviteeBonus = *req.InviteeBonus
+	}
+	if req.MarketplaceCommission != nil {
+		policy.MarketplaceCommission = *req.MarketplaceCommission
+	}
+	if err := economy.Validate(policy); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	admin := c.Locals("user").(models.User)
+	policy, err = economy.Update(database.DB, policy, admin.Username)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update policy"})
+	}
+
+	zlog.Info().Str("admin", admin.Username).Uint("version", policy.ID).Int("signup_bonus", policy.SignupBonus).
+		Int("upload_reward", policy.UploadReward).Int("premium_price", policy.PremiumPrice).Msg("economy policy changed")
+	return c.JSON(policy)
+}
+
+// EconomyPolicyHistory lists policy versions, newest first. Older pages are
+// fetched by passing the last version seen as before.
+func EconomyPolicyHistory(c *fiber.Ctx) error {
+	limit := c.QueryInt("limit", defaultTransferLimit)
+	if limit <= 0 || limit > maxTransferLimit {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "limit must be between 1 and 200"})
+	}
+	before := c.QueryInt("before", 0)
+	if before < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid cursor"})
+	}
+
+	policies, err := economy.History(database.DB, uint(before), limit)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch policies"})
+	}
+	if policies == nil {
+		policies = []models.EconomyPolicy{}
+	}
+
+	response := fiber.Map{"policies": policies}
+	if len(policies) == limit {
+		response["next"] = policies[len(policies)-1].ID
+	}
+	return c.JSON(response)
+}
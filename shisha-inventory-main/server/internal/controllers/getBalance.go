@@ -1,21 +1,13 @@
 package controllers
 
 import (
-	"server/internal/database"
-	"server/internal/models"
-
 	"github.com/gofiber/fiber/v2"
 )
 
 func Balance(c *fiber.Ctx) error {
-	username := c.Query("username")
-	if username == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "username is required"})
-	}
-
-	var user models.User
-	if err := database.DB.Where("username = ?", username).First(&user).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "user not found"})
+	user, err := actingUser(c, c.Query("username"))
+	if err != nil {
+		return errorResponse(c, err)
 	}
 
 	return c.JSON(fiber.Map{"balance": user.Coins})
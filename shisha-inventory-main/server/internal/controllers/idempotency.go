@@ -0,0 +1,181 @@
+// internal/controllers/idempotency.go
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"server/internal/models"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gofiber/fiber/v2"
+	zlog "github.com/rs/zerolog/log"
+)
+
+const (
+	HeaderIdempotencyKey      = "Idempotency-Key"
+	HeaderIdempotentReplayed  = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+	idempotencyPendingTimeout = time.Minute
+)
+
+// idempotencyRecord is what is kept in Redis for a key. Response fields are
+// empty while the first request is still running.
+type idempotencyRecord struct {
+	Fingerprint string `json:"fingerprint"`
+	Done        bool   `json:"done"`
+	Status      int    `json:"status,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+// Idempotency lets clients retry a request safely by sending the same
+// Idempotency-Key header. The response of the first request is stored for TTL
+// and replayed for retries. It must run after AuthRequired, keys are per user.
+type Idempotency struct {
+	RedisClient *redis.Client
+	TTL         time.Duration
+}
+
+func NewIdempotency(redisClient *redis.Client, ttl time.Duration) *Idempotency {
+	return &Idempotency{
+		RedisClient: redisClient,
+		TTL:         ttl,
+	}
+}
+
+func (i *Idempotency) Handler(c *fiber.Ctx) error {
+	key := c.Get(HeaderIdempotencyKey)
+	if key == "" {
+		return c.Next()
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Idempotency-Key is too long"})
+	}
+
+	fingerprint, err := requestFingerprint(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Failed to read request"})
+	}
+
+	user := c.Locals("user").(models.User)
+	redisKey := fmt.Sprintf("idempotency:%d:%s", user.ID, key)
+
+	pending, _ := json.Marshal(idempotencyRecord{Fingerprint: fingerprint})
+	first, err := i.RedisClient.SetNX(c.Context(), redisKey, pending, idempotencyPendingTimeout).Result()
+	if err != nil {
+		zlog.Error().Err(err).Msg("idempotency key store")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to check Idempotency-Key"})
+	}
+	if !first {
+		return i.replay(c, redisKey, fingerprint)
+	}
+
+	if err := c.Next(); err != nil {
+		i.forget(c, redisKey)
+		return err
+	}
+	// Server errors are not final, let the client try again
+	if c.Response().StatusCode() >= fiber.StatusInternalServerError {
+		i.forget(c, redisKey)
+		return nil
+	}
+
+	done, _ := json.Marshal(idempotencyRecord{
+		Fingerprint: fingerprint,
+		Done:        true,
+		Status:      c.Response().StatusCode(),
+		ContentType: string(c.Response().Header.ContentType()),
+		Body:        c.Response().Body(),
+	})
+	if err := i.RedisClient.Set(c.Context(), redisKey, done, i.TTL).Err(); err != nil {
+		zlog.Error().Err(err).Msg("idempotency response store")
+	}
+	return nil
+}
+
+func (i *Idempotency) replay(c *fiber.Ctx, redisKey, fingerprint string) error {
+	data, err := i.RedisClient.Get(c.Context(), redisKey).Bytes()
+	if err == redis.Nil {
+		// The first request failed in the meantime
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Request with this Idempotency-Key failed, retry it"})
+	}
+	if err != nil {
+		zlog.Error().Err(err).Msg("idempotency key load")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to check Idempotency-Key"})
+	}
+
+	var record idempotencyRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to check Idempotency-Key"})
+	}
+	if record.Fingerprint != fingerprint {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Idempotency-Key was already used for a different request"})
+	}
+	if !record.Done {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Request with this Idempotency-Key is still in progress"})
+	}
+
+	c.Set(HeaderIdempotentReplayed, "true")
+	c.Set(fiber.HeaderContentType, record.ContentType)
+	return c.Status(record.Status).Send(record.Body)
+}
+
+func (i *Idempotency) forget(c *fiber.Ctx, redisKey string) {
+	if err := i.RedisClient.Del(c.Context(), redisKey).Err(); err != nil {
+		zlog.Error().Err(err).Msg("idempotency key release")
+	}
+}
+
+// requestFingerprint hashes what makes two requests the same. Multipart
+// bodies are hashed by their fields and file contents, since clients pick a
+// new boundary on every attempt.
+func requestFingerprint(c *fiber.Ctx) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", c.Method(), c.Path())
+
+	if !strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEMultipartForm) {
+		h.Write(c.Body())
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		return "", err
+	}
+	names := make([]string, 0, len(form.Value))
+	for name := range form.Value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "value %s=%q\n", name, form.Value[name])
+	}
+
+	names = names[:0]
+	for name := range form.File {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, file := range form.File[name] {
+			fmt.Fprintf(h, "file %s=%s %d\n", name, file.Filename, file.Size)
+			f, err := file.Open()
+			if err != nil {
+				return "", err
+			}
+			_, err = io.Copy(h, f)
+			f.Close()
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -2,10 +2,15 @@ package controllers
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
 	"server/internal/initializers"
+	"server/internal/ledger"
 	"server/internal/models"
+	"server/internal/rules"
 	"strconv"
 	"time"
 
@@ -15,6 +20,8 @@ import (
 	zlog "github.com/rs/zerolog/log"
 )
 
+var errAlreadyPurchased = errors.New("image already purchased")
+
 type ImageController struct {
 	DB           *gorm.DB
 	MinioClient  *minio.Client
@@ -106,11 +113,12 @@ func setHostname(addr, hostname string) (string, error) {
 	return u.String(), nil
 }
 
-func (ic *ImageController) PurchaseImage(topic string, brokers []string) fiber.Handler {
+func (ic *ImageController) PurchaseImage(topic string, brokers []string, rg *RuleGuard) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		type PurchaseRequest struct {
-			ImageID  uint   `json:"image_id"`
-			UserName string `json:"user_name"`
+			ImageID   uint   `json:"image_id"`
+			ListingID uint   `json:"listing_id"`
+			UserName  string `json:"user_name"`
 		}
 
 		var request PurchaseRequest
@@ -118,9 +126,13 @@ func (ic *ImageController) PurchaseImage(topic string, brokers []string) fiber.H
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request"})
 		}
 
-		var purchase models.Purchase
-		if err := ic.DB.Where("user_name = ? AND image_id = ?", request.UserName, request.ImageID).First(&purchase).Error; err == nil {
-			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "You have already purchased this image"})
+		user, err := actingUser(c, request.UserName)
+		if err != nil {
+			return errorResponse(c, err)
+		}
+		// Uploaded images are bought from their seller's listing
+		if request.ListingID != 0 {
+			return ic.purchaseListing(c, topic, brokers, rg, user, request.ListingID)
 		}
 
 		var image models.PremiumImage
@@ -128,57 +140,85 @@ func (ic *ImageController) PurchaseImage(topic string, brokers []string) fiber.H
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Image not found"})
 		}
 
-		var user models.User
-		if err := ic.DB.Where("username = ?", request.UserName).First(&user).Error; err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
-		}
-
-		if user.Coins < 25 {
-			return c.Status(fiber.StatusPaymentRequired).JSON(fiber.Map{"error": "Insufficient coins"})
-		}
-
-		user.Coins -= 25
-		if err := ic.DB.Save(&user).Error; err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update user balance"})
-		}
-
-		purchase = models.Purchase{
-			UserName:  request.UserName,
-			ImageID:   request.ImageID,
+		purchase := models.Purchase{
+			UserName:  user.Username,
+			ImageID:   image.ID,
+			Price:     image.Price,
 			ImageUUID: image.UUID,
 			ImageName: image.Name,
 			Hash:      image.Hash,
 		}
-		if err := ic.DB.Create(&purchase).Error; err != nil {
-			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create purchase record"})
+		// The purchase row and the payment are written together, and the unique
+		// index on unrefunded (user_name, image_id) settles concurrent purchases
+		var op rules.Operation
+		var decision rules.Decision
+		err = ic.DB.Transaction(func(tx *gorm.DB) error {
+			var err error
+			op, decision, err = rg.Evaluate(tx, rules.KindPurchase, user.Username, "", image.Price)
+			if err != nil || decision.Action != rules.Allow {
+				return err
+			}
+			err = tx.Set("gorm:insert_option", "ON CONFLICT (user_name, seller, image_id) WHERE refunded_at IS NULL DO NOTHING").Create(&purchase).Error
+			// A skipped insert returns no id to scan
+			if errors.Is(err, sql.ErrNoRows) {
+				return errAlreadyPurchased
+			}
+			if err != nil {
+				return err
+			}
+			_, err = ledger.Move(tx, nil, ledger.UserAccount(user.Username), ledger.AccountShop, image.Price, ledger.ReasonPurchase, fmt.Sprintf("purchase:%d", purchase.ID))
+			return err
+		})
+		if err == nil {
+			if record := rg.Record(op, decision); decision.Action != rules.Allow {
+				return ruleResponse(c, record)
+			}
+		}
+		if err != nil {
+			return purchaseError(c, err)
 		}
 
 		producer, err := initializers.NewProducer(brokers, topic)
 		if err != nil {
 			return err
 		}
-		producer.SendBuyMessage(ic.Ctx, user.Username, image.UUID, 25)
+		producer.SendBuyMessage(ic.Ctx, user.Username, image.UUID, image.Price)
 
 		return c.JSON(fiber.Map{"message": "Image purchased successfully"})
 	}
 }
 
-func (ic *ImageController) GetPurchasedImages(c *fiber.Ctx) error {
-	userName := c.Params("userName")
+// purchaseError renders why a purchase transaction failed.
+func purchaseError(c *fiber.Ctx, err error) error {
+	if err == errAlreadyPurchased {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "You have already purchased this image"})
+	}
+	if err == ledger.ErrInsufficientFunds {
+		return c.Status(fiber.StatusPaymentRequired).JSON(fiber.Map{"error": "Insufficient coins"})
+	}
+	return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create purchase record"})
+}
 
-	if userName == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "User ID is required"})
+func (ic *ImageController) GetPurchasedImages(c *fiber.Ctx) error {
+	user, err := actingUser(c, c.Params("userName"))
+	if err != nil {
+		return errorResponse(c, err)
 	}
 
 	var purchases []models.Purchase
-	if err := ic.DB.Where("user_name = ?", userName).Find(&purchases).Error; err != nil {
+	if err := ic.DB.Where("user_name = ? AND refunded_at IS NULL", user.Username).Find(&purchases).Error; err != nil {
 		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch purchases"})
 	}
 
 	var imageList []fiber.Map
 	for _, image := range purchases {
+		// Marketplace purchases are uploads and stored like them
+		bucket, object := "premium-images", image.Hash+".jpg"
+		if image.Seller != "" {
+			bucket, object = "user-images", image.ImageName
+		}
 		reqParams := make(url.Values)
-		presignedURL, err := ic.MinioClient.PresignedGetObject(ic.Ctx, "premium-images", image.Hash+".jpg", time.Hour*24, reqParams)
+		presignedURL, err := ic.MinioClient.PresignedGetObject(ic.Ctx, bucket, object, time.Hour*24, reqParams)
 		if err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to get image URL"})
 		}
@@ -193,6 +233,7 @@ func (ic *ImageController) GetPurchasedImages(c *fiber.Ctx) error {
 			"name":    image.ImageName,
 			"url":     u.Scheme + "://" + u.Host + u.Path,
 			"buytime": image.CreatedAt,
+			"seller":  image.Seller,
 		})
 	}
 
@@ -200,14 +241,15 @@ func (ic *ImageController) GetPurchasedImages(c *fiber.Ctx) error {
 }
 
 func (ic *ImageController) GetPurchasedImageIDs(c *fiber.Ctx) error {
-	userName := c.Params("userName")
-	if userName == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "UserName is required"})
+	user, err := actingUser(c, c.Params("userName"))
+	if err != nil {
+		return errorResponse(c, err)
 	}
 
 	var purchasedImages []models.Purchase
 
-	if err := ic.DB.Where("user_name = ?", userName).Select("image_id").Find(&purchasedImages).Error; err != nil {
+	// Only premium image ids, uploaded images are numbered apart
+	if err := ic.DB.Where("user_name = ? AND seller = '' AND refunded_at IS NULL", user.Username).Select("image_id").Find(&purchasedImages).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to retrieve purchased image IDs",
 		})
@@ -0,0 +1,56 @@
+// internal/controllers/ledger.go
+package controllers
+
+import (
+	"server/internal/database"
+	"server/internal/ledger"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultLedgerLimit = 50
+	maxLedgerLimit     = 200
+)
+
+// Ledger lists the ledger entries of the caller's account, newest first.
+// Older pages are fetched by passing the last id seen as before.
+func Ledger(c *fiber.Ctx) error {
+	user, err := actingUser(c, c.Query("username"))
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	limit := c.QueryInt("limit", defaultLedgerLimit)
+	if limit <= 0 || limit > maxLedgerLimit {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "limit must be between 1 and 200"})
+	}
+	before := c.QueryInt("before", 0)
+	if before < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid cursor"})
+	}
+
+	entries, err := ledger.Entries(database.DB, ledger.UserAccount(user.Username), uint(before), limit)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch ledger"})
+	}
+
+	entryList := make([]fiber.Map, 0, len(entries))
+	for _, entry := range entries {
+		entryList = append(entryList, fiber.Map{
+			"id":             entry.ID,
+			"tx_id":          entry.TxID,
+			"amount":         entry.Amount,
+			"reason":         entry.Reason,
+			"reference":      entry.Reference,
+			"policy_version": entry.PolicyVersion,
+			"created_at":     entry.CreatedAt,
+		})
+	}
+
+	response := fiber.Map{"balance": user.Coins, "entries": entryList}
+	if len(entries) == limit {
+		response["next"] = entries[len(entries)-1].ID
+	}
+	return c.JSON(response)
+}
@@ -0,0 +1,297 @@
+// internal/controllers/listings.go
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"server/internal/database"
+	"server/internal/economy"
+	"server/internal/initializers"
+	"server/internal/ledger"
+	"server/internal/models"
+	"server/internal/rules"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+	zlog "github.com/rs/zerolog/log"
+)
+
+// maxListingPrice bounds what a seller can ask for an image
+const maxListingPrice = 100000
+
+var (
+	errListingNotFound    = errors.New("listing not found")
+	errListingUnavailable = errors.New("listing is not active")
+	errOwnListing         = errors.New("cannot buy own listing")
+)
+
+// listingRow is a listing with the image it sells.
+type listingRow struct {
+	ID        uint      `json:"id"`
+	ImageID   uint      `json:"image_id"`
+	ImageUUID string    `json:"image_uuid"`
+	ImageName string    `json:"image_name"`
+	Seller    string    `json:"seller"`
+	Price     int       `json:"price"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func listingQuery() *gorm.DB {
+	return database.DB.Table("listings").
+		Select("listings.*, images.uuid AS image_uuid, images.name AS image_name").
+		Joins("JOIN images ON images.id = listings.image_id")
+}
+
+// findListings runs query for a page of listings, newest first, and renders it.
+func findListings(c *fiber.Ctx, query *gorm.DB) error {
+	limit := c.QueryInt("limit", defaultTransferLimit)
+	if limit <= 0 || limit > maxTransferLimit {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "limit must be between 1 and 200"})
+	}
+	before := c.QueryInt("before", 0)
+	if before < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid cursor"})
+	}
+	if before > 0 {
+		query = query.Where("listings.id < ?", before)
+	}
+
+	listings := []listingRow{}
+	if err := query.Order("listings.id desc").Limit(limit).Scan(&listings).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch listings"})
+	}
+
+	response := fiber.Map{"listings": listings}
+	if len(listings) == limit {
+		response["next"] = listings[len(listings)-1].ID
+	}
+	return c.JSON(response)
+}
+
+// Listings shows the marketplace: active listings, newest first, optionally
+// of one seller. Older pages are fetched by passing the last id seen as
+// before.
+func Listings(c *fiber.Ctx) error {
+	query := listingQuery().Where("listings.status = ?", models.ListingActive)
+	if seller := c.Query("seller"); seller != "" {
+		query = query.Where("listings.seller = ?", seller)
+	}
+	return findListings(c, query)
+}
+
+// MyListings shows the caller's listings in every state, newest first.
+func MyListings(c *fiber.Ctx) error {
+	user, err := actingUser(c, c.Query("username"))
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	return findListings(c, listingQuery().Where("listings.seller = ?", user.Username))
+}
+
+// CreateListing puts one of the caller's uploads up for sale.
+func CreateListing(c *fiber.Ctx) error {
+	type ListingRequest struct {
+		ImageID uint `json:"image_id"`
+		Price   int  `json:"price"`
+	}
+
+	var req ListingRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+	}
+	if req.Price <= 0 || req.Price > maxListingPrice {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("Price must be between 1 and %d", maxListingPrice)})
+	}
+
+	user := c.Locals("user").(models.User)
+	var image models.Image
+	err := database.DB.Where("id = ? AND username = ?", req.ImageID, user.Username).First(&image).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "You have not uploaded this image"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch image"})
+	}
+
+	listing := models.Listing{ImageID: image.ID, Seller: user.Username, Price: req.Price, Status: models.ListingActive}
+	// The unique index on open listings settles concurrent requests
+	err = database.DB.Set("gorm:insert_option", "ON CONFLICT (image_id) WHERE status <> 'withdrawn' DO NOTHING").Create(&listing).Error
+	if errors.Is(err, sql.ErrNoRows) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "This image is already listed"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create listing"})
+	}
+	return c.Status(fiber.StatusCreated).JSON(listing)
+}
+
+// UpdateListing changes the price of one of the caller's listings, or pauses
+// and resumes it.
+func UpdateListing(c *fiber.Ctx) error {
+	type ListingRequest struct {
+		Price  *int    `json:"price"`
+		Status *string `json:"status"`
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid listing id"})
+	}
+	var req ListingRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+	}
+	updates := map[string]interface{}{}
+	if req.Price != nil {
+		if *req.Price <= 0 || *req.Price > maxListingPrice {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("Price must be between 1 and %d", maxListingPrice)})
+		}
+		updates["price"] = *req.Price
+	}
+	if req.Status != nil {
+		if *req.Status != models.ListingActive && *req.Status != models.ListingPaused {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Status must be active or paused"})
+		}
+		updates["status"] = *req.Status
+	}
+	if len(updates) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Nothing to update"})
+	}
+
+	user := c.Locals("user").(models.User)
+	result := database.DB.Model(&models.Listing{}).
+		Where("id = ? AND seller = ? AND status <> ?", id, user.Username, models.ListingWithdrawn).
+		Updates(updates)
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update listing"})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Listing not found"})
+	}
+
+	var listing models.Listing
+	if err := database.DB.First(&listing, id).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch listing"})
+	}
+	return c.JSON(listing)
+}
+
+// WithdrawListing takes one of the caller's listings off the marketplace for
+// good. Buyers keep the image.
+func WithdrawListing(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid listing id"})
+	}
+	user := c.Locals("user").(models.User)
+
+	result := database.DB.Model(&models.Listing{}).
+		Where("id = ? AND seller = ? AND status <> ?", id, user.Username, models.ListingWithdrawn).
+		Update("status", models.ListingWithdrawn)
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to withdraw listing"})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Listing not found"})
+	}
+	return c.JSON(fiber.Map{"message": "Listing withdrawn"})
+}
+
+// purchaseListing buys an uploaded image from its seller. The seller is paid
+// the price minus the commission of the economy policy, which goes to the
+// shop. The listing is locked, so a price change, pause or withdrawal lands
+// either before or after the sale.
+func (ic *ImageController) purchaseListing(c *fiber.Ctx, topic string, brokers []string, rg *RuleGuard, user models.User, listingID uint) error {
+	var listing models.Listing
+	var image models.Image
+	var commission int
+	var op rules.Operation
+	var decision rules.Decision
+	err := ic.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Set("gorm:query_option", "FOR UPDATE").First(&listing, listingID).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return errListingNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if listing.Status != models.ListingActive {
+			return errListingUnavailable
+		}
+		if listing.Seller == user.Username {
+			return errOwnListing
+		}
+		if err := tx.First(&image, listing.ImageID).Error; err != nil {
+			return err
+		}
+
+		op, decision, err = rg.Evaluate(tx, rules.KindPurchase, user.Username, listing.Seller, listing.Price)
+		if err != nil || decision.Action != rules.Allow {
+			return err
+		}
+		policy, err := economy.Current(tx)
+		if err != nil {
+			return err
+		}
+		commission = policy.Commission(listing.Price)
+
+		purchase := models.Purchase{
+			UserName:   user.Username,
+			ImageID:    image.ID,
+			Seller:     listing.Seller,
+			ListingID:  &listing.ID,
+			Price:      listing.Price,
+			Commission: commission,
+			ImageUUID:  image.UUID,
+			ImageName:  image.Name,
+			Hash:       image.Hash,
+		}
+		err = tx.Set("gorm:insert_option", "ON CONFLICT (user_name, seller, image_id) WHERE refunded_at IS NULL DO NOTHING").Create(&purchase).Error
+		if errors.Is(err, sql.ErrNoRows) {
+			return errAlreadyPurchased
+		}
+		if err != nil {
+			return err
+		}
+
+		postings := []ledger.Posting{{Account: ledger.UserAccount(user.Username), Amount: -listing.Price}}
+		if listing.Price > commission {
+			postings = append(postings, ledger.Posting{Account: ledger.UserAccount(listing.Seller), Amount: listing.Price - commission})
+		}
+		if commission > 0 {
+			postings = append(postings, ledger.Posting{Account: ledger.AccountShop, Amount: commission})
+		}
+		_, err = ledger.Post(tx, policy.Version(), ledger.ReasonPurchase, fmt.Sprintf("purchase:%d", purchase.ID), postings...)
+		return err
+	})
+	if err == nil {
+		if record := rg.Record(op, decision); decision.Action != rules.Allow {
+			return ruleResponse(c, record)
+		}
+	}
+	switch err {
+	case errListingNotFound:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Listing not found"})
+	case errListingUnavailable:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "This listing is not for sale"})
+	case errOwnListing:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "You cannot buy your own image"})
+	}
+	if err != nil {
+		return purchaseError(c, err)
+	}
+
+	zlog.Info().Str("buyer", user.Username).Str("seller", listing.Seller).Uint("listing", listing.ID).Int("price", listing.Price).Int("commission", commission).Msg("marketplace sale")
+	producer, err := initializers.NewProducer(brokers, topic)
+	if err != nil {
+		return err
+	}
+	producer.SendSaleMessage(ic.Ctx, user.Username, listing.Seller, image.UUID, listing.ID, listing.Price, commission)
+
+	return c.JSON(fiber.Map{"message": "Image purchased successfully"})
+}
@@ -0,0 +1,114 @@
+// internal/controllers/login_guard.go
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"server/internal/initializers"
+
+	"github.com/go-redis/redis/v8"
+	zlog "github.com/rs/zerolog/log"
+)
+
+// LoginGuard counts failed logins per username and per client IP and locks
+// the key out for an exponentially growing window once a limit is reached.
+type LoginGuard struct {
+	RedisClient     *redis.Client
+	RedPandaBroker  []string
+	Topic           string
+	MaxUserFailures int
+	MaxIPFailures   int
+	BaseLockout     time.Duration
+	MaxLockout      time.Duration
+	FailureWindow   time.Duration
+}
+
+func NewLoginGuard(redisClient *redis.Client, redPandaBroker []string, topic string) *LoginGuard {
+	return &LoginGuard{
+		RedisClient:     redisClient,
+		RedPandaBroker:  redPandaBroker,
+		Topic:           topic,
+		MaxUserFailures: 5,
+		MaxIPFailures:   20,
+		BaseLockout:     time.Minute,
+		MaxLockout:      time.Hour,
+		FailureWindow:   15 * time.Minute,
+	}
+}
+
+// Locked returns how long the username or IP is still locked out for.
+func (lg *LoginGuard) Locked(ctx context.Context, username, ip string) (time.Duration, error) {
+	var retryAfter time.Duration
+	for _, key := range []string{lockKey("user", username), lockKey("ip", ip)} {
+		ttl, err := lg.RedisClient.PTTL(ctx, key).Result()
+		if err != nil {
+			return 0, err
+		}
+		if ttl > retryAfter {
+			retryAfter = ttl
+		}
+	}
+	return retryAfter, nil
+}
+
+// Failed records a failed attempt and starts a lockout when a limit is hit.
+func (lg *LoginGuard) Failed(ctx context.Context, username, ip string) error {
+	if err := lg.fail(ctx, "user", username, username, ip, lg.MaxUserFailures); err != nil {
+		return err
+	}
+	return lg.fail(ctx, "ip", ip, username, ip, lg.MaxIPFailures)
+}
+
+// Succeeded forgets the failures of the username. IP failures are kept so a
+// single valid account cannot be used to reset a credential stuffing run.
+func (lg *LoginGuard) Succeeded(ctx context.Context, username string) error {
+	return lg.RedisClient.Del(ctx, failKey("user", username)).Err()
+}
+
+func (lg *LoginGuard) fail(ctx context.Context, scope, value, username, ip string, limit int) error {
+	key := failKey(scope, value)
+	failures, err := lg.RedisClient.Incr(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+	if failures < int64(limit) {
+		return lg.RedisClient.Expire(ctx, key, lg.FailureWindow).Err()
+	}
+
+	lockout := lg.lockout(int(failures) - limit)
+	if err := lg.RedisClient.Set(ctx, lockKey(scope, value), failures, lockout).Err(); err != nil {
+		return err
+	}
+	if err := lg.RedisClient.Expire(ctx, key, lockout+lg.FailureWindow).Err(); err != nil {
+		return err
+	}
+
+	zlog.Warn().Str("scope", scope).Str("user", username).Str("ip", ip).Int64("failures", failures).Dur("lockout", lockout).Msg("login locked out")
+	producer, err := initializers.NewProducer(lg.RedPandaBroker, lg.Topic)
+	if err != nil {
+		return err
+	}
+	// The record is produced asynchronously, so do not tie it to the request
+	producer.SendLockoutMessage(context.Background(), username, ip, scope, int(failures), lockout)
+	return nil
+}
+
+func (lg *LoginGuard) lockout(excess int) time.Duration {
+	lockout := lg.BaseLockout
+	for i := 0; i < excess && lockout < lg.MaxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > lg.MaxLockout {
+		lockout = lg.MaxLockout
+	}
+	return lockout
+}
+
+func failKey(scope, value string) string {
+	return "login:fail:" + scope + ":" + value
+}
+
+func lockKey(scope, value string) string {
+	return "login:lock:" + scope + ":" + value
+}
@@ -0,0 +1,205 @@
+// internal/controllers/password.go
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"server/internal/database"
+	"server/internal/models"
+	"server/internal/notify"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+	zlog "github.com/rs/zerolog/log"
+)
+
+func ChangePassword(tm *TokenManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		type ChangePasswordRequest struct {
+			OldPassword string `json:"old_password"`
+			NewPassword string `json:"new_password"`
+		}
+
+		var req ChangePasswordRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+		}
+		if req.NewPassword == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "New password is required"})
+		}
+
+		user := c.Locals("user").(models.User)
+		if !user.CheckPassword(req.OldPassword) {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Incorrect password"})
+		}
+
+		user.Password = req.NewPassword
+		if err := user.HashPassword(); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		// Other devices are logged out, the caller gets a fresh token pair
+		user.TokenVersion++
+		err := database.DB.Transaction(func(tx *gorm.DB) error {
+			err := tx.Model(&user).Updates(map[string]interface{}{
+				"password":      user.Password,
+				"token_version": user.TokenVersion,
+			}).Error
+			if err != nil {
+				return err
+			}
+			return revokeSessions(tx, user.ID)
+		})
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update password"})
+		}
+
+		return loginResponse(c, tm, user)
+	}
+}
+
+// PasswordReset mails single-use reset links. Only a hash of the token is
+// stored, like passwords.
+type PasswordReset struct {
+	Notifier notify.Notifier
+	TTL      time.Duration
+	ResetURL string
+}
+
+func NewPasswordReset(notifier notify.Notifier, ttl time.Duration, resetURL string) *PasswordReset {
+	return &PasswordReset{
+		Notifier: notifier,
+		TTL:      ttl,
+		ResetURL: resetURL,
+	}
+}
+
+func (pr *PasswordReset) Request(c *fiber.Ctx) error {
+	type ResetRequest struct {
+		Username string `json:"username"`
+	}
+
+	var req ResetRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+	}
+
+	// The response is the same whether or not the user exists
+	response := fiber.Map{"message": "If the account exists, a reset link has been sent"}
+
+	var user models.User
+	if err := database.DB.Where("username = ?", req.Username).First(&user).Error; err != nil {
+		return c.JSON(response)
+	}
+	if user.Email == "" {
+		zlog.Warn().Str("user", user.Username).Msg("password reset requested for user without email")
+		return c.JSON(response)
+	}
+
+	token, err := newResetToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create reset token"})
+	}
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		// Only the latest link stays valid
+		if err := tx.Where("user_id = ? AND used_at IS NULL", user.ID).Delete(&models.PasswordResetToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.PasswordResetToken{
+			UserID:    user.ID,
+			TokenHash: hashResetToken(token),
+			ExpiresAt: time.Now().Add(pr.TTL),
+		}).Error
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create reset token"})
+	}
+
+	msg := notify.Message{
+		To:      user.Email,
+		Subject: "Reset your shisha-inventory password",
+		Body: fmt.Sprintf("Hi %s,\n\nuse the link below to choose a new password. It expires in %s.\n\n%s?token=%s\n\nIf you did not ask for this, ignore this message.",
+			user.Username, pr.TTL, pr.ResetURL, token),
+	}
+	// Deliver in the background so response times do not reveal the account
+	go func() {
+		if err := pr.Notifier.Notify(context.Background(), msg); err != nil {
+			zlog.Error().Err(err).Str("user", user.Username).Msg("password reset notification")
+		}
+	}()
+
+	return c.JSON(response)
+}
+
+func (pr *PasswordReset) Confirm(c *fiber.Ctx) error {
+	type ResetConfirmRequest struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"new_password"`
+	}
+
+	var req ResetConfirmRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+	}
+	if req.NewPassword == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "New password is required"})
+	}
+
+	var resetToken models.PasswordResetToken
+	err := database.DB.Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", hashResetToken(req.Token), time.Now()).
+		First(&resetToken).Error
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid or expired reset token"})
+	}
+
+	user := models.User{Password: req.NewPassword}
+	if err := user.HashPassword(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.PasswordResetToken{}).
+			Where("id = ? AND used_at IS NULL", resetToken.ID).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			return errInvalidToken
+		}
+		err := tx.Model(&models.User{}).Where("id = ?", resetToken.UserID).Updates(map[string]interface{}{
+			"password":      user.Password,
+			"token_version": gorm.Expr("token_version + 1"),
+		}).Error
+		if err != nil {
+			return err
+		}
+		return revokeSessions(tx, resetToken.UserID)
+	})
+	if err == errInvalidToken {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid or expired reset token"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to reset password"})
+	}
+
+	return c.JSON(fiber.Map{"message": "Password has been reset"})
+}
+
+func newResetToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,236 @@
+// internal/controllers/referrals.go
+package controllers
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"strings"
+	"time"
+
+	"server/internal/database"
+	"server/internal/economy"
+	"server/internal/ledger"
+	"server/internal/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+	zlog "github.com/rs/zerolog/log"
+)
+
+const (
+	// maxInviteCodes bounds the codes a user holds at once
+	maxInviteCodes = 5
+	// referralIPWindow is how far back registrations from an IP are counted
+	referralIPWindow = 24 * time.Hour
+)
+
+// Reasons a referral is rejected for
+const (
+	referralSelf    = "self_referral"
+	referralIPLimit = "ip_limit"
+)
+
+var (
+	errUnknownInviteCode = fiber.NewError(fiber.StatusBadRequest, "Unknown invite code")
+	errTooManyCodes      = fiber.NewError(fiber.StatusConflict, fmt.Sprintf("At most %d invite codes can be active", maxInviteCodes))
+)
+
+// Referrals lets users invite others with codes. Both sides are paid the
+// bonuses of the economy policy once the invitee makes a first upload.
+// Registrations from an IP the inviter has logged in from, or beyond IPLimit
+// invited registrations per IP a day, are kept but never paid.
+type Referrals struct {
+	IPLimit int
+}
+
+func NewReferrals(ipLimit int) *Referrals {
+	return &Referrals{IPLimit: ipLimit}
+}
+
+func newInviteCode() (string, error) {
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.EncodeToString(b), nil
+}
+
+// CreateCode issues an invite code to the caller.
+func (rf *Referrals) CreateCode(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.User)
+
+	var code models.InviteCode
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Set("gorm:query_option", "FOR UPDATE").Where("username = ?", user.Username).First(&models.User{}).Error
+		if err != nil {
+			return err
+		}
+		var active int
+		err = tx.Model(&models.InviteCode{}).Where("owner = ? AND revoked_at IS NULL", user.Username).Count(&active).Error
+		if err != nil {
+			return err
+		}
+		if active >= maxInviteCodes {
+			return errTooManyCodes
+		}
+
+		value, err := newInviteCode()
+		if err != nil {
+			return err
+		}
+		code = models.InviteCode{Code: value, Owner: user.Username}
+		return tx.Create(&code).Error
+	})
+	if err == errTooManyCodes {
+		return errorResponse(c, err)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create invite code"})
+	}
+	return c.Status(fiber.StatusCreated).JSON(code)
+}
+
+// RevokeCode stops a code from being used. Referrals made with it are kept.
+func (rf *Referrals) RevokeCode(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.User)
+
+	result := database.DB.Model(&models.InviteCode{}).
+		Where("code = ? AND owner = ? AND revoked_at IS NULL", strings.ToUpper(c.Params("code")), user.Username).
+		UpdateColumn("revoked_at", time.Now())
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to revoke invite code"})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Invite code not found"})
+	}
+	return c.JSON(fiber.Map{"message": "Invite code revoked"})
+}
+
+// List shows the caller's invite codes, the users they invited and what the
+// invitations earned.
+func (rf *Referrals) List(c *fiber.Ctx) error {
+	user, err := actingUser(c, c.Query("username"))
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	var codes []models.InviteCode
+	if err := database.DB.Where("owner = ?", user.Username).Order("id desc").Find(&codes).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch invite codes"})
+	}
+	var referrals []models.Referral
+	if err := database.DB.Where("inviter = ?", user.Username).Order("id desc").Find(&referrals).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch referrals"})
+	}
+	if codes == nil {
+		codes = []models.InviteCode{}
+	}
+	if referrals == nil {
+		referrals = []models.Referral{}
+	}
+
+	stats := fiber.Map{
+		"invited":               len(referrals),
+		models.ReferralPending:  0,
+		models.ReferralRewarded: 0,
+		models.ReferralRejected: 0,
+	}
+	earned := 0
+	for _, referral := range referrals {
+		stats[referral.Status] = stats[referral.Status].(int) + 1
+		earned += referral.InviterBonus
+	}
+	stats["earned"] = earned
+
+	return c.JSON(fiber.Map{"codes": codes, "referrals": referrals, "stats": stats})
+}
+
+// attach records that invitee registered with code from ip, within the
+// registration transaction. It fails only for unknown codes; referrals that
+// trip a guard are recorded as rejected.
+func (rf *Referrals) attach(tx *gorm.DB, invitee, code, ip string) error {
+	var invite models.InviteCode
+	err := tx.Where("code = ? AND revoked_at IS NULL", strings.ToUpper(strings.TrimSpace(code))).First(&invite).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return errUnknownInviteCode
+	}
+	if err != nil {
+		return err
+	}
+
+	referral := models.Referral{
+		Inviter: invite.Owner,
+		Invitee: invitee,
+		Code:    invite.Code,
+		Status:  models.ReferralPending,
+		IP:      ip,
+	}
+
+	var inviter models.User
+	if err := tx.Where("username = ?", invite.Owner).First(&inviter).Error; err != nil {
+		return err
+	}
+	var shared int
+	err = tx.Model(&models.Session{}).Where("user_id = ? AND ip = ?", inviter.ID, ip).Count(&shared).Error
+	if err != nil {
+		return err
+	}
+	var recent int
+	err = tx.Model(&models.Referral{}).Where("ip = ? AND created_at >= ?", ip, time.Now().Add(-referralIPWindow)).Count(&recent).Error
+	if err != nil {
+		return err
+	}
+	switch {
+	case shared > 0:
+		referral.Status, referral.RejectReason = models.ReferralRejected, referralSelf
+	case rf.IPLimit > 0 && recent >= rf.IPLimit:
+		referral.Status, referral.RejectReason = models.ReferralRejected, referralIPLimit
+	}
+	if referral.Status == models.ReferralRejected {
+		zlog.Warn().Str("inviter", referral.Inviter).Str("invitee", invitee).Str("ip", ip).
+			Str("reason", referral.RejectReason).Msg("referral rejected")
+	}
+	return tx.Create(&referral).Error
+}
+
+// QualifyReferral pays the bonuses of username's pending referral, if any,
+// once the invitee has done something real. HandleUpload calls it in the
+// transaction of the upload.
+func QualifyReferral(tx *gorm.DB, username string) error {
+	var referral models.Referral
+	err := tx.Set("gorm:query_option", "FOR UPDATE").
+		Where("invitee = ? AND status = ?", username, models.ReferralPending).
+		First(&referral).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	policy, err := economy.Current(tx)
+	if err != nil {
+		return err
+	}
+	postings := []ledger.Posting{}
+	if policy.ReferralBonus > 0 {
+		postings = append(postings, ledger.Posting{Account: ledger.UserAccount(referral.Inviter), Amount: policy.ReferralBonus})
+	}
+	if policy.InviteeBonus > 0 {
+		postings = append(postings, ledger.Posting{Account: ledger.UserAccount(referral.Invitee), Amount: policy.InviteeBonus})
+	}
+	if len(postings) > 0 {
+		postings = append(postings, ledger.Posting{Account: ledger.AccountMint, Amount: -policy.ReferralBonus - policy.InviteeBonus})
+		if _, err := ledger.Post(tx, policy.Version(), ledger.ReasonReferralBonus, fmt.Sprintf("referral:%d", referral.ID), postings...); err != nil {
+			return err
+		}
+	}
+
+	return tx.Model(&referral).Updates(map[string]interface{}{
+		"status":        models.ReferralRewarded,
+		"inviter_bonus": policy.ReferralBonus,
+		"invitee_bonus": policy.InviteeBonus,
+		"rewarded_at":   time.Now(),
+	}).Error
+}
@@ -0,0 +1,106 @@
+// internal/controllers/reversals.go
+package controllers
+
+import (
+	"context"
+	"errors"
+
+	"server/internal/database"
+	"server/internal/initializers"
+	"server/internal/ledger"
+	"server/internal/models"
+
+	"github.com/gofiber/fiber/v2"
+	zlog "github.com/rs/zerolog/log"
+)
+
+type reversalRequest struct {
+	Reason string `json:"reason"`
+}
+
+// reversalError answers a failed reversal or refund.
+func reversalError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, ledger.ErrNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Not found"})
+	case errors.Is(err, ledger.ErrAlreadyReversed):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Already reversed"})
+	case errors.Is(err, ledger.ErrInsufficientFunds):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "The coins have already been spent"})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to reverse"})
+}
+
+// ReverseTransfer pays a transfer back to its sender. The transfer is kept and
+// links to the reversal.
+func ReverseTransfer(topic string, brokers []string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil || id <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid transfer id"})
+		}
+		var req reversalRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+		}
+		if req.Reason == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "A reason is required"})
+		}
+
+		admin := c.Locals("user").(models.User)
+		reversal, err := ledger.ReverseTransfer(database.DB, uint(id), admin.Username, req.Reason)
+		if err != nil {
+			return reversalError(c, err)
+		}
+		zlog.Info().Str("admin", admin.Username).Int("transfer", id).Str("from", reversal.Counterparty).Str("to", reversal.Username).
+			Int("amount", reversal.Amount).Str("reason", req.Reason).Msg("transfer reversed")
+
+		producer, err := initializers.NewProducer(brokers, topic)
+		if err != nil {
+			zlog.Error().Err(err).Msg("reversal event")
+			return c.JSON(reversal)
+		}
+		// The record is produced asynchronously, so do not tie it to the request
+		producer.SendReversalMessage(context.Background(), reversal.Username, reversal.Counterparty, reversal.Amount, uint(id))
+		return c.JSON(reversal)
+	}
+}
+
+// RefundPurchase pays back a purchase and revokes the image. The purchase is
+// kept and links to the refund, the user can buy the image again.
+func RefundPurchase(topic string, brokers []string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil || id <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid purchase id"})
+		}
+		var req reversalRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+		}
+		if req.Reason == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "A reason is required"})
+		}
+
+		admin := c.Locals("user").(models.User)
+		reversal, err := ledger.RefundPurchase(database.DB, uint(id), admin.Username, req.Reason)
+		if err != nil {
+			return reversalError(c, err)
+		}
+		var purchase models.Purchase
+		if err := database.DB.First(&purchase, id).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch purchase"})
+		}
+		zlog.Info().Str("admin", admin.Username).Int("purchase", id).Str("user", reversal.Username).
+			Int("amount", reversal.Amount).Str("reason", req.Reason).Msg("purchase refunded")
+
+		producer, err := initializers.NewProducer(brokers, topic)
+		if err != nil {
+			zlog.Error().Err(err).Msg("refund event")
+			return c.JSON(reversal)
+		}
+		// The record is produced asynchronously, so do not tie it to the request
+		producer.SendRefundMessage(context.Background(), reversal.Username, purchase.ImageUUID, reversal.Amount)
+		return c.JSON(reversal)
+	}
+}
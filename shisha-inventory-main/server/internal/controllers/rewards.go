@@ -0,0 +1,164 @@
+// internal/controllers/rewards.go
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"server/internal/database"
+	"server/internal/economy"
+	"server/internal/initializers"
+	"server/internal/ledger"
+	"server/internal/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+	zlog "github.com/rs/zerolog/log"
+)
+
+const dayFormat = "2006-01-02"
+
+var errDailyRewardsDisabled = fiber.NewError(fiber.StatusNotFound, "Daily rewards are disabled")
+
+// DailyRewards pays a bonus once per calendar day in Location. Claiming on
+// consecutive days grows the streak and the bonus, as the economy policy
+// says; missing a day starts over.
+type DailyRewards struct {
+	RedPandaBroker []string
+	Topic          string
+	Location       *time.Location
+	// Now is the clock, time.Now unless a test sets it
+	Now func() time.Time
+}
+
+func NewDailyRewards(redPandaBroker []string, topic string, location *time.Location) *DailyRewards {
+	return &DailyRewards{
+		RedPandaBroker: redPandaBroker,
+		Topic:          topic,
+		Location:       location,
+		Now:            time.Now,
+	}
+}
+
+// days returns today and yesterday in the reward timezone.
+func (dr *DailyRewards) days() (string, string) {
+	now := dr.Now().In(dr.Location)
+	return now.Format(dayFormat), now.AddDate(0, 0, -1).Format(dayFormat)
+}
+
+// lastReward returns the user's latest claim, if any.
+func lastReward(db *gorm.DB, username string) (*models.DailyReward, error) {
+	var reward models.DailyReward
+	err := db.Where("username = ?", username).Order("day desc").First(&reward).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &reward, nil
+}
+
+// Status shows the caller's streak and what claiming today pays.
+func (dr *DailyRewards) Status(c *fiber.Ctx) error {
+	user, err := actingUser(c, c.Query("username"))
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	today, yesterday := dr.days()
+	last, err := lastReward(database.DB, user.Username)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch rewards"})
+	}
+	policy, err := economy.Current(database.DB)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch policy"})
+	}
+
+	streak, claimed := 0, false
+	if last != nil && (last.Day == today || last.Day == yesterday) {
+		streak, claimed = last.Streak, last.Day == today
+	}
+	response := fiber.Map{"day": today, "streak": streak, "claimed": claimed, "enabled": policy.DailyReward > 0}
+	if !claimed && policy.DailyReward > 0 {
+		response["amount"] = policy.DailyRewardFor(streak + 1)
+	}
+	return c.JSON(response)
+}
+
+// Claim pays today's bonus. Claiming again the same day pays nothing and
+// returns the same claim.
+func (dr *DailyRewards) Claim(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.User)
+	today, yesterday := dr.days()
+
+	var reward models.DailyReward
+	claimed := false
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		// Claims of a user are made one after the other
+		err := tx.Set("gorm:query_option", "FOR UPDATE").Where("username = ?", user.Username).First(&models.User{}).Error
+		if err != nil {
+			return err
+		}
+		last, err := lastReward(tx, user.Username)
+		if err != nil {
+			return err
+		}
+		if last != nil && last.Day == today {
+			reward = *last
+			return nil
+		}
+
+		policy, err := economy.Current(tx)
+		if err != nil {
+			return err
+		}
+		if policy.DailyReward == 0 {
+			return errDailyRewardsDisabled
+		}
+		streak := 1
+		if last != nil && last.Day == yesterday {
+			streak = last.Streak + 1
+		}
+
+		reward = models.DailyReward{
+			Username: user.Username,
+			Day:      today,
+			Streak:   streak,
+			Amount:   policy.DailyRewardFor(streak),
+		}
+		if err := tx.Create(&reward).Error; err != nil {
+			return err
+		}
+		txID, err := ledger.Move(tx, policy.Version(), ledger.AccountMint, ledger.UserAccount(user.Username), reward.Amount, ledger.ReasonDailyReward, fmt.Sprintf("daily_reward:%d", reward.ID))
+		if err != nil {
+			return err
+		}
+		reward.LedgerTxID = &txID
+		claimed = true
+		return tx.Model(&reward).UpdateColumn("ledger_tx_id", txID).Error
+	})
+	if err != nil {
+		if err == errDailyRewardsDisabled {
+			return errorResponse(c, err)
+		}
+		zlog.Error().Err(err).Str("user", user.Username).Msg("daily reward")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to claim reward"})
+	}
+
+	response := fiber.Map{"day": reward.Day, "streak": reward.Streak, "amount": reward.Amount, "already_claimed": !claimed}
+	if !claimed {
+		return c.JSON(response)
+	}
+
+	producer, err := initializers.NewProducer(dr.RedPandaBroker, dr.Topic)
+	if err != nil {
+		zlog.Error().Err(err).Msg("reward event")
+		return c.JSON(response)
+	}
+	// The record is produced asynchronously, so do not tie it to the request
+	producer.SendRewardMessage(context.Background(), user.Username, reward.Amount, reward.Streak, reward.Day)
+	return c.JSON(response)
+}
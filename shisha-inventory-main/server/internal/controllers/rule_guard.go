@@ -0,0 +1,189 @@
+// internal/controllers/rule_guard.go
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"server/internal/database"
+	"server/internal/initializers"
+	"server/internal/models"
+	"server/internal/rules"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+	zlog "github.com/rs/zerolog/log"
+)
+
+// RuleGuard runs the transfer and purchase rules. Every decision is logged
+// and published, denied and held operations are also stored for review. A
+// nil RuleGuard allows everything.
+type RuleGuard struct {
+	Engine         *rules.Engine
+	RedPandaBroker []string
+	Topic          string
+}
+
+func NewRuleGuard(engine *rules.Engine, redPandaBroker []string, topic string) *RuleGuard {
+	return &RuleGuard{
+		Engine:         engine,
+		RedPandaBroker: redPandaBroker,
+		Topic:          topic,
+	}
+}
+
+// Evaluate decides on a payment of username inside tx, the transaction that
+// makes the payment. The user row is locked first so the limits see the
+// user's concurrent payments. A hold an admin approved lets one identical
+// operation through.
+func (rg *RuleGuard) Evaluate(tx *gorm.DB, kind, username, counterparty string, amount int) (rules.Operation, rules.Decision, error) {
+	op := rules.Operation{Kind: kind, Counterparty: counterparty, Amount: amount}
+	if rg == nil || rg.Engine == nil {
+		op.User.Username = username
+		return op, rules.Decision{Action: rules.Allow}, nil
+	}
+
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Where("username = ?", username).First(&op.User).Error
+	if err != nil {
+		return op, rules.Decision{}, err
+	}
+	decision, err := rg.Engine.Evaluate(tx, op, time.Now())
+	if err != nil || decision.Action != rules.Hold {
+		return op, decision, err
+	}
+
+	var approval models.RuleDecision
+	err = tx.Where("username = ? AND kind = ? AND counterparty = ? AND amount = ? AND review = ?",
+		username, kind, counterparty, amount, models.ReviewApproved).
+		Order("id").First(&approval).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return op, decision, nil
+	}
+	if err != nil {
+		return op, rules.Decision{}, err
+	}
+	result := tx.Model(&approval).Where("review = ?", models.ReviewApproved).UpdateColumn("review", models.ReviewUsed)
+	if result.Error != nil {
+		return op, rules.Decision{}, result.Error
+	}
+	if result.RowsAffected == 1 {
+		decision = rules.Decision{Action: rules.Allow, Rule: decision.Rule, Reason: "approved on review"}
+	}
+	return op, decision, nil
+}
+
+// Record logs and publishes a decision once the operation it was made for is
+// settled. Denied and held operations are stored.
+func (rg *RuleGuard) Record(op rules.Operation, decision rules.Decision) models.RuleDecision {
+	record := models.RuleDecision{
+		Kind:         op.Kind,
+		Username:     op.User.Username,
+		Counterparty: op.Counterparty,
+		Amount:       op.Amount,
+		Action:       string(decision.Action),
+		Rule:         decision.Rule,
+		Reason:       decision.Reason,
+	}
+	if rg == nil || rg.Engine == nil {
+		return record
+	}
+
+	if decision.Action != rules.Allow {
+		if decision.Action == rules.Hold {
+			record.Review = models.ReviewPending
+		}
+		if err := database.DB.Create(&record).Error; err != nil {
+			zlog.Error().Err(err).Str("user", op.User.Username).Msg("rule decision store")
+		}
+	}
+	zlog.Info().Str("user", op.User.Username).Str("kind", op.Kind).Str("target", op.Counterparty).Int("amount", op.Amount).
+		Str("action", record.Action).Str("rule", record.Rule).Str("reason", record.Reason).Msg("rule decision")
+
+	producer, err := initializers.NewProducer(rg.RedPandaBroker, rg.Topic)
+	if err != nil {
+		zlog.Error().Err(err).Msg("rule decision event")
+		return record
+	}
+	// The record is produced asynchronously, so do not tie it to the request
+	producer.SendRuleDecisionMessage(context.Background(), op.User.Username, op.Kind, op.Counterparty, op.Amount, record.Action, record.Rule)
+	return record
+}
+
+// ruleResponse answers a request whose operation a rule stopped.
+func ruleResponse(c *fiber.Ctx, record models.RuleDecision) error {
+	if record.Action == string(rules.Hold) {
+		return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"message": "Held for review", "decision_id": record.ID, "rule": record.Rule})
+	}
+	return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Denied: " + record.Reason, "rule": record.Rule})
+}
+
+// ListRuleDecisions shows denied and held operations, newest first, filtered
+// by action and review state. Older pages are fetched by passing the last id
+// seen as before.
+func ListRuleDecisions(c *fiber.Ctx) error {
+	limit := c.QueryInt("limit", defaultTransferLimit)
+	if limit <= 0 || limit > maxTransferLimit {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "limit must be between 1 and 200"})
+	}
+	before := c.QueryInt("before", 0)
+	if before < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid cursor"})
+	}
+
+	query := database.DB.Model(&models.RuleDecision{})
+	if action := c.Query("action"); action != "" {
+		query = query.Where("action = ?", action)
+	}
+	if review := c.Query("review"); review != "" {
+		query = query.Where("review = ?", review)
+	}
+	if username := c.Query("username"); username != "" {
+		query = query.Where("username = ?", username)
+	}
+	if before > 0 {
+		query = query.Where("id < ?", before)
+	}
+
+	var decisions []models.RuleDecision
+	if err := query.Order("id desc").Limit(limit).Find(&decisions).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch decisions"})
+	}
+	if decisions == nil {
+		decisions = []models.RuleDecision{}
+	}
+
+	response := fiber.Map{"decisions": decisions}
+	if len(decisions) == limit {
+		response["next"] = decisions[len(decisions)-1].ID
+	}
+	return c.JSON(response)
+}
+
+// ReviewRuleDecision approves or rejects a held operation. After an approval
+// the user has to make the operation again.
+func ReviewRuleDecision(approve bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid decision id"})
+		}
+
+		review := models.ReviewRejected
+		if approve {
+			review = models.ReviewApproved
+		}
+		admin := c.Locals("user").(models.User)
+		result := database.DB.Model(&models.RuleDecision{}).
+			Where("id = ? AND review = ?", id, models.ReviewPending).
+			Updates(map[string]interface{}{"review": review, "reviewed_by": admin.Username, "reviewed_at": time.Now()})
+		if result.Error != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to review decision"})
+		}
+		if result.RowsAffected == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "No pending review with this id"})
+		}
+
+		zlog.Info().Str("admin", admin.Username).Int("decision", id).Str("review", review).Msg("rule decision reviewed")
+		return c.JSON(fiber.Map{"id": id, "review": review})
+	}
+}
@@ -0,0 +1,354 @@
+// internal/controllers/scheduled_transfers.go
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"server/internal/database"
+	"server/internal/initializers"
+	"server/internal/ledger"
+	"server/internal/models"
+	"server/internal/rules"
+	"server/internal/schedule"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+	zlog "github.com/rs/zerolog/log"
+)
+
+// errNothingDue stops a scheduler pass when no transfer is due
+var errNothingDue = errors.New("no scheduled transfer is due")
+
+// ScheduledTransfers manages transfers run at a later time or on a
+// recurrence, and runs them when due. The scheduler claims due transfers with
+// FOR UPDATE SKIP LOCKED, so every replica can run it and each run happens
+// once.
+type ScheduledTransfers struct {
+	RedPandaBroker []string
+	Topic          string
+	TwoFactor      *TwoFactor
+	Rules          *RuleGuard
+	// BatchSize caps the runs of a single scheduler pass
+	BatchSize int
+}
+
+func NewScheduledTransfers(redPandaBroker []string, topic string, tf *TwoFactor, rg *RuleGuard) *ScheduledTransfers {
+	return &ScheduledTransfers{
+		RedPandaBroker: redPandaBroker,
+		Topic:          topic,
+		TwoFactor:      tf,
+		Rules:          rg,
+		BatchSize:      100,
+	}
+}
+
+// Create schedules a transfer from the caller. Two-factor authentication is
+// checked once here, as for an immediate transfer of the same amount.
+func (st *ScheduledTransfers) Create(c *fiber.Ctx) error {
+	type ScheduleRequest struct {
+		ToUsername string `json:"to_username"`
+		Amount     int    `json:"amount"`
+		Memo       string `json:"memo"`
+		Recurrence string `json:"recurrence"`
+		Cron       string `json:"cron"`
+		StartAt    string `json:"start_at"`
+		TimeZone   string `json:"time_zone"`
+		OTPCode    string `json:"otp_code"`
+	}
+
+	var req ScheduleRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+	}
+	if req.Amount <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Amount must be greater than zero"})
+	}
+	if utf8.RuneCountInString(req.Memo) > maxMemoLength {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("Memo must be at most %d characters", maxMemoLength)})
+	}
+
+	// An RFC 3339 offset does not follow daylight saving, the zone is named
+	if req.TimeZone == "" {
+		req.TimeZone = "UTC"
+	}
+	location, err := time.LoadLocation(req.TimeZone)
+	if err != nil || req.TimeZone == "Local" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "time_zone must be an IANA time zone such as Europe/Berlin"})
+	}
+
+	now := time.Now().In(location)
+	start := now
+	if req.StartAt != "" {
+		start, err = time.Parse(time.RFC3339, req.StartAt)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "start_at must be an RFC 3339 time"})
+		}
+		start = start.In(location)
+		if start.Before(now.Add(-time.Minute)) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "start_at is in the past"})
+		}
+	} else if req.Recurrence == schedule.Once {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "start_at is required for a one-off transfer"})
+	}
+	if req.Recurrence != schedule.Cron {
+		req.Cron = ""
+	}
+	sched, err := schedule.Parse(req.Recurrence, req.Cron, start)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	firstRun := sched.Next(start.Add(-time.Nanosecond))
+	if firstRun.IsZero() {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Schedule never runs"})
+	}
+
+	user := c.Locals("user").(models.User)
+	if user.Username == req.ToUsername {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Cannot transfer coins to yourself"})
+	}
+	var toUser models.User
+	if err := database.DB.Where("username = ?", req.ToUsername).First(&toUser).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Recipient not found"})
+	}
+
+	if st.TwoFactor.RequiredForTransfer(req.Amount) {
+		if !user.TOTPEnabled {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": fmt.Sprintf("Two-factor authentication must be enabled for transfers above %d coins", st.TwoFactor.TransferThreshold)})
+		}
+		if req.OTPCode == "" {
+			return errorResponse(c, errTwoFactorCodeRequired)
+		}
+		if err := st.TwoFactor.Verify(c.Context(), user, req.OTPCode, c.IP()); err != nil {
+			return errorResponse(c, err)
+		}
+	}
+
+	scheduled := models.ScheduledTransfer{
+		FromUser:   user.Username,
+		ToUser:     toUser.Username,
+		Amount:     req.Amount,
+		Memo:       req.Memo,
+		Recurrence: req.Recurrence,
+		Cron:       req.Cron,
+		StartAt:    start,
+		TimeZone:   req.TimeZone,
+		NextRunAt:  &firstRun,
+		Status:     models.ScheduledTransferActive,
+	}
+	if err := database.DB.Create(&scheduled).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to schedule transfer"})
+	}
+	return c.Status(fiber.StatusCreated).JSON(scheduled)
+}
+
+// parseSchedule rebuilds the schedule of a stored transfer. Postgres keeps
+// StartAt as an instant, the wall clock time runs keep is that of TimeZone.
+func parseSchedule(scheduled models.ScheduledTransfer) (schedule.Schedule, error) {
+	location, err := time.LoadLocation(scheduled.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	return schedule.Parse(scheduled.Recurrence, scheduled.Cron, scheduled.StartAt.In(location))
+}
+
+// List shows the transfers the caller has scheduled, newest first.
+func (st *ScheduledTransfers) List(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.User)
+
+	query := database.DB.Where("from_user = ?", user.Username)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	var scheduled []models.ScheduledTransfer
+	if err := query.Order("id desc").Find(&scheduled).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch scheduled transfers"})
+	}
+	if scheduled == nil {
+		scheduled = []models.ScheduledTransfer{}
+	}
+	return c.JSON(scheduled)
+}
+
+// Runs lists the executions of one of the caller's scheduled transfers,
+// newest first. Older pages are fetched by passing the last id seen as before.
+func (st *ScheduledTransfers) Runs(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.User)
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid scheduled transfer id"})
+	}
+	limit := c.QueryInt("limit", defaultTransferLimit)
+	if limit <= 0 || limit > maxTransferLimit {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "limit must be between 1 and 200"})
+	}
+	before := c.QueryInt("before", 0)
+	if before < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid cursor"})
+	}
+
+	var scheduled models.ScheduledTransfer
+	if err := database.DB.Where("id = ? AND from_user = ?", id, user.Username).First(&scheduled).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Scheduled transfer not found"})
+	}
+
+	query := database.DB.Where("scheduled_transfer_id = ?", scheduled.ID)
+	if before > 0 {
+		query = query.Where("id < ?", before)
+	}
+	var runs []models.ScheduledTransferRun
+	if err := query.Order("id desc").Limit(limit).Find(&runs).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch runs"})
+	}
+	if runs == nil {
+		runs = []models.ScheduledTransferRun{}
+	}
+
+	response := fiber.Map{"runs": runs}
+	if len(runs) == limit {
+		response["next"] = runs[len(runs)-1].ID
+	}
+	return c.JSON(response)
+}
+
+// Cancel stops a scheduled transfer of the caller. Past runs are kept.
+func (st *ScheduledTransfers) Cancel(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.User)
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid scheduled transfer id"})
+	}
+
+	result := database.DB.Model(&models.ScheduledTransfer{}).
+		Where("id = ? AND from_user = ? AND status = ?", id, user.Username, models.ScheduledTransferActive).
+		Updates(map[string]interface{}{"status": models.ScheduledTransferCancelled, "next_run_at": nil})
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to cancel scheduled transfer"})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Scheduled transfer not found"})
+	}
+	return c.JSON(fiber.Map{"message": "Scheduled transfer cancelled"})
+}
+
+// Run executes due transfers every interval until ctx is done.
+func (st *ScheduledTransfers) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := st.RunDue(time.Now()); err != nil {
+				zlog.Error().Err(err).Msg("scheduled transfers")
+			}
+		}
+	}
+}
+
+// RunDue executes up to BatchSize transfers due at now and returns how many
+// ran, failed runs included.
+func (st *ScheduledTransfers) RunDue(now time.Time) (int, error) {
+	for ran := 0; ran < st.BatchSize; ran++ {
+		err := st.runNext(now)
+		if err == errNothingDue {
+			return ran, nil
+		}
+		if err != nil {
+			return ran, err
+		}
+	}
+	return st.BatchSize, nil
+}
+
+// runNext claims the oldest due transfer and runs it. The run is recorded and
+// the next run time set in the same transaction, whether the transfer went
+// through or not. Runs missed while no server was up are not made up for.
+func (st *ScheduledTransfers) runNext(now time.Time) error {
+	var scheduled models.ScheduledTransfer
+	var run models.ScheduledTransferRun
+	var op rules.Operation
+	var decision rules.Decision
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Set("gorm:query_option", "FOR UPDATE SKIP LOCKED").
+			Where("status = ? AND next_run_at <= ?", models.ScheduledTransferActive, now).
+			Order("next_run_at").
+			First(&scheduled).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return errNothingDue
+		}
+		if err != nil {
+			return err
+		}
+
+		run = models.ScheduledTransferRun{
+			ScheduledTransferID: scheduled.ID,
+			ScheduledFor:        *scheduled.NextRunAt,
+			Status:              models.ScheduledRunSucceeded,
+		}
+		sched, err := parseSchedule(scheduled)
+		if err == nil {
+			// A failed transfer must not take the run record down with it
+			if err := tx.Exec("SAVEPOINT scheduled_run").Error; err != nil {
+				return err
+			}
+			var transfer models.Transfer
+			op, decision, err = st.Rules.Evaluate(tx, rules.KindTransfer, scheduled.FromUser, scheduled.ToUser, scheduled.Amount)
+			if err == nil && decision.Action != rules.Allow {
+				err = fmt.Errorf("%s by rule %s: %s", decision.Action, decision.Rule, decision.Reason)
+			}
+			if err == nil {
+				transfer, err = ledger.TransferTx(tx, scheduled.FromUser, scheduled.ToUser, scheduled.Amount, scheduled.Memo)
+			}
+			if err == nil {
+				run.TransferID = &transfer.ID
+			} else if err := tx.Exec("ROLLBACK TO SAVEPOINT scheduled_run").Error; err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			run.Status = models.ScheduledRunFailed
+			run.Error = err.Error()
+		}
+		if err := tx.Create(&run).Error; err != nil {
+			return err
+		}
+
+		updates := map[string]interface{}{"last_run_at": now}
+		var next time.Time
+		if sched != nil {
+			next = sched.Next(now)
+		}
+		if next.IsZero() {
+			updates["next_run_at"] = nil
+			updates["status"] = models.ScheduledTransferCompleted
+		} else {
+			updates["next_run_at"] = next
+		}
+		return tx.Model(&scheduled).Updates(updates).Error
+	})
+	if err != nil {
+		return err
+	}
+	if decision.Action != "" {
+		st.Rules.Record(op, decision)
+	}
+
+	if run.Status == models.ScheduledRunFailed {
+		zlog.Warn().Uint("scheduled_transfer", scheduled.ID).Str("error", run.Error).Msg("scheduled transfer failed")
+		return nil
+	}
+	producer, err := initializers.NewProducer(st.RedPandaBroker, st.Topic)
+	if err != nil {
+		zlog.Error().Err(err).Uint("scheduled_transfer", scheduled.ID).Msg("scheduled transfer event")
+		return nil
+	}
+	producer.SendTransferMessage(context.Background(), scheduled.FromUser, scheduled.ToUser, scheduled.Amount)
+	return nil
+}
@@ -0,0 +1,119 @@
+// internal/controllers/sessions.go
+package controllers
+
+import (
+	"time"
+
+	"server/internal/database"
+	"server/internal/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+// sessionTouchInterval limits how often last_seen_at is written for a session.
+const sessionTouchInterval = time.Minute
+
+// startSession records a login of the user from the requesting device.
+func startSession(c *fiber.Ctx, tm *TokenManager, user models.User) (models.Session, error) {
+	now := time.Now()
+	session := models.Session{
+		ID:         uuid.New().String(),
+		UserID:     user.ID,
+		UserAgent:  c.Get(fiber.HeaderUserAgent),
+		IP:         c.IP(),
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(tm.RefreshTTL),
+	}
+	err := database.DB.Create(&session).Error
+	return session, err
+}
+
+// activeSession loads the session a token was issued for and reports whether
+// it is still active. Tokens issued before sessions existed carry no ID and are
+// left to their version and expiry checks.
+func activeSession(claims *Claims, user models.User) (models.Session, bool, error) {
+	if claims.SessionID == "" {
+		return models.Session{}, true, nil
+	}
+
+	var session models.Session
+	err := database.DB.Where("id = ? AND user_id = ?", claims.SessionID, user.ID).First(&session).Error
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return models.Session{}, false, nil
+		}
+		return models.Session{}, false, err
+	}
+
+	now := time.Now()
+	if !session.Active(now) {
+		return session, false, nil
+	}
+	if now.Sub(session.LastSeenAt) > sessionTouchInterval {
+		session.LastSeenAt = now
+		if err := database.DB.Model(&session).UpdateColumn("last_seen_at", now).Error; err != nil {
+			return session, false, err
+		}
+	}
+	return session, true, nil
+}
+
+// revokeSessions ends every active session of the user.
+func revokeSessions(tx *gorm.DB, userID uint) error {
+	return tx.Model(&models.Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		UpdateColumn("revoked_at", time.Now()).Error
+}
+
+func revokeSession(userID uint, sessionID string) (bool, error) {
+	result := database.DB.Model(&models.Session{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", sessionID, userID).
+		UpdateColumn("revoked_at", time.Now())
+	return result.RowsAffected > 0, result.Error
+}
+
+func ListSessions(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.User)
+	claims := c.Locals("claims").(*Claims)
+
+	var sessions []models.Session
+	err := database.DB.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", user.ID, time.Now()).
+		Order("last_seen_at desc").
+		Find(&sessions).Error
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch sessions"})
+	}
+
+	sessionList := make([]fiber.Map, 0, len(sessions))
+	for _, session := range sessions {
+		sessionList = append(sessionList, fiber.Map{
+			"id":           session.ID,
+			"user_agent":   session.UserAgent,
+			"ip":           session.IP,
+			"created_at":   session.CreatedAt,
+			"last_seen_at": session.LastSeenAt,
+			"expires_at":   session.ExpiresAt,
+			"current":      session.ID == claims.SessionID,
+		})
+	}
+	return c.JSON(sessionList)
+}
+
+func RevokeSession(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.User)
+
+	sessionID := c.Params("id")
+	if _, err := uuid.Parse(sessionID); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Session not found"})
+	}
+	revoked, err := revokeSession(user.ID, sessionID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to revoke session"})
+	}
+	if !revoked {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Session not found"})
+	}
+	return c.JSON(fiber.Map{"message": "Session revoked"})
+}
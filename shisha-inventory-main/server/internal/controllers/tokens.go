@@ -0,0 +1,202 @@
+// internal/controllers/tokens.go
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"server/internal/initializers"
+	"server/internal/models"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+const (
+	TokenTypeAccess  = "access"
+	TokenTypeRefresh = "refresh"
+	// TokenTypeMFA proves the password step of a login that still needs a 2FA code
+	TokenTypeMFA = "mfa"
+
+	mfaTokenTTL = 5 * time.Minute
+)
+
+// DefaultSecretKey is the secret key used when none is configured. It is
+// public, so tokens signed with it are never accepted next to a signing key.
+const DefaultSecretKey = "your_secret_key"
+
+var (
+	errInvalidToken   = errors.New("invalid token")
+	errInsecureSecret = errors.New("legacy tokens need a secret key other than the default")
+	errNoSigningKey   = errors.New("legacy tokens are only accepted next to a jwt signing key")
+)
+
+type TokenPair struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// TokenManager signs tokens with the asymmetric signing key from Keys. The
+// shared HMAC SecretKey is only used when no signing key is configured, and
+// to verify the HMAC tokens issued before one was, see AcceptLegacy.
+type TokenManager struct {
+	RedisClient *redis.Client
+	Keys        *initializers.KeySet
+	SecretKey   string
+	AccessTTL   time.Duration
+	RefreshTTL  time.Duration
+	legacyUntil time.Time
+}
+
+func NewTokenManager(redisClient *redis.Client, keys *initializers.KeySet, secretKey string, accessTTL, refreshTTL time.Duration) *TokenManager {
+	return &TokenManager{
+		RedisClient: redisClient,
+		Keys:        keys,
+		SecretKey:   secretKey,
+		AccessTTL:   accessTTL,
+		RefreshTTL:  refreshTTL,
+	}
+}
+
+// AcceptLegacy keeps verifying HMAC tokens issued with SecretKey before the
+// signing key was configured until the fixed time until, so sessions survive
+// the switch. It should be the switch plus a refresh TTL, the secret can be
+// removed afterwards. Only tokens bound to a session are accepted.
+func (tm *TokenManager) AcceptLegacy(until time.Time) error {
+	if tm.signingKey() == nil {
+		return errNoSigningKey
+	}
+	if tm.SecretKey == "" || tm.SecretKey == DefaultSecretKey {
+		return errInsecureSecret
+	}
+	tm.legacyUntil = until
+	return nil
+}
+
+// Issue signs a new access and refresh token pair for the user, bound to the
+// session with sessionID.
+func (tm *TokenManager) Issue(user models.User, sessionID string) (TokenPair, error) {
+	accessToken, err := tm.sign(user, TokenTypeAccess, sessionID, tm.AccessTTL)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	refreshToken, err := tm.sign(user, TokenTypeRefresh, sessionID, tm.RefreshTTL)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(tm.AccessTTL.Seconds()),
+	}, nil
+}
+
+// IssueMFA signs the short-lived token handed out between the password and
+// the two-factor step of a login.
+func (tm *TokenManager) IssueMFA(user models.User) (string, error) {
+	return tm.sign(user, TokenTypeMFA, "", mfaTokenTTL)
+}
+
+func (tm *TokenManager) sign(user models.User, tokenType, sessionID string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims := &Claims{
+		Username:     user.Username,
+		TokenType:    tokenType,
+		TokenVersion: user.TokenVersion,
+		Role:         user.Role,
+		SessionID:    sessionID,
+		StandardClaims: jwt.StandardClaims{
+			Id:        uuid.New().String(),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(ttl).Unix(),
+		},
+	}
+	if key := tm.signingKey(); key != nil {
+		token := jwt.NewWithClaims(key.Method, claims)
+		token.Header["kid"] = key.ID
+		return token.SignedString(key.Private)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(tm.SecretKey))
+}
+
+func (tm *TokenManager) signingKey() *initializers.SigningKey {
+	if tm.Keys == nil {
+		return nil
+	}
+	return tm.Keys.Signing()
+}
+
+func (tm *TokenManager) verificationKey(token *jwt.Token) (interface{}, error) {
+	_, symmetric := token.Method.(*jwt.SigningMethodHMAC)
+	if tm.signingKey() == nil {
+		if !symmetric {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(tm.SecretKey), nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	if symmetric && kid == "" && tm.legacy(token) {
+		return []byte(tm.SecretKey), nil
+	}
+	key, ok := tm.Keys.Lookup(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.Public, nil
+}
+
+// legacy reports whether token may be an HMAC token issued before the signing
+// key was configured. Tokens outliving the cutover or without a session were
+// not issued by this server.
+func (tm *TokenManager) legacy(token *jwt.Token) bool {
+	if tm.SecretKey == "" || tm.SecretKey == DefaultSecretKey {
+		return false
+	}
+	claims, ok := token.Claims.(*Claims)
+	return ok && claims.SessionID != "" && time.Now().Before(tm.legacyUntil) && claims.ExpiresAt <= tm.legacyUntil.Unix()
+}
+
+// Parse checks the signature, expiry and type of a token. It does not consult
+// the revocation list, see Revoked.
+func (tm *TokenManager) Parse(tokenString, tokenType string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, tm.verificationKey)
+	if err != nil {
+		return nil, err
+	}
+	// StandardClaims.Valid accepts tokens without exp, so require it explicitly
+	if !token.Valid || claims.ExpiresAt == 0 || claims.Id == "" || claims.Username == "" || claims.TokenType != tokenType {
+		return nil, errInvalidToken
+	}
+	return claims, nil
+}
+
+// Revoke puts the token id on the revocation list until the token expires.
+// It reports false if the token had already been revoked.
+func (tm *TokenManager) Revoke(ctx context.Context, claims *Claims) (bool, error) {
+	ttl := time.Until(time.Unix(claims.ExpiresAt, 0))
+	if ttl <= 0 {
+		return true, nil
+	}
+	return tm.RedisClient.SetNX(ctx, revokedKey(claims.Id), claims.Username, ttl).Result()
+}
+
+func (tm *TokenManager) Revoked(ctx context.Context, claims *Claims) (bool, error) {
+	n, err := tm.RedisClient.Exists(ctx, revokedKey(claims.Id)).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func revokedKey(jti string) string {
+	return "revoked:jti:" + jti
+}
@@ -0,0 +1,197 @@
+// internal/controllers/topups.go
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"server/internal/database"
+	"server/internal/initializers"
+	"server/internal/ledger"
+	"server/internal/models"
+	"server/internal/payments"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+	zlog "github.com/rs/zerolog/log"
+)
+
+// maxTopUpCoins bounds a single top-up
+const maxTopUpCoins = 100000
+
+var errTopUpNotFound = errors.New("top-up not found")
+
+// TopUps sells coins through a payment provider. A top-up is created pending,
+// the user pays on the provider's page and the provider's webhook credits the
+// coins. Webhooks are delivered at least once and a failed attempt may be
+// retried on the same intent, the top-up row settles them so coins are
+// credited exactly once.
+type TopUps struct {
+	Provider payments.PaymentProvider
+	// CoinPrice is the price of a coin in the smallest unit of Currency
+	CoinPrice      int
+	Currency       string
+	RedPandaBroker []string
+	Topic          string
+}
+
+func NewTopUps(provider payments.PaymentProvider, coinPrice int, currency string, redPandaBroker []string, topic string) *TopUps {
+	return &TopUps{
+		Provider:       provider,
+		CoinPrice:      coinPrice,
+		Currency:       currency,
+		RedPandaBroker: redPandaBroker,
+		Topic:          topic,
+	}
+}
+
+// Create starts a top-up and returns where to send the user to pay.
+func (tu *TopUps) Create(c *fiber.Ctx) error {
+	type CreateRequest struct {
+		Coins int `json:"coins"`
+	}
+
+	var req CreateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+	}
+	if req.Coins <= 0 || req.Coins > maxTopUpCoins {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("Coins must be between 1 and %d", maxTopUpCoins)})
+	}
+
+	user := c.Locals("user").(models.User)
+	price := req.Coins * tu.CoinPrice
+	intent, err := tu.Provider.CreateIntent(c.Context(), price, tu.Currency, user.Username)
+	if err != nil {
+		zlog.Error().Err(err).Str("provider", tu.Provider.Name()).Msg("payment intent")
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "Payment provider is unavailable"})
+	}
+
+	topUp := models.TopUp{
+		Username: user.Username,
+		Coins:    req.Coins,
+		Price:    price,
+		Currency: tu.Currency,
+		Provider: tu.Provider.Name(),
+		IntentID: intent.ID,
+		Status:   models.TopUpPending,
+	}
+	if err := database.DB.Create(&topUp).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create top-up"})
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"top_up": topUp, "redirect_url": intent.RedirectURL})
+}
+
+// List shows the caller's top-ups, newest first. Older pages are fetched by
+// passing the last id seen as before.
+func (tu *TopUps) List(c *fiber.Ctx) error {
+	user, err := actingUser(c, c.Query("username"))
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	limit := c.QueryInt("limit", defaultTransferLimit)
+	if limit <= 0 || limit > maxTransferLimit {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "limit must be between 1 and 200"})
+	}
+	before := c.QueryInt("before", 0)
+	if before < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid cursor"})
+	}
+
+	query := database.DB.Where("username = ?", user.Username)
+	if before > 0 {
+		query = query.Where("id < ?", before)
+	}
+	var topUps []models.TopUp
+	if err := query.Order("id desc").Limit(limit).Find(&topUps).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch top-ups"})
+	}
+	if topUps == nil {
+		topUps = []models.TopUp{}
+	}
+
+	response := fiber.Map{"top_ups": topUps}
+	if len(topUps) == limit {
+		response["next"] = topUps[len(topUps)-1].ID
+	}
+	return c.JSON(response)
+}
+
+// Webhook settles a top-up from the provider's notification. Redeliveries and
+// events about a credited top-up are acknowledged without doing anything.
+func (tu *TopUps) Webhook(c *fiber.Ctx) error {
+	event, err := tu.Provider.ParseWebhook(c.Body(), func(name string) string { return c.Get(name) })
+	if err == payments.ErrInvalidSignature {
+		zlog.Warn().Str("provider", tu.Provider.Name()).Str("ip", c.IP()).Msg("invalid webhook signature")
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid signature"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid webhook"})
+	}
+
+	var topUp models.TopUp
+	credited := false
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Set("gorm:query_option", "FOR UPDATE").
+			Where("provider = ? AND intent_id = ?", tu.Provider.Name(), event.IntentID).
+			First(&topUp).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return errTopUpNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if topUp.Status == models.TopUpSucceeded || topUp.EventID == event.ID {
+			return nil
+		}
+
+		now := time.Now()
+		topUp.Status, topUp.EventID, topUp.CompletedAt = models.TopUpFailed, event.ID, &now
+		updates := map[string]interface{}{"event_id": event.ID, "completed_at": now}
+		if event.Status == payments.StatusSucceeded {
+			topUp.Status = models.TopUpSucceeded
+			txID, err := ledger.Move(tx, nil, ledger.AccountPayments, ledger.UserAccount(topUp.Username), topUp.Coins, ledger.ReasonTopUp, fmt.Sprintf("top_up:%d", topUp.ID))
+			if err != nil {
+				return err
+			}
+			topUp.LedgerTxID = &txID
+			updates["ledger_tx_id"] = txID
+			credited = true
+		}
+		updates["status"] = topUp.Status
+		return tx.Model(&topUp).Updates(updates).Error
+	})
+	if err == errTopUpNotFound {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Top-up not found"})
+	}
+	if err != nil {
+		zlog.Error().Err(err).Str("intent", event.IntentID).Msg("top-up webhook")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to settle top-up"})
+	}
+	if !credited {
+		return c.JSON(fiber.Map{"status": topUp.Status})
+	}
+
+	zlog.Info().Str("user", topUp.Username).Uint("top_up", topUp.ID).Int("coins", topUp.Coins).Msg("top-up credited")
+	producer, err := initializers.NewProducer(tu.RedPandaBroker, tu.Topic)
+	if err != nil {
+		zlog.Error().Err(err).Msg("top-up event")
+		return c.JSON(fiber.Map{"status": topUp.Status})
+	}
+	// The record is produced asynchronously, so do not tie it to the request
+	producer.SendTopUpMessage(context.Background(), topUp.Username, topUp.Coins)
+	return c.JSON(fiber.Map{"status": topUp.Status})
+}
+
+// FakeCheckout is the checkout page of the fake provider: visiting it pays
+// the intent and has the provider deliver the webhook.
+func FakeCheckout(provider *payments.FakeProvider) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if err := provider.Pay(c.Context(), c.Params("intent")); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(fiber.Map{"message": "Payment completed"})
+	}
+}
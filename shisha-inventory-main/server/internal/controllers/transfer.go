@@ -3,20 +3,28 @@ package controllers
 
 import (
 	"context"
+	"fmt"
 	"server/internal/database"
 	"server/internal/initializers"
+	"server/internal/ledger"
 	"server/internal/models"
+	"server/internal/rules"
+	"unicode/utf8"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/jinzhu/gorm"
 )
 
-func Tranfser(topic string, brokers []string, ctx context.Context) fiber.Handler {
+const maxMemoLength = 200
+
+func Tranfser(topic string, brokers []string, ctx context.Context, tf *TwoFactor, rg *RuleGuard) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		type TransferRequest struct {
 			FromUsername string `json:"from_username"`
 			ToUsername   string `json:"to_username"`
 			Amount       int    `json:"amount"`
+			Memo         string `json:"memo"`
+			OTPCode      string `json:"otp_code"`
 		}
 
 		var req TransferRequest
@@ -27,33 +35,57 @@ func Tranfser(topic string, brokers []string, ctx context.Context) fiber.Handler
 		if req.Amount <= 0 {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Amount must be greater than zero"})
 		}
+		if utf8.RuneCountInString(req.Memo) > maxMemoLength {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("Memo must be at most %d characters", maxMemoLength)})
+		}
 
-		var fromUser, toUser models.User
+		fromUser, err := actingUser(c, req.FromUsername)
+		if err != nil {
+			return errorResponse(c, err)
+		}
+		if fromUser.Username == req.ToUsername {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Cannot transfer coins to yourself"})
+		}
 
-		if err := database.DB.Where("username = ?", req.FromUsername).First(&fromUser).Error; err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Ebat' ti kto?"})
+		if tf.RequiredForTransfer(req.Amount) {
+			if !fromUser.TOTPEnabled {
+				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": fmt.Sprintf("Two-factor authentication must be enabled for transfers above %d coins", tf.TransferThreshold)})
+			}
+			if req.OTPCode == "" {
+				return errorResponse(c, errTwoFactorCodeRequired)
+			}
+			if err := tf.Verify(c.Context(), fromUser, req.OTPCode, c.IP()); err != nil {
+				return errorResponse(c, err)
+			}
 		}
 
+		var toUser models.User
+
 		if err := database.DB.Where("username = ?", req.ToUsername).First(&toUser).Error; err != nil {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Recipient not found"})
 		}
 
-		if fromUser.Coins < req.Amount {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Insufficient coins"})
-		}
-
-		err := database.DB.Transaction(func(tx *gorm.DB) error {
-			if err := tx.Model(&fromUser).Update("coins", gorm.Expr("coins - ?", req.Amount)).Error; err != nil {
-				return err
-			}
-
-			if err := tx.Model(&toUser).Update("coins", gorm.Expr("coins + ?", req.Amount)).Error; err != nil {
+		// The rules and the balance are checked under a row lock inside the transfer
+		var op rules.Operation
+		var decision rules.Decision
+		var transfer models.Transfer
+		err = database.DB.Transaction(func(tx *gorm.DB) error {
+			var err error
+			op, decision, err = rg.Evaluate(tx, rules.KindTransfer, fromUser.Username, toUser.Username, req.Amount)
+			if err != nil || decision.Action != rules.Allow {
 				return err
 			}
-
-			return nil
+			transfer, err = ledger.TransferTx(tx, fromUser.Username, toUser.Username, req.Amount, req.Memo)
+			return err
 		})
-
+		if err == nil {
+			if record := rg.Record(op, decision); decision.Action != rules.Allow {
+				return ruleResponse(c, record)
+			}
+		}
+		if err == ledger.ErrInsufficientFunds {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Insufficient coins"})
+		}
 		if err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "transfer failed"})
 		}
@@ -63,8 +95,8 @@ func Tranfser(topic string, brokers []string, ctx context.Context) fiber.Handler
 			return err
 		}
 
-		producer.SendTransferMessage(ctx, req.FromUsername, req.ToUsername, req.Amount)
+		producer.SendTransferMessage(ctx, fromUser.Username, toUser.Username, req.Amount)
 
-		return c.JSON(fiber.Map{"message": "Transfer successful"})
+		return c.JSON(fiber.Map{"message": "Transfer successful", "transfer_id": transfer.ID})
 	}
 }
@@ -0,0 +1,155 @@
+// internal/controllers/transfers.go
+package controllers
+
+import (
+	"encoding/csv"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/internal/database"
+	"server/internal/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	defaultTransferLimit = 50
+	maxTransferLimit     = 200
+	// maxTransferExport caps the rows of a single CSV export
+	maxTransferExport = 10000
+)
+
+// transferQuery builds the query for the caller's transfers from the
+// direction, counterparty, from and to query parameters.
+func transferQuery(c *fiber.Ctx, user models.User) (*gorm.DB, error) {
+	query := database.DB.Model(&models.Transfer{})
+
+	switch c.Query("direction") {
+	case "":
+		query = query.Where("from_user = ? OR to_user = ?", user.Username, user.Username)
+	case "sent":
+		query = query.Where("from_user = ?", user.Username)
+	case "received":
+		query = query.Where("to_user = ?", user.Username)
+	default:
+		return nil, fiber.NewError(fiber.StatusBadRequest, "direction must be sent or received")
+	}
+
+	if counterparty := c.Query("counterparty"); counterparty != "" {
+		query = query.Where("(from_user = ? AND to_user = ?) OR (from_user = ? AND to_user = ?)",
+			user.Username, counterparty, counterparty, user.Username)
+	}
+
+	if from := c.Query("from"); from != "" {
+		t, _, err := parseTime(from)
+		if err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "from must be a date or RFC 3339 time")
+		}
+		query = query.Where("created_at >= ?", t)
+	}
+	if to := c.Query("to"); to != "" {
+		t, dateOnly, err := parseTime(to)
+		if err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "to must be a date or RFC 3339 time")
+		}
+		// A plain date includes the whole day
+		if dateOnly {
+			t = t.AddDate(0, 0, 1)
+		}
+		query = query.Where("created_at < ?", t)
+	}
+	return query, nil
+}
+
+// csvSafe keeps spreadsheets from evaluating user supplied text as a formula.
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+func parseTime(value string) (time.Time, bool, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	return t, false, err
+}
+
+// Transfers lists the caller's transfers, newest first. Older pages are
+// fetched by passing the last id seen as before.
+func Transfers(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.User)
+
+	limit := c.QueryInt("limit", defaultTransferLimit)
+	if limit <= 0 || limit > maxTransferLimit {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "limit must be between 1 and 200"})
+	}
+	before := c.QueryInt("before", 0)
+	if before < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid cursor"})
+	}
+
+	query, err := transferQuery(c, user)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	if before > 0 {
+		query = query.Where("id < ?", before)
+	}
+
+	var transfers []models.Transfer
+	if err := query.Order("id desc").Limit(limit).Find(&transfers).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch transfers"})
+	}
+	if transfers == nil {
+		transfers = []models.Transfer{}
+	}
+
+	response := fiber.Map{"transfers": transfers}
+	if len(transfers) == limit {
+		response["next"] = transfers[len(transfers)-1].ID
+	}
+	return c.JSON(response)
+}
+
+// ExportTransfers returns the caller's transfers matching the same filters as
+// Transfers as a CSV file.
+func ExportTransfers(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.User)
+
+	query, err := transferQuery(c, user)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	var transfers []models.Transfer
+	if err := query.Order("id desc").Limit(maxTransferExport).Find(&transfers).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch transfers"})
+	}
+
+	c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="transfers.csv"`)
+
+	w := csv.NewWriter(c.Response().BodyWriter())
+	w.Write([]string{"id", "created_at", "direction", "counterparty", "amount", "memo"})
+	for _, transfer := range transfers {
+		direction, counterparty, amount := "received", transfer.FromUser, transfer.Amount
+		if transfer.FromUser == user.Username {
+			direction, counterparty, amount = "sent", transfer.ToUser, -transfer.Amount
+		}
+		w.Write([]string{
+			strconv.FormatUint(uint64(transfer.ID), 10),
+			transfer.CreatedAt.UTC().Format(time.RFC3339),
+			direction,
+			csvSafe(counterparty),
+			strconv.Itoa(amount),
+			csvSafe(transfer.Memo),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
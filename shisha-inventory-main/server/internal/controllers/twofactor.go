@@ -0,0 +1,257 @@
+// internal/controllers/twofactor.go
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"server/internal/database"
+	"server/internal/models"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+	zlog "github.com/rs/zerolog/log"
+)
+
+const recoveryCodeCount = 10
+
+var (
+	errInvalidTwoFactorCode  = fiber.NewError(fiber.StatusUnauthorized, "Invalid two-factor code")
+	errTwoFactorLocked       = fiber.NewError(fiber.StatusTooManyRequests, "Too many failed two-factor attempts, try again later")
+	errTwoFactorCodeRequired = fiber.NewError(fiber.StatusForbidden, "Two-factor code required")
+)
+
+// TwoFactor handles TOTP enrollment and verification. Failed codes count
+// towards the same lockout as failed passwords.
+type TwoFactor struct {
+	RedisClient       *redis.Client
+	Guard             *LoginGuard
+	Issuer            string
+	TransferThreshold int
+}
+
+func NewTwoFactor(redisClient *redis.Client, guard *LoginGuard, issuer string, transferThreshold int) *TwoFactor {
+	return &TwoFactor{
+		RedisClient:       redisClient,
+		Guard:             guard,
+		Issuer:            issuer,
+		TransferThreshold: transferThreshold,
+	}
+}
+
+// RequiredForTransfer reports whether a transfer of amount needs a 2FA code.
+func (tf *TwoFactor) RequiredForTransfer(amount int) bool {
+	return tf != nil && tf.TransferThreshold > 0 && amount > tf.TransferThreshold
+}
+
+// Verify accepts either a current TOTP code or an unused recovery code.
+func (tf *TwoFactor) Verify(ctx context.Context, user models.User, code, ip string) error {
+	retryAfter, err := tf.Guard.Locked(ctx, user.Username, ip)
+	if err != nil {
+		return err
+	}
+	if retryAfter > 0 {
+		return errTwoFactorLocked
+	}
+
+	ok, err := tf.check(ctx, user, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err := tf.Guard.Failed(ctx, user.Username, ip); err != nil {
+			zlog.Error().Err(err).Msg("two-factor failure record")
+		}
+		return errInvalidTwoFactorCode
+	}
+	return nil
+}
+
+func (tf *TwoFactor) check(ctx context.Context, user models.User, code string) (bool, error) {
+	if code == "" || user.TOTPSecret == "" {
+		return false, nil
+	}
+	if counter, ok := models.ValidateTOTP(user.TOTPSecret, code, time.Now()); ok {
+		// A code may only be used once within the window it is accepted in
+		key := fmt.Sprintf("totp:used:%d:%d", user.ID, counter)
+		return tf.RedisClient.SetNX(ctx, key, 1, 2*time.Minute).Result()
+	}
+	if !user.TOTPEnabled {
+		return false, nil
+	}
+
+	var codes []models.RecoveryCode
+	if err := database.DB.Where("user_id = ? AND used_at IS NULL", user.ID).Find(&codes).Error; err != nil {
+		return false, err
+	}
+	for _, rc := range codes {
+		if !rc.Check(code) {
+			continue
+		}
+		// Guard against the same code being redeemed concurrently
+		result := database.DB.Model(&models.RecoveryCode{}).
+			Where("id = ? AND used_at IS NULL", rc.ID).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return false, result.Error
+		}
+		return result.RowsAffected == 1, nil
+	}
+	return false, nil
+}
+
+func (tf *TwoFactor) Enroll(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.User)
+	if user.TOTPEnabled {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Two-factor authentication is already enabled"})
+	}
+
+	secret, err := models.GenerateTOTPSecret()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate secret"})
+	}
+	if err := database.DB.Model(&user).Update("totp_secret", secret).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to store secret"})
+	}
+
+	return c.JSON(fiber.Map{
+		"secret":      secret,
+		"otpauth_uri": models.TOTPURI(tf.Issuer, user.Username, secret),
+	})
+}
+
+func (tf *TwoFactor) Confirm(c *fiber.Ctx) error {
+	type ConfirmRequest struct {
+		Code string `json:"code"`
+	}
+
+	var req ConfirmRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+	}
+
+	user := c.Locals("user").(models.User)
+	if user.TOTPEnabled {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Two-factor authentication is already enabled"})
+	}
+	if user.TOTPSecret == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Two-factor enrollment not started"})
+	}
+	if err := tf.Verify(c.Context(), user, req.Code, c.IP()); err != nil {
+		return errorResponse(c, err)
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		for i := range codes {
+			code, err := models.GenerateRecoveryCode()
+			if err != nil {
+				return err
+			}
+			rc, err := models.NewRecoveryCode(user.ID, code)
+			if err != nil {
+				return err
+			}
+			if err := tx.Create(&rc).Error; err != nil {
+				return err
+			}
+			codes[i] = code
+		}
+		return tx.Model(&user).Update("totp_enabled", true).Error
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to enable two-factor authentication"})
+	}
+
+	return c.JSON(fiber.Map{"message": "Two-factor authentication enabled", "recovery_codes": codes})
+}
+
+func (tf *TwoFactor) Disable(c *fiber.Ctx) error {
+	type DisableRequest struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	var req DisableRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+	}
+
+	user := c.Locals("user").(models.User)
+	if !user.TOTPEnabled {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Two-factor authentication is not enabled"})
+	}
+	if !user.CheckPassword(req.Password) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Incorrect password"})
+	}
+	if err := tf.Verify(c.Context(), user, req.Code, c.IP()); err != nil {
+		return errorResponse(c, err)
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&user).Updates(map[string]interface{}{"totp_secret": "", "totp_enabled": false}).Error
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to disable two-factor authentication"})
+	}
+	return c.JSON(fiber.Map{"message": "Two-factor authentication disabled"})
+}
+
+// LoginTwoFactor completes a login started with a password for users that
+// have 2FA enabled, exchanging the mfa token and a code for real tokens.
+func LoginTwoFactor(tm *TokenManager, tf *TwoFactor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		type LoginTwoFactorRequest struct {
+			MFAToken string `json:"mfa_token"`
+			Code     string `json:"code"`
+		}
+
+		var req LoginTwoFactorRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot parse JSON"})
+		}
+
+		claims, err := tm.Parse(req.MFAToken, TokenTypeMFA)
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+		}
+		revoked, err := tm.Revoked(c.Context(), claims)
+		if err != nil || revoked {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+		}
+
+		var user models.User
+		if err := database.DB.Where("username = ?", claims.Username).First(&user).Error; err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+		}
+		if claims.TokenVersion != user.TokenVersion || !user.TOTPEnabled {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+		}
+
+		if err := tf.Verify(c.Context(), user, req.Code, c.IP()); err != nil {
+			if err == errTwoFactorLocked {
+				retryAfter, _ := tf.Guard.Locked(c.Context(), user.Username, c.IP())
+				c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			}
+			return errorResponse(c, err)
+		}
+		if fresh, err := tm.Revoke(c.Context(), claims); err != nil || !fresh {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+		}
+		if err := tf.Guard.Succeeded(c.Context(), user.Username); err != nil {
+			zlog.Error().Err(err).Msg("login failure reset")
+		}
+
+		return loginResponse(c, tm, user)
+	}
+}
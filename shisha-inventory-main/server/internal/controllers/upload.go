@@ -11,7 +11,9 @@ import (
 	"strconv"
 	"time"
 
+	"server/internal/economy"
 	"server/internal/initializers"
+	"server/internal/ledger"
 	"server/internal/models"
 
 	"github.com/go-redis/redis/v8"
@@ -80,9 +82,12 @@ func (uc *UploadController) HandleUpload(c *fiber.Ctx) error {
 	// Begin transaction
 	tx := uc.DB.Begin()
 
-	// Add 1 coin to user's balance
-	user.Coins += 1
-	if err := tx.Save(&user).Error; err != nil {
+	// Reward the upload as the economy policy says
+	policy, err := economy.Current(tx)
+	if err == nil && policy.UploadReward > 0 {
+		_, err = ledger.Move(tx, policy.Version(), ledger.AccountMint, ledger.UserAccount(user.Username), policy.UploadReward, ledger.ReasonUploadReward, "image:"+imageID)
+	}
+	if err != nil {
 		tx.Rollback()
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update user balance"})
 	}
@@ -107,12 +112,19 @@ func (uc *UploadController) HandleUpload(c *fiber.Ctx) error {
 		UploadedAt: time.Now(),
 		Hash:       hashValue,
 		Username:   user.Username,
+		Reward:     policy.UploadReward,
 	}
-	if err := uc.DB.Create(&image).Error; err != nil {
+	if err := tx.Create(&image).Error; err != nil {
 		tx.Rollback()
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to store image metadata"})
 	}
 
+	// A first upload qualifies the user's referral
+	if err := QualifyReferral(tx, user.Username); err != nil {
+		tx.Rollback()
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to pay referral bonus"})
+	}
+
 	// Store the hash in Redis
 	if err := uc.RedisClient.Set(uc.Ctx, hashValue, imageID, 0).Err(); err != nil {
 		tx.Rollback()
@@ -145,6 +157,10 @@ var imageUrls = []string{
 }
 
 func (uc *UploadController) HandleBulkDownload() error {
+	policy, err := economy.Current(uc.DB)
+	if err != nil {
+		return err
+	}
 	for i, url := range imageUrls {
 		resp, err := http.Get(url)
 		if err != nil {
@@ -191,7 +207,7 @@ func (uc *UploadController) HandleBulkDownload() error {
 			Name:       imageName,
 			UploadedAt: time.Now(),
 			Hash:       hashValue,
-			Price:      25,
+			Price:      policy.PremiumPrice,
 		}
 		if err := uc.DB.Create(&image).Error; err != nil {
 			return err
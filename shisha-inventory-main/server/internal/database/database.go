@@ -30,3 +30,55 @@ func DBReady(url string) bool {
 func Migrate(models ...interface{}) error {
 	return DB.AutoMigrate(models...).Error
 }
+
+// duplicatePurchases marks every unrefunded purchase of an image but the
+// oldest as refunded. They were made before purchases were unique and are
+// kept for the record, the coins they cost are not paid back.
+const duplicatePurchases = `
+UPDATE purchases SET refunded_at = NOW() WHERE id IN (
+	SELECT id FROM (
+		SELECT id, ROW_NUMBER() OVER (PARTITION BY user_name, seller, image_id ORDER BY created_at, id) AS n
+		FROM purchases WHERE refunded_at IS NULL
+	) ranked WHERE n > 1
+) RETURNING id, user_name, image_id`
+
+// MigratePurchases limits users to one unrefunded purchase per image. gorm
+// cannot declare partial indexes, so it replaces the plain unique index.
+// Premium and uploaded images are numbered apart, the seller tells them apart.
+// Duplicates made before the index existed are marked refunded first and
+// logged, so operators can pay them back.
+func MigratePurchases(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		rows, err := tx.Raw(duplicatePurchases).Rows()
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id, imageID uint
+			var username string
+			if err := rows.Scan(&id, &username, &imageID); err != nil {
+				return err
+			}
+			zlog.Warn().Uint("purchase", id).Str("user", username).Uint("image", imageID).Msg("duplicate purchase marked refunded")
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		return tx.Exec(`
+DROP INDEX IF EXISTS idx_purchases_user_image;
+DROP INDEX IF EXISTS idx_purchases_user_image_active;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_purchases_user_seller_image_active
+	ON purchases (user_name, seller, image_id) WHERE refunded_at IS NULL;
+`).Error
+	})
+}
+
+// MigrateListings limits images to one listing that is not withdrawn.
+func MigrateListings(db *gorm.DB) error {
+	return db.Exec(`
+CREATE UNIQUE INDEX IF NOT EXISTS idx_listings_image_open
+	ON listings (image_id) WHERE status <> 'withdrawn';
+`).Error
+}
@@ -0,0 +1,201 @@
+// internal/economy/economy.go
+package economy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"server/internal/models"
+
+	"github.com/jinzhu/gorm"
+	"gopkg.in/yaml.v3"
+)
+
+// Default is in force until a policy is stored.
+var Default = models.EconomyPolicy{
+	SignupBonus:           100,
+	UploadReward:          1,
+	PremiumPrice:          25,
+	DailyReward:           5,
+	DailyRewardStep:       1,
+	DailyRewardMax:        10,
+	ReferralBonus:         50,
+	InviteeBonus:          25,
+	MarketplaceCommission: 10,
+}
+
+// Load reads a YAML policy file. Amounts it leaves out keep their default:
+//
+//	signup_bonus: 100
+//	upload_reward: 1
+//	premium_price: 25
+//	daily_reward: 5
+//	daily_reward_step: 1
+//	daily_reward_max: 10
+//	referral_bonus: 50
+//	invitee_bonus: 25
+//	marketplace_commission: 10
+func Load(path string) (models.EconomyPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return models.EconomyPolicy{}, err
+	}
+	policy := Default
+	if err := yaml.Unmarshal(data, &policy); err != nil {
+		return models.EconomyPolicy{}, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := Validate(policy); err != nil {
+		return models.EconomyPolicy{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return policy, nil
+}
+
+func Validate(policy models.EconomyPolicy) error {
+	if policy.SignupBonus < 0 {
+		return errors.New("signup_bonus must not be negative")
+	}
+	if policy.UploadReward < 0 {
+		return errors.New("upload_reward must not be negative")
+	}
+	if policy.PremiumPrice <= 0 {
+		return errors.New("premium_price must be greater than zero")
+	}
+	if policy.DailyReward < 0 || policy.DailyRewardStep < 0 {
+		return errors.New("daily_reward and daily_reward_step must not be negative")
+	}
+	if policy.ReferralBonus < 0 || policy.InviteeBonus < 0 {
+		return errors.New("referral_bonus and invitee_bonus must not be negative")
+	}
+	if policy.MarketplaceCommission < 0 || policy.MarketplaceCommission > 100 {
+		return errors.New("marketplace_commission must be between 0 and 100")
+	}
+	if policy.DailyRewardMax < 0 || (policy.DailyRewardMax > 0 && policy.DailyRewardMax < policy.DailyReward) {
+		return errors.New("daily_reward_max must not be below daily_reward, or 0 for no cap")
+	}
+	return nil
+}
+
+// Current returns the policy in force. Read it in the transaction that uses
+// the amounts and pass its Version to ledger.Post, so the entries record the
+// version the amounts were taken from.
+func Current(db *gorm.DB) (models.EconomyPolicy, error) {
+	var policy models.EconomyPolicy
+	err := db.Order("id desc").First(&policy).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return Default, nil
+	}
+	return policy, err
+}
+
+// additions are amounts added to the policy after versions were stored.
+// Stored versions get 0 for them when their columns are added, which would
+// turn off what they pay for on upgrade.
+var additions = []struct {
+	Columns []string
+	Apply   func(to *models.EconomyPolicy, from models.EconomyPolicy)
+}{
+	{[]string{"daily_reward", "daily_reward_step", "daily_reward_max"}, func(to *models.EconomyPolicy, from models.EconomyPolicy) {
+		to.DailyReward, to.DailyRewardStep, to.DailyRewardMax = from.DailyReward, from.DailyRewardStep, from.DailyRewardMax
+	}},
+	{[]string{"referral_bonus", "invitee_bonus"}, func(to *models.EconomyPolicy, from models.EconomyPolicy) {
+		to.ReferralBonus, to.InviteeBonus = from.ReferralBonus, from.InviteeBonus
+	}},
+	{[]string{"marketplace_commission"}, func(to *models.EconomyPolicy, from models.EconomyPolicy) {
+		to.MarketplaceCommission = from.MarketplaceCommission
+	}},
+}
+
+// Migrate creates the economy policies table. When it adds amounts to a table
+// with stored versions, the latest version is carried forward as a new one
+// with those amounts taken from policy, the configured starting values.
+func Migrate(db *gorm.DB, policy models.EconomyPolicy) error {
+	if !db.HasTable(&models.EconomyPolicy{}) {
+		return db.AutoMigrate(&models.EconomyPolicy{}).Error
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := lock(tx); err != nil {
+			return err
+		}
+		latest, err := Current(tx)
+		if err != nil {
+			return err
+		}
+		var added []string
+		for _, addition := range additions {
+			if !tx.Dialect().HasColumn("economy_policies", addition.Columns[0]) {
+				addition.Apply(&latest, policy)
+				added = append(added, addition.Columns...)
+			}
+		}
+		if err := tx.AutoMigrate(&models.EconomyPolicy{}).Error; err != nil {
+			return err
+		}
+		// Nothing to carry forward before the first version is seeded
+		if len(added) == 0 || latest.ID == 0 {
+			return nil
+		}
+		latest.ID = 0
+		latest.ChangedBy = "migration"
+		latest.Comment = "defaults for " + strings.Join(added, ", ")
+		latest.CreatedAt = time.Time{}
+		return tx.Create(&latest).Error
+	})
+}
+
+// Seed stores policy as the first version unless one is stored already. A
+// policy file only provides the starting values, changes made through the
+// admin API are kept across restarts.
+func Seed(db *gorm.DB, policy models.EconomyPolicy) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := lock(tx); err != nil {
+			return err
+		}
+		var count int
+		if err := tx.Model(&models.EconomyPolicy{}).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return nil
+		}
+		policy.ID = 0
+		policy.ChangedBy = "config"
+		return tx.Create(&policy).Error
+	})
+}
+
+// Update stores policy as a new version. A new premium price applies to
+// premium images seeded afterwards, stored images keep the price they have.
+func Update(db *gorm.DB, policy models.EconomyPolicy, admin string) (models.EconomyPolicy, error) {
+	if err := Validate(policy); err != nil {
+		return models.EconomyPolicy{}, err
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := lock(tx); err != nil {
+			return err
+		}
+		policy.ID = 0
+		policy.ChangedBy = admin
+		return tx.Create(&policy).Error
+	})
+	return policy, err
+}
+
+// History returns stored versions, newest first. When before is set only
+// versions older than it are returned.
+func History(db *gorm.DB, before uint, limit int) ([]models.EconomyPolicy, error) {
+	query := db.Order("id desc").Limit(limit)
+	if before > 0 {
+		query = query.Where("id < ?", before)
+	}
+	var policies []models.EconomyPolicy
+	err := query.Find(&policies).Error
+	return policies, err
+}
+
+// lock serializes writers, readers are not blocked.
+func lock(tx *gorm.DB) error {
+	return tx.Exec("LOCK TABLE economy_policies IN SHARE ROW EXCLUSIVE MODE").Error
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"server/internal/models"
+	"time"
 
 	zlog "github.com/rs/zerolog/log"
 	"github.com/twmb/franz-go/pkg/kgo"
@@ -53,6 +54,92 @@ func (p *Producer) SendBuyMessage(ctx context.Context, user, image_uuid string,
 	})
 }
 
+func (p *Producer) SendLockoutMessage(ctx context.Context, user, ip, scope string, failures int, lockout time.Duration) {
+	msg := models.LockoutMessage{User: user, Type: "lockout", IP: ip, Scope: scope, Failures: failures, LockoutSeconds: int(lockout.Seconds())}
+	b, _ := json.Marshal(msg)
+	p.client.Produce(ctx, &kgo.Record{Topic: p.topic, Value: b}, func(_ *kgo.Record, err error) {
+		if err != nil {
+			zlog.Printf("record had a produce error: %v\n", err)
+		}
+	})
+}
+
+// SendCoinRequestMessage publishes a state change of a coin request. User is
+// the requester and target the payer.
+func (p *Producer) SendCoinRequestMessage(ctx context.Context, user, target string, requestID uint, amount int, status string) {
+	msg := models.CoinRequestMessage{User: user, Type: "coin_request", Target: target, RequestID: requestID, Amount: amount, Status: status}
+	b, _ := json.Marshal(msg)
+	p.client.Produce(ctx, &kgo.Record{Topic: p.topic, Value: b}, func(_ *kgo.Record, err error) {
+		if err != nil {
+			zlog.Printf("record had a produce error: %v\n", err)
+		}
+	})
+}
+
+func (p *Producer) SendRuleDecisionMessage(ctx context.Context, user, kind, target string, amount int, action, rule string) {
+	msg := models.RuleDecisionMessage{User: user, Type: "rule_decision", Kind: kind, Target: target, Amount: amount, Action: action, Rule: rule}
+	b, _ := json.Marshal(msg)
+	p.client.Produce(ctx, &kgo.Record{Topic: p.topic, Value: b}, func(_ *kgo.Record, err error) {
+		if err != nil {
+			zlog.Printf("record had a produce error: %v\n", err)
+		}
+	})
+}
+
+// SendReversalMessage publishes a reversed transfer. User is the original
+// sender, who gets the amount back from target.
+func (p *Producer) SendReversalMessage(ctx context.Context, user, target string, amount int, transferID uint) {
+	msg := models.ReversalMessage{User: user, Type: "reversal", Target: target, Amount: amount, TransferID: transferID}
+	b, _ := json.Marshal(msg)
+	p.client.Produce(ctx, &kgo.Record{Topic: p.topic, Value: b}, func(_ *kgo.Record, err error) {
+		if err != nil {
+			zlog.Printf("record had a produce error: %v\n", err)
+		}
+	})
+}
+
+func (p *Producer) SendRefundMessage(ctx context.Context, user, image_uuid string, amount int) {
+	msg := models.RefundMessage{User: user, Type: "refund", Image_uuid: image_uuid, Amount: amount}
+	b, _ := json.Marshal(msg)
+	p.client.Produce(ctx, &kgo.Record{Topic: p.topic, Value: b}, func(_ *kgo.Record, err error) {
+		if err != nil {
+			zlog.Printf("record had a produce error: %v\n", err)
+		}
+	})
+}
+
+func (p *Producer) SendRewardMessage(ctx context.Context, user string, amount, streak int, day string) {
+	msg := models.RewardMessage{User: user, Type: "reward", Amount: amount, Streak: streak, Day: day}
+	b, _ := json.Marshal(msg)
+	p.client.Produce(ctx, &kgo.Record{Topic: p.topic, Value: b}, func(_ *kgo.Record, err error) {
+		if err != nil {
+			zlog.Printf("record had a produce error: %v\n", err)
+		}
+	})
+}
+
+func (p *Producer) SendTopUpMessage(ctx context.Context, user string, amount int) {
+	msg := models.TopUpMessage{User: user, Type: "top_up", Amount: amount}
+	b, _ := json.Marshal(msg)
+	p.client.Produce(ctx, &kgo.Record{Topic: p.topic, Value: b}, func(_ *kgo.Record, err error) {
+		if err != nil {
+			zlog.Printf("record had a produce error: %v\n", err)
+		}
+	})
+}
+
+// SendSaleMessage publishes a marketplace sale. User is the buyer, amount what
+// they paid and commission the part of it the platform kept.
+func (p *Producer) SendSaleMessage(ctx context.Context, user, seller, image_uuid string, listingID uint, amount, commission int) {
+	msg := models.SaleMessage{User: user, Type: "sale", Seller: seller, Image_uuid: image_uuid, ListingID: listingID, Amount: amount, Commission: commission}
+	b, _ := json.Marshal(msg)
+	p.client.Produce(ctx, &kgo.Record{Topic: p.topic, Value: b}, func(_ *kgo.Record, err error) {
+		if err != nil {
+			zlog.Printf("record had a produce error: %v\n", err)
+		}
+	})
+}
+
 func (p *Producer) Close() {
 	p.client.Close()
 }
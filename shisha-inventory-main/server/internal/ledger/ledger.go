@@ -0,0 +1,227 @@
+// internal/ledger/ledger.go
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"server/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	ReasonSignupBonus    = "signup_bonus"
+	ReasonUploadReward   = "upload_reward"
+	ReasonTransfer       = "transfer"
+	ReasonPurchase       = "purchase"
+	ReasonOpeningBalance = "opening_balance"
+	ReasonReversal       = "reversal"
+	ReasonRefund         = "refund"
+	ReasonDailyReward    = "daily_reward"
+	ReasonReferralBonus  = "referral_bonus"
+	ReasonTopUp          = "top_up"
+	ReasonCorrection     = "correction"
+)
+
+// System accounts are the other side of coins entering or leaving circulation.
+// They have no balance column of their own.
+const (
+	// AccountMint issues bonuses and rewards
+	AccountMint = "system:mint"
+	// AccountShop receives payments for premium images
+	AccountShop = "system:shop"
+	// AccountPayments issues coins bought through a payment provider
+	AccountPayments = "system:payments"
+)
+
+const userAccountPrefix = "user:"
+
+var (
+	ErrInsufficientFunds = errors.New("insufficient coins")
+	ErrInvalidAmount     = errors.New("amount must be greater than zero")
+	ErrSelfTransfer      = errors.New("cannot transfer coins to yourself")
+	ErrUnbalanced        = errors.New("ledger: postings do not balance")
+)
+
+// Posting moves Amount coins into Account, or out of it when negative.
+type Posting struct {
+	Account string
+	Amount  int
+}
+
+func UserAccount(username string) string {
+	return userAccountPrefix + username
+}
+
+// Username returns the user a user account belongs to.
+func Username(account string) (string, bool) {
+	if !strings.HasPrefix(account, userAccountPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(account, userAccountPrefix), true
+}
+
+// Post records a balanced movement and returns its transaction ID. version is
+// the economy policy the amounts were taken from, as read by the caller, or
+// nil when no policy sets them. users.coins is kept as a cached balance of
+// user accounts and never drops below zero, in which case ErrInsufficientFunds
+// is returned. tx should be a transaction so the entries and the balances are
+// written together.
+func Post(tx *gorm.DB, version *uint, reason, reference string, postings ...Posting) (string, error) {
+	if err := lockBalances(tx, postings); err != nil {
+		return "", err
+	}
+	txID, err := record(tx, version, reason, reference, postings)
+	if err != nil {
+		return "", err
+	}
+
+	for _, p := range postings {
+		username, ok := Username(p.Account)
+		if !ok {
+			continue
+		}
+		result := tx.Model(&models.User{}).
+			Where("username = ? AND coins + ? >= 0", username, p.Amount).
+			UpdateColumn("coins", gorm.Expr("coins + ?", p.Amount))
+		if result.Error != nil {
+			return "", result.Error
+		}
+		if result.RowsAffected != 1 {
+			if p.Amount < 0 {
+				return "", ErrInsufficientFunds
+			}
+			return "", fmt.Errorf("ledger: account %s not found", p.Account)
+		}
+	}
+	return txID, nil
+}
+
+// lockBalances locks the users of the postings with SELECT ... FOR UPDATE and
+// checks that none of them would go negative. Rows are locked in username
+// order so concurrent movements between the same users cannot deadlock.
+func lockBalances(tx *gorm.DB, postings []Posting) error {
+	changes := map[string]int{}
+	for _, p := range postings {
+		if username, ok := Username(p.Account); ok {
+			changes[username] += p.Amount
+		}
+	}
+	usernames := make([]string, 0, len(changes))
+	for username := range changes {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	for _, username := range usernames {
+		var user models.User
+		err := tx.Set("gorm:query_option", "FOR UPDATE").Where("username = ?", username).First(&user).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return fmt.Errorf("ledger: account %s not found", UserAccount(username))
+		}
+		if err != nil {
+			return err
+		}
+		if user.Coins+changes[username] < 0 {
+			return ErrInsufficientFunds
+		}
+	}
+	return nil
+}
+
+// record writes the entries of a movement without touching balances, tagged
+// with the economy policy version.
+func record(tx *gorm.DB, version *uint, reason, reference string, postings []Posting) (string, error) {
+	sum := 0
+	for _, p := range postings {
+		sum += p.Amount
+	}
+	if sum != 0 || len(postings) < 2 {
+		return "", ErrUnbalanced
+	}
+
+	txID := uuid.New().String()
+	for _, p := range postings {
+		entry := models.LedgerEntry{
+			TxID:          txID,
+			Account:       p.Account,
+			Amount:        p.Amount,
+			Reason:        reason,
+			Reference:     reference,
+			PolicyVersion: version,
+		}
+		if err := tx.Create(&entry).Error; err != nil {
+			return "", err
+		}
+	}
+	return txID, nil
+}
+
+// Move posts amount from one account to another.
+func Move(tx *gorm.DB, version *uint, from, to string, amount int, reason, reference string) (string, error) {
+	return Post(tx, version, reason, reference, Posting{Account: from, Amount: -amount}, Posting{Account: to, Amount: amount})
+}
+
+// Transfer moves amount coins from one user to another in its own
+// transaction and records it with memo. It is the single path every user to
+// user payment goes through.
+func Transfer(db *gorm.DB, from, to string, amount int, memo string) (models.Transfer, error) {
+	var transfer models.Transfer
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		transfer, err = TransferTx(tx, from, to, amount, memo)
+		return err
+	})
+	return transfer, err
+}
+
+// TransferTx is Transfer within a transaction the caller already holds, for
+// payments that must commit together with other changes.
+func TransferTx(tx *gorm.DB, from, to string, amount int, memo string) (models.Transfer, error) {
+	if amount <= 0 {
+		return models.Transfer{}, ErrInvalidAmount
+	}
+	if from == to {
+		return models.Transfer{}, ErrSelfTransfer
+	}
+
+	transfer := models.Transfer{FromUser: from, ToUser: to, Amount: amount, Memo: memo}
+	if err := tx.Create(&transfer).Error; err != nil {
+		return models.Transfer{}, err
+	}
+	txID, err := Move(tx, nil, UserAccount(from), UserAccount(to), amount, ReasonTransfer, fmt.Sprintf("transfer:%d", transfer.ID))
+	if err != nil {
+		return models.Transfer{}, err
+	}
+	transfer.LedgerTxID = &txID
+	if err := tx.Model(&transfer).UpdateColumn("ledger_tx_id", txID).Error; err != nil {
+		return models.Transfer{}, err
+	}
+	return transfer, nil
+}
+
+// Balance sums the entries of an account.
+func Balance(db *gorm.DB, account string) (int, error) {
+	var balance struct{ Total int }
+	err := db.Model(&models.LedgerEntry{}).
+		Select("COALESCE(SUM(amount), 0) AS total").
+		Where("account = ?", account).
+		Scan(&balance).Error
+	return balance.Total, err
+}
+
+// Entries returns the latest entries of an account, newest first. When
+// beforeID is set only entries older than it are returned.
+func Entries(db *gorm.DB, account string, beforeID uint, limit int) ([]models.LedgerEntry, error) {
+	query := db.Where("account = ?", account)
+	if beforeID > 0 {
+		query = query.Where("id < ?", beforeID)
+	}
+	var entries []models.LedgerEntry
+	err := query.Order("id desc").Limit(limit).Find(&entries).Error
+	return entries, err
+}
@@ -0,0 +1,61 @@
+// internal/ledger/migrate.go
+package ledger
+
+import (
+	"server/internal/models"
+
+	"github.com/jinzhu/gorm"
+	zlog "github.com/rs/zerolog/log"
+)
+
+const appendOnlyTrigger = `
+CREATE OR REPLACE FUNCTION ledger_entries_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'ledger entries are append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS ledger_entries_append_only ON ledger_entries;
+CREATE TRIGGER ledger_entries_append_only BEFORE UPDATE OR DELETE ON ledger_entries
+	FOR EACH ROW EXECUTE PROCEDURE ledger_entries_append_only();
+`
+
+// Migrate creates the append-only ledger, the economy policies its entries
+// refer to and the balance corrections tables, and opens the ledger with the
+// balances of users that predate it. It must run after the users table is
+// migrated.
+func Migrate(db *gorm.DB) error {
+	if err := db.AutoMigrate(&models.EconomyPolicy{}, &models.LedgerEntry{}, &models.BalanceCorrection{}).Error; err != nil {
+		return err
+	}
+	if err := db.Exec(appendOnlyTrigger).Error; err != nil {
+		return err
+	}
+	// Coins are only granted through the ledger, so new rows must start empty
+	if err := db.Exec("ALTER TABLE users ALTER COLUMN coins SET DEFAULT 0").Error; err != nil {
+		return err
+	}
+
+	var users []models.User
+	err := db.Where("coins <> 0 AND NOT EXISTS (SELECT 1 FROM ledger_entries WHERE account = 'user:' || users.username)").
+		Find(&users).Error
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			_, err := record(tx, nil, ReasonOpeningBalance, "", []Posting{
+				{Account: AccountMint, Amount: -user.Coins},
+				{Account: UserAccount(user.Username), Amount: user.Coins},
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(users) > 0 {
+		zlog.Info().Int("users", len(users)).Msg("ledger opening balances recorded")
+	}
+	return nil
+}
@@ -0,0 +1,345 @@
+// internal/ledger/reconcile.go
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"server/internal/models"
+
+	"github.com/jinzhu/gorm"
+	zlog "github.com/rs/zerolog/log"
+)
+
+var ErrDriftChanged = errors.New("balance changed since the report, reconcile again")
+
+// Sources of a user's balance, in report order. Opening balances are the
+// snapshot taken when the ledger was introduced, every other source is
+// recomputed from the records of the activity that paid or charged the user.
+// Corrections are the ledger entries of earlier reconciliations.
+var sources = []struct {
+	Name    string
+	Reasons []string
+}{
+	{"opening_balance", []string{ReasonOpeningBalance}},
+	{"signup_bonus", []string{ReasonSignupBonus}},
+	{"uploads", []string{ReasonUploadReward}},
+	{"transfers", []string{ReasonTransfer, ReasonReversal}},
+	{"purchases", []string{ReasonPurchase, ReasonRefund}},
+	{"daily_rewards", []string{ReasonDailyReward}},
+	{"referrals", []string{ReasonReferralBonus}},
+	{"top_ups", []string{ReasonTopUp}},
+	{"corrections", []string{ReasonCorrection}},
+}
+
+// balancesQuery selects each user's cached balance, ledger balance and the
+// amount of every source but corrections, in the order of sources. Reversed
+// transfers and refunded purchases are left out, their reversal paid them
+// back.
+const balancesQuery = `
+SELECT users.username, users.coins,
+	COALESCE((SELECT SUM(amount) FROM ledger_entries WHERE account = 'user:' || users.username), 0),
+	COALESCE((SELECT SUM(amount) FROM ledger_entries WHERE account = 'user:' || users.username AND reason = 'opening_balance'), 0),
+	users.signup_bonus,
+	COALESCE((SELECT SUM(reward) FROM images WHERE images.username = users.username), 0),
+	COALESCE((SELECT SUM(CASE WHEN to_user = users.username THEN amount ELSE -amount END) FROM transfers
+		WHERE (from_user = users.username OR to_user = users.username) AND reversal_id IS NULL), 0),
+	COALESCE((SELECT SUM(CASE WHEN seller = users.username THEN price - commission ELSE -price END) FROM purchases
+		WHERE (user_name = users.username OR seller = users.username) AND refunded_at IS NULL), 0),
+	COALESCE((SELECT SUM(amount) FROM daily_rewards WHERE daily_rewards.username = users.username), 0),
+	COALESCE((SELECT SUM(CASE WHEN inviter = users.username THEN inviter_bonus ELSE invitee_bonus END) FROM referrals
+		WHERE (inviter = users.username OR invitee = users.username) AND status = 'rewarded'), 0),
+	COALESCE((SELECT SUM(coins) FROM top_ups WHERE top_ups.username = users.username AND status = 'succeeded'), 0)
+FROM users
+WHERE users.deleted_at IS NULL`
+
+// SourceDrift is what a source paid a user according to its records and
+// according to the ledger.
+type SourceDrift struct {
+	Expected int `json:"expected"`
+	Ledger   int `json:"ledger"`
+}
+
+// Drift is a user whose cached or ledger balance differs from the balance
+// expected from their activity. Difference is the cached balance minus the
+// expected one, Sources lists the sources the ledger disagrees with.
+type Drift struct {
+	Username   string                 `json:"username"`
+	Coins      int                    `json:"coins"`
+	Ledger     int                    `json:"ledger"`
+	Expected   int                    `json:"expected"`
+	Difference int                    `json:"difference"`
+	Sources    map[string]SourceDrift `json:"sources"`
+}
+
+// Report is the outcome of a reconciliation. Unbalanced lists ledger
+// transactions whose entries do not sum to zero, which corrections cannot fix.
+type Report struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	Users       int       `json:"users"`
+	TotalDrift  int       `json:"total_drift"`
+	Drifts      []Drift   `json:"drifts"`
+	Unbalanced  []string  `json:"unbalanced"`
+}
+
+func (r Report) Clean() bool {
+	return len(r.Drifts) == 0 && len(r.Unbalanced) == 0
+}
+
+// balance is a user's cached and ledger balances and the amount of each
+// source.
+type balance struct {
+	username string
+	coins    int
+	ledger   int
+	sources  map[string]int
+}
+
+func (b balance) expected() int {
+	total := 0
+	for _, amount := range b.sources {
+		total += amount
+	}
+	return total
+}
+
+// balances reads the balances of every user, or of one when username is set,
+// in a single statement so concurrent payments do not show up as drift.
+func balances(db *gorm.DB, username string) ([]balance, error) {
+	query := db.Raw(balancesQuery)
+	if username != "" {
+		query = db.Raw(balancesQuery+" AND users.username = ?", username)
+	}
+	rows, err := query.Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []balance
+	for rows.Next() {
+		b := balance{sources: map[string]int{}}
+		amounts := make([]int, len(sources)-1)
+		dest := []interface{}{&b.username, &b.coins, &b.ledger}
+		for i := range amounts {
+			dest = append(dest, &amounts[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		for i, amount := range amounts {
+			b.sources[sources[i].Name] = amount
+		}
+		result = append(result, b)
+	}
+	return result, rows.Err()
+}
+
+// Reconcile recomputes every user's balance from what they were paid and
+// charged: their opening balance, signup bonus, upload rewards, transfers,
+// purchases and sales, daily rewards, referral bonuses and top-ups. It is
+// compared to both users.coins and the ledger, and the sources the ledger
+// disagrees with are reported.
+func Reconcile(db *gorm.DB) (Report, error) {
+	report := Report{GeneratedAt: time.Now(), Drifts: []Drift{}, Unbalanced: []string{}}
+
+	users, err := balances(db, "")
+	if err != nil {
+		return Report{}, err
+	}
+	for _, b := range users {
+		report.Users++
+		expected := b.expected()
+		if b.coins == expected && b.ledger == expected {
+			continue
+		}
+		drift := Drift{
+			Username:   b.username,
+			Coins:      b.coins,
+			Ledger:     b.ledger,
+			Expected:   expected,
+			Difference: b.coins - expected,
+		}
+		drift.Sources, err = sourceDrifts(db, b)
+		if err != nil {
+			return Report{}, err
+		}
+		report.TotalDrift += drift.Difference
+		report.Drifts = append(report.Drifts, drift)
+	}
+	sort.Slice(report.Drifts, func(i, j int) bool { return report.Drifts[i].Username < report.Drifts[j].Username })
+
+	err = db.Model(&models.LedgerEntry{}).Group("tx_id").Having("SUM(amount) <> 0").Order("tx_id").Pluck("tx_id", &report.Unbalanced).Error
+	if err != nil {
+		return Report{}, err
+	}
+	return report, nil
+}
+
+// sourceDrifts compares the sources of b with the ledger entries of the user
+// by reason. Reasons no source knows of are reported on their own.
+func sourceDrifts(db *gorm.DB, b balance) (map[string]SourceDrift, error) {
+	var totals []struct {
+		Reason string
+		Total  int
+	}
+	err := db.Model(&models.LedgerEntry{}).
+		Select("reason, SUM(amount) AS total").
+		Where("account = ?", UserAccount(b.username)).
+		Group("reason").
+		Scan(&totals).Error
+	if err != nil {
+		return nil, err
+	}
+	booked := map[string]int{}
+	for _, t := range totals {
+		booked[t.Reason] = t.Total
+	}
+
+	result := map[string]SourceDrift{}
+	for _, source := range sources {
+		drift := SourceDrift{Expected: b.sources[source.Name]}
+		for _, reason := range source.Reasons {
+			drift.Ledger += booked[reason]
+			delete(booked, reason)
+		}
+		if drift.Expected != drift.Ledger {
+			result[source.Name] = drift
+		}
+	}
+	for reason, total := range booked {
+		if total != 0 {
+			result[reason] = SourceDrift{Ledger: total}
+		}
+	}
+	return result, nil
+}
+
+// Correct sets the cached balance and the ledger account of a drifted user to
+// the expected balance and records who did it. The ledger is corrected with an
+// entry against the mint, it is never rewritten. It refuses with
+// ErrDriftChanged when the balances moved since drift was reported, so a
+// reviewed report is never applied to a different state.
+func Correct(db *gorm.DB, drift Drift, operator string) (models.BalanceCorrection, error) {
+	var correction models.BalanceCorrection
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		err := tx.Set("gorm:query_option", "FOR UPDATE").Where("username = ?", drift.Username).First(&user).Error
+		if err != nil {
+			return err
+		}
+		users, err := balances(tx, user.Username)
+		if err != nil {
+			return err
+		}
+		if len(users) != 1 {
+			return gorm.ErrRecordNotFound
+		}
+		b := users[0]
+		expected := b.expected()
+		if b.coins != drift.Coins || b.ledger != drift.Ledger || expected != drift.Expected {
+			return ErrDriftChanged
+		}
+		if expected < 0 {
+			return fmt.Errorf("ledger: %s is expected to have a negative balance of %d", UserAccount(user.Username), expected)
+		}
+
+		correction = models.BalanceCorrection{
+			Username: user.Username,
+			Coins:    b.coins,
+			Ledger:   b.ledger,
+			Expected: expected,
+			Operator: operator,
+		}
+		if err := tx.Create(&correction).Error; err != nil {
+			return err
+		}
+		if b.ledger != expected {
+			_, err := record(tx, nil, ReasonCorrection, fmt.Sprintf("correction:%d", correction.ID), []Posting{
+				{Account: AccountMint, Amount: b.ledger - expected},
+				{Account: UserAccount(user.Username), Amount: expected - b.ledger},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Model(&user).UpdateColumn("coins", expected).Error
+	})
+	return correction, err
+}
+
+// WriteText prints a report for people, one line per drifted user with the
+// sources the ledger disagrees with as name=expected/ledger.
+func WriteText(w io.Writer, report Report) error {
+	fmt.Fprintf(w, "Reconciled %d users at %s\n", report.Users, report.GeneratedAt.Format(time.RFC3339))
+	if report.Clean() {
+		_, err := fmt.Fprintln(w, "No drift")
+		return err
+	}
+
+	if len(report.Drifts) > 0 {
+		fmt.Fprintf(w, "%d users drifted by %d coins in total\n\n", len(report.Drifts), report.TotalDrift)
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "USER\tCOINS\tLEDGER\tEXPECTED\tDIFFERENCE\tSOURCES")
+		for _, drift := range report.Drifts {
+			names := make([]string, 0, len(drift.Sources))
+			for name := range drift.Sources {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			detail := "-"
+			for i, name := range names {
+				source := drift.Sources[name]
+				if i == 0 {
+					detail = ""
+				} else {
+					detail += " "
+				}
+				detail += fmt.Sprintf("%s=%d/%d", name, source.Expected, source.Ledger)
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%+d\t%s\n", drift.Username, drift.Coins, drift.Ledger, drift.Expected, drift.Difference, detail)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	if len(report.Unbalanced) > 0 {
+		fmt.Fprintf(w, "\n%d unbalanced ledger transactions:\n", len(report.Unbalanced))
+		for _, txID := range report.Unbalanced {
+			fmt.Fprintf(w, "  %s\n", txID)
+		}
+	}
+	return nil
+}
+
+// RunReconcile reports drift every interval until ctx is done. It never
+// corrects balances, that is left to the reconcile command.
+func RunReconcile(ctx context.Context, db *gorm.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := Reconcile(db)
+			if err != nil {
+				zlog.Error().Err(err).Msg("reconciliation")
+				continue
+			}
+			for _, drift := range report.Drifts {
+				zlog.Warn().Str("user", drift.Username).Int("coins", drift.Coins).Int("ledger", drift.Ledger).Int("expected", drift.Expected).
+					Int("difference", drift.Difference).Msg("balance drift")
+			}
+			if len(report.Unbalanced) > 0 {
+				zlog.Error().Strs("transactions", report.Unbalanced).Msg("unbalanced ledger transactions")
+			}
+			zlog.Info().Int("users", report.Users).Int("drifted", len(report.Drifts)).Int("total_drift", report.TotalDrift).Msg("reconciliation")
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// internal/ledger/reversal.go
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"server/internal/models"
+
+	"github.com/jinzhu/gorm"
+)
+
+var (
+	ErrAlreadyReversed = errors.New("already reversed")
+	ErrNotFound        = errors.New("not found")
+)
+
+// ReverseTransfer pays a transfer back to its sender. The recipient must still
+// hold the coins, otherwise ErrInsufficientFunds is returned and nothing
+// changes.
+func ReverseTransfer(db *gorm.DB, transferID uint, admin, reason string) (models.Reversal, error) {
+	var reversal models.Reversal
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var transfer models.Transfer
+		err := tx.Set("gorm:query_option", "FOR UPDATE").First(&transfer, transferID).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if transfer.ReversalID != nil {
+			return ErrAlreadyReversed
+		}
+
+		txID, err := Move(tx, nil, UserAccount(transfer.ToUser), UserAccount(transfer.FromUser), transfer.Amount, ReasonReversal, fmt.Sprintf("transfer:%d", transfer.ID))
+		if err != nil {
+			return err
+		}
+		reversal = models.Reversal{
+			Kind:         models.ReversalTransfer,
+			TransferID:   &transfer.ID,
+			Username:     transfer.FromUser,
+			Counterparty: transfer.ToUser,
+			Amount:       transfer.Amount,
+			Reason:       reason,
+			Admin:        admin,
+			LedgerTxID:   &txID,
+		}
+		if err := tx.Create(&reversal).Error; err != nil {
+			return err
+		}
+		return tx.Model(&transfer).UpdateColumn("reversal_id", reversal.ID).Error
+	})
+	return reversal, err
+}
+
+// RefundPurchase pays back what a purchase was charged and revokes the image.
+// Every account the charge went to pays its share back, so a marketplace sale
+// is refunded by the seller and the shop. Purchases made before the ledger
+// have no charge on record, they are only revoked.
+func RefundPurchase(db *gorm.DB, purchaseID uint, admin, reason string) (models.Reversal, error) {
+	var reversal models.Reversal
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var purchase models.Purchase
+		err := tx.Set("gorm:query_option", "FOR UPDATE").First(&purchase, purchaseID).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if purchase.RefundedAt != nil {
+			return ErrAlreadyReversed
+		}
+
+		reference := fmt.Sprintf("purchase:%d", purchase.ID)
+		var charges []Posting
+		err = tx.Model(&models.LedgerEntry{}).
+			Select("account, SUM(amount) AS amount").
+			Where("reason = ? AND reference = ?", ReasonPurchase, reference).
+			Group("account").
+			Scan(&charges).Error
+		if err != nil {
+			return err
+		}
+
+		reversal = models.Reversal{
+			Kind:         models.ReversalPurchase,
+			PurchaseID:   &purchase.ID,
+			Username:     purchase.UserName,
+			Counterparty: AccountShop,
+			Reason:       reason,
+			Admin:        admin,
+		}
+		if purchase.Seller != "" {
+			reversal.Counterparty = purchase.Seller
+		}
+		var postings []Posting
+		for _, charge := range charges {
+			if charge.Account == UserAccount(purchase.UserName) {
+				reversal.Amount = -charge.Amount
+			}
+			if charge.Amount != 0 {
+				postings = append(postings, Posting{Account: charge.Account, Amount: -charge.Amount})
+			}
+		}
+		if len(postings) > 0 {
+			txID, err := Post(tx, nil, ReasonRefund, reference, postings...)
+			if err != nil {
+				return err
+			}
+			reversal.LedgerTxID = &txID
+		}
+		if err := tx.Create(&reversal).Error; err != nil {
+			return err
+		}
+		return tx.Model(&purchase).Updates(map[string]interface{}{
+			"refunded_at": time.Now(),
+			"refund_id":   reversal.ID,
+		}).Error
+	})
+	return reversal, err
+}
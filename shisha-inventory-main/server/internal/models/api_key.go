@@ -0,0 +1,112 @@
+// internal/models/api_key.go
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+const (
+	ScopeUpload       = "upload"
+	ScopeTransfer     = "transfer"
+	ScopeTransferRead = "transfer:read"
+	ScopePurchase     = "purchase"
+	ScopeBalance      = "balance"
+)
+
+// APIKeyPrefix starts every key so they are easy to tell apart from JWTs and
+// to find in leaked text.
+const APIKeyPrefix = "shk_"
+
+// APIKey lets scripts authenticate as a user with a limited set of scopes.
+// Keys look like shk_<prefix>_<secret>; only the prefix and a SHA-256 hash of
+// the full key are stored.
+type APIKey struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	UserID     uint       `gorm:"not null;index" json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `gorm:"not null;unique_index" json:"prefix"`
+	KeyHash    string     `gorm:"not null" json:"-"`
+	Scopes     string     `gorm:"not null" json:"-"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func ValidScope(scope string) bool {
+	switch scope {
+	case ScopeUpload, ScopeTransfer, ScopeTransferRead, ScopePurchase, ScopeBalance:
+		return true
+	}
+	return false
+}
+
+// NewAPIKey generates a key for the user and returns it together with the
+// record to store. The key itself cannot be recovered later.
+func NewAPIKey(userID uint, name string, scopes []string, expiresAt *time.Time) (string, APIKey, error) {
+	prefix := make([]byte, 6)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(prefix); err != nil {
+		return "", APIKey{}, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", APIKey{}, err
+	}
+
+	apiKey := APIKey{
+		UserID:    userID,
+		Name:      name,
+		Prefix:    hex.EncodeToString(prefix),
+		Scopes:    strings.Join(scopes, " "),
+		ExpiresAt: expiresAt,
+	}
+	key := APIKeyPrefix + apiKey.Prefix + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	apiKey.KeyHash = HashAPIKey(key)
+	return key, apiKey, nil
+}
+
+// ParseAPIKey returns the lookup prefix of a key, or false if key is not
+// shaped like an API key.
+func ParseAPIKey(key string) (string, bool) {
+	if !strings.HasPrefix(key, APIKeyPrefix) {
+		return "", false
+	}
+	prefix, secret, found := strings.Cut(strings.TrimPrefix(key, APIKeyPrefix), "_")
+	if !found || prefix == "" || secret == "" {
+		return "", false
+	}
+	return prefix, true
+}
+
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (k *APIKey) Check(key string) bool {
+	return subtle.ConstantTimeCompare([]byte(k.KeyHash), []byte(HashAPIKey(key))) == 1
+}
+
+// Active reports whether the key is neither revoked nor expired at now.
+func (k *APIKey) Active(now time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
+
+func (k *APIKey) ScopeList() []string {
+	return strings.Fields(k.Scopes)
+}
+
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.ScopeList() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+// internal/models/coin_request.go
+package models
+
+import (
+	"time"
+)
+
+const (
+	CoinRequestPending  = "pending"
+	CoinRequestAccepted = "accepted"
+	CoinRequestDeclined = "declined"
+	CoinRequestExpired  = "expired"
+)
+
+// CoinRequest asks Payer to send Amount coins to Requester. Once accepted the
+// payment is recorded as the transfer TransferID.
+type CoinRequest struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	Requester   string     `gorm:"not null;index" json:"requester"`
+	Payer       string     `gorm:"not null;index" json:"payer"`
+	Amount      int        `gorm:"not null" json:"amount"`
+	Note        string     `json:"note"`
+	Status      string     `gorm:"not null;default:'pending';index" json:"status"`
+	TransferID  *uint      `json:"transfer_id,omitempty"`
+	ExpiresAt   time.Time  `gorm:"not null" json:"expires_at"`
+	RespondedAt *time.Time `json:"responded_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// Overdue reports whether the request is still pending past its expiry.
+func (r CoinRequest) Overdue(now time.Time) bool {
+	return r.Status == CoinRequestPending && !now.Before(r.ExpiresAt)
+}
@@ -0,0 +1,20 @@
+// internal/models/daily_reward.go
+package models
+
+import (
+	"time"
+)
+
+// DailyReward is a claimed daily bonus. Day is the calendar day of the claim,
+// YYYY-MM-DD in the configured reward timezone, and Streak the number of
+// consecutive days claimed up to it. LedgerTxID is NULL until the payout is
+// posted.
+type DailyReward struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	Username   string    `gorm:"not null;unique_index:idx_daily_rewards_user_day" json:"username"`
+	Day        string    `gorm:"not null;size:10;unique_index:idx_daily_rewards_user_day" json:"day"`
+	Streak     int       `gorm:"not null" json:"streak"`
+	Amount     int       `gorm:"not null" json:"amount"`
+	LedgerTxID *string   `gorm:"type:uuid" json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+}
@@ -0,0 +1,57 @@
+// internal/models/economy.go
+package models
+
+import (
+	"time"
+)
+
+// EconomyPolicy is one version of the coin amounts the platform pays and
+// charges. Versions are never updated, a change inserts a new one and the
+// latest is in force.
+type EconomyPolicy struct {
+	ID           uint `gorm:"primaryKey" json:"version"`
+	SignupBonus  int  `gorm:"not null" json:"signup_bonus" yaml:"signup_bonus"`
+	UploadReward int  `gorm:"not null" json:"upload_reward" yaml:"upload_reward"`
+	PremiumPrice int  `gorm:"not null" json:"premium_price" yaml:"premium_price"`
+	// DailyReward is paid for the first day of a streak and grows by
+	// DailyRewardStep every consecutive day, up to DailyRewardMax. A zero
+	// DailyReward disables daily rewards.
+	DailyReward     int `gorm:"not null;default:0" json:"daily_reward" yaml:"daily_reward"`
+	DailyRewardStep int `gorm:"not null;default:0" json:"daily_reward_step" yaml:"daily_reward_step"`
+	DailyRewardMax  int `gorm:"not null;default:0" json:"daily_reward_max" yaml:"daily_reward_max"`
+	// ReferralBonus is paid to the inviter and InviteeBonus to the invited user
+	// once the invitee has made a first upload
+	ReferralBonus int `gorm:"not null;default:0" json:"referral_bonus" yaml:"referral_bonus"`
+	InviteeBonus  int `gorm:"not null;default:0" json:"invitee_bonus" yaml:"invitee_bonus"`
+	// MarketplaceCommission is the percentage of a marketplace sale the
+	// platform keeps, the seller is credited the rest
+	MarketplaceCommission int       `gorm:"not null;default:0" json:"marketplace_commission" yaml:"marketplace_commission"`
+	ChangedBy             string    `gorm:"not null" json:"changed_by" yaml:"-"`
+	Comment               string    `json:"comment,omitempty" yaml:"-"`
+	CreatedAt             time.Time `json:"created_at" yaml:"-"`
+}
+
+// Commission returns the platform's share of a marketplace sale at price,
+// rounded down.
+func (p EconomyPolicy) Commission(price int) int {
+	return price * p.MarketplaceCommission / 100
+}
+
+// DailyRewardFor returns what the given day of a streak pays, counting from 1.
+func (p EconomyPolicy) DailyRewardFor(streak int) int {
+	amount := p.DailyReward + p.DailyRewardStep*(streak-1)
+	if p.DailyRewardMax > 0 && amount > p.DailyRewardMax {
+		return p.DailyRewardMax
+	}
+	return amount
+}
+
+// Version returns the version ledger entries paying amounts of p refer to,
+// nil for the Default policy that was never stored.
+func (p EconomyPolicy) Version() *uint {
+	if p.ID == 0 {
+		return nil
+	}
+	version := p.ID
+	return &version
+}
@@ -12,7 +12,9 @@ type Image struct {
 	UploadedAt time.Time `json:"uploaded_at"`
 	Hash       string    `json:"hash"`
 	Username   string    `json:"username"`
-	CreatedAt  time.Time
+	// Reward is what the uploader was paid for the image
+	Reward    int `json:"-" gorm:"not null;default:0"`
+	CreatedAt time.Time
 }
 
 type PremiumImage struct {
@@ -21,16 +23,28 @@ type PremiumImage struct {
 	Name       string    `json:"name"`
 	UploadedAt time.Time `json:"uploaded_at"`
 	Hash       string    `json:"hash"`
-	Price      int       `json:"price" gorm:"default:25"`
+	Price      int       `json:"price" gorm:"not null"`
 	CreatedAt  time.Time
 }
 
+// Purchase grants UserName an image. A refunded purchase is kept but no
+// longer grants it, see database.MigratePurchases for the matching index.
+// Premium images are bought from the shop and have no Seller, marketplace
+// purchases refer to an uploaded Image and the Listing it was bought from.
+// The buyer paid Price, of which the shop kept Commission and the seller the
+// rest.
 type Purchase struct {
-	ID        uint   `gorm:"primaryKey"`
-	UserName  string `gorm:"not null"`
-	ImageID   uint   `gorm:"not null"`
-	ImageUUID string `gorm:"type:uuid;default:uuid_generate_v4()" json:"imageuuid"`
-	ImageName string `json:"imagename"`
-	Hash      string `json:"hash"`
-	CreatedAt time.Time
+	ID         uint       `gorm:"primaryKey"`
+	UserName   string     `gorm:"not null;index"`
+	ImageID    uint       `gorm:"not null"`
+	Seller     string     `gorm:"not null;default:''" json:"seller,omitempty"`
+	ListingID  *uint      `json:"listing_id,omitempty"`
+	Price      int        `gorm:"not null;default:0" json:"price"`
+	Commission int        `gorm:"not null;default:0" json:"commission,omitempty"`
+	ImageUUID  string     `gorm:"type:uuid;default:uuid_generate_v4()" json:"imageuuid"`
+	ImageName  string     `json:"imagename"`
+	Hash       string     `json:"hash"`
+	RefundedAt *time.Time `json:"refunded_at,omitempty"`
+	RefundID   *uint      `json:"refund_id,omitempty"`
+	CreatedAt  time.Time
 }
@@ -0,0 +1,34 @@
+// internal/models/ledger.go
+package models
+
+import (
+	"time"
+)
+
+// LedgerEntry is one side of a coin movement. Entries sharing a TxID always
+// sum to zero and are never updated or deleted.
+type LedgerEntry struct {
+	ID        uint   `gorm:"primaryKey" json:"id"`
+	TxID      string `gorm:"type:uuid;not null;index" json:"tx_id"`
+	Account   string `gorm:"not null;index" json:"account"`
+	Amount    int    `gorm:"not null" json:"amount"`
+	Reason    string `gorm:"not null" json:"reason"`
+	Reference string `json:"reference"`
+	// PolicyVersion is the economy policy the amounts were taken from, nil for
+	// movements no policy sets such as transfers
+	PolicyVersion *uint     `json:"policy_version,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// BalanceCorrection records a user whose cached balance and ledger account
+// were reset to the balance expected from their activity by the reconcile
+// command.
+type BalanceCorrection struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Username  string    `gorm:"not null;index" json:"username"`
+	Coins     int       `gorm:"not null" json:"coins"`
+	Ledger    int       `gorm:"not null" json:"ledger"`
+	Expected  int       `gorm:"not null" json:"expected"`
+	Operator  string    `gorm:"not null" json:"operator"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,27 @@
+// internal/models/listing.go
+package models
+
+import (
+	"time"
+)
+
+// Listing states. Withdrawn is final, the image can be listed again with a new
+// listing.
+const (
+	ListingActive    = "active"
+	ListingPaused    = "paused"
+	ListingWithdrawn = "withdrawn"
+)
+
+// Listing offers an uploaded image for sale by its uploader on the
+// marketplace. Only active listings can be bought, and an image has at most
+// one listing that is not withdrawn, see database.MigrateListings.
+type Listing struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	ImageID   uint      `gorm:"not null" json:"image_id"`
+	Seller    string    `gorm:"not null;index" json:"seller"`
+	Price     int       `gorm:"not null" json:"price"`
+	Status    string    `gorm:"not null" json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
@@ -19,3 +19,70 @@ type BuyMessage struct {
 	Image_uuid string `json:"image_uuid"`
 	Amount     int    `json:"amount"`
 }
+
+type LockoutMessage struct {
+	User           string `json:"user"`
+	Type           string `json:"type" default:"lockout"`
+	IP             string `json:"ip"`
+	Scope          string `json:"scope"`
+	Failures       int    `json:"failures"`
+	LockoutSeconds int    `json:"lockout_seconds"`
+}
+
+type CoinRequestMessage struct {
+	User      string `json:"user"`
+	Type      string `json:"type" default:"coin_request"`
+	Target    string `json:"target"`
+	RequestID uint   `json:"request_id"`
+	Amount    int    `json:"amount"`
+	Status    string `json:"status"`
+}
+
+type RuleDecisionMessage struct {
+	User   string `json:"user"`
+	Type   string `json:"type" default:"rule_decision"`
+	Kind   string `json:"kind"`
+	Target string `json:"target,omitempty"`
+	Amount int    `json:"amount"`
+	Action string `json:"action"`
+	Rule   string `json:"rule,omitempty"`
+}
+
+type ReversalMessage struct {
+	User       string `json:"user"`
+	Type       string `json:"type" default:"reversal"`
+	Target     string `json:"target"`
+	Amount     int    `json:"amount"`
+	TransferID uint   `json:"transfer_id"`
+}
+
+type RefundMessage struct {
+	User       string `json:"user"`
+	Type       string `json:"type" default:"refund"`
+	Image_uuid string `json:"image_uuid"`
+	Amount     int    `json:"amount"`
+}
+
+type RewardMessage struct {
+	User   string `json:"user"`
+	Type   string `json:"type" default:"reward"`
+	Amount int    `json:"amount"`
+	Streak int    `json:"streak"`
+	Day    string `json:"day"`
+}
+
+type TopUpMessage struct {
+	User   string `json:"user"`
+	Type   string `json:"type" default:"top_up"`
+	Amount int    `json:"amount"`
+}
+
+type SaleMessage struct {
+	User       string `json:"user"`
+	Type       string `json:"type" default:"sale"`
+	Seller     string `json:"seller"`
+	Image_uuid string `json:"image_uuid"`
+	ListingID  uint   `json:"listing_id"`
+	Amount     int    `json:"amount"`
+	Commission int    `json:"commission"`
+}
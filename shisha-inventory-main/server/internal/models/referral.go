@@ -0,0 +1,42 @@
+// internal/models/referral.go
+package models
+
+import (
+	"time"
+)
+
+// Referral states
+const (
+	// ReferralPending waits for the invitee's first upload
+	ReferralPending = "pending"
+	// ReferralRewarded has paid both bonuses
+	ReferralRewarded = "rewarded"
+	// ReferralRejected tripped an abuse guard and never pays
+	ReferralRejected = "rejected"
+)
+
+// InviteCode lets new users register as invited by Owner. A code can be used
+// any number of times until it is revoked.
+type InviteCode struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	Code      string     `gorm:"not null;unique_index" json:"code"`
+	Owner     string     `gorm:"not null;index" json:"owner"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Referral links an invitee to the inviter whose code they registered with.
+// IP is where the invitee registered from.
+type Referral struct {
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	Inviter      string     `gorm:"not null;index" json:"inviter"`
+	Invitee      string     `gorm:"not null;unique_index" json:"invitee"`
+	Code         string     `gorm:"not null" json:"code"`
+	Status       string     `gorm:"not null;index" json:"status"`
+	RejectReason string     `json:"reject_reason,omitempty"`
+	IP           string     `gorm:"index" json:"-"`
+	InviterBonus int        `json:"inviter_bonus"`
+	InviteeBonus int        `json:"invitee_bonus"`
+	RewardedAt   *time.Time `json:"rewarded_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
@@ -0,0 +1,29 @@
+// internal/models/reversal.go
+package models
+
+import (
+	"time"
+)
+
+const (
+	ReversalTransfer = "transfer"
+	ReversalPurchase = "purchase"
+)
+
+// Reversal undoes a transfer or refunds a purchase with a compensating ledger
+// transaction. The original record is kept and points back to it. Username
+// receives Amount coins back from Counterparty. LedgerTxID is NULL when there
+// was nothing to pay back, for purchases made before the ledger.
+type Reversal struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	Kind         string    `gorm:"not null" json:"kind"`
+	TransferID   *uint     `gorm:"unique_index" json:"transfer_id,omitempty"`
+	PurchaseID   *uint     `gorm:"unique_index" json:"purchase_id,omitempty"`
+	Username     string    `gorm:"not null;index" json:"username"`
+	Counterparty string    `gorm:"not null" json:"counterparty"`
+	Amount       int       `gorm:"not null" json:"amount"`
+	Reason       string    `json:"reason"`
+	Admin        string    `gorm:"not null" json:"admin"`
+	LedgerTxID   *string   `gorm:"type:uuid" json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+}
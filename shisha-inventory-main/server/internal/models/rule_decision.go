@@ -0,0 +1,33 @@
+// internal/models/rule_decision.go
+package models
+
+import (
+	"time"
+)
+
+// Review states of an operation held by a rule
+const (
+	ReviewPending  = "pending"
+	ReviewApproved = "approved"
+	ReviewRejected = "rejected"
+	// ReviewUsed marks an approval the user's retry has gone through with
+	ReviewUsed = "used"
+)
+
+// RuleDecision records an operation a rule denied or held. Held operations
+// wait for an admin; once approved the user's next identical attempt goes
+// through.
+type RuleDecision struct {
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	Kind         string     `gorm:"not null" json:"kind"`
+	Username     string     `gorm:"not null;index" json:"username"`
+	Counterparty string     `json:"counterparty,omitempty"`
+	Amount       int        `gorm:"not null" json:"amount"`
+	Action       string     `gorm:"not null" json:"action"`
+	Rule         string     `json:"rule"`
+	Reason       string     `json:"reason"`
+	Review       string     `gorm:"index" json:"review,omitempty"`
+	ReviewedBy   string     `json:"reviewed_by,omitempty"`
+	ReviewedAt   *time.Time `json:"reviewed_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
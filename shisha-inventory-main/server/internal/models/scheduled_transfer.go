@@ -0,0 +1,50 @@
+// internal/models/scheduled_transfer.go
+package models
+
+import (
+	"time"
+)
+
+const (
+	ScheduledTransferActive    = "active"
+	ScheduledTransferCompleted = "completed"
+	ScheduledTransferCancelled = "cancelled"
+)
+
+const (
+	ScheduledRunSucceeded = "succeeded"
+	ScheduledRunFailed    = "failed"
+)
+
+// ScheduledTransfer pays Amount coins from FromUser to ToUser once or on a
+// recurrence, see the schedule package. Runs keep the wall clock time of
+// StartAt in TimeZone, an IANA zone name. NextRunAt is nil once no run is
+// left.
+type ScheduledTransfer struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	FromUser   string     `gorm:"not null;index" json:"from"`
+	ToUser     string     `gorm:"not null" json:"to"`
+	Amount     int        `gorm:"not null" json:"amount"`
+	Memo       string     `json:"memo"`
+	Recurrence string     `gorm:"not null" json:"recurrence"`
+	Cron       string     `json:"cron,omitempty"`
+	StartAt    time.Time  `gorm:"not null" json:"start_at"`
+	TimeZone   string     `gorm:"not null;default:'UTC'" json:"time_zone"`
+	NextRunAt  *time.Time `gorm:"index" json:"next_run_at"`
+	LastRunAt  *time.Time `json:"last_run_at"`
+	Status     string     `gorm:"not null;default:'active'" json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// ScheduledTransferRun is one execution of a scheduled transfer. Failed runs
+// keep the reason in Error and have no transfer.
+type ScheduledTransferRun struct {
+	ID                  uint      `gorm:"primaryKey" json:"id"`
+	ScheduledTransferID uint      `gorm:"not null;unique_index:idx_scheduled_runs_slot" json:"-"`
+	ScheduledFor        time.Time `gorm:"not null;unique_index:idx_scheduled_runs_slot" json:"scheduled_for"`
+	Status              string    `gorm:"not null" json:"status"`
+	Error               string    `json:"error,omitempty"`
+	TransferID          *uint     `json:"transfer_id,omitempty"`
+	CreatedAt           time.Time `json:"created_at"`
+}
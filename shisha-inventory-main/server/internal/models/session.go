@@ -0,0 +1,23 @@
+// internal/models/session.go
+package models
+
+import (
+	"time"
+)
+
+// Session is a login on one device. Every token issued for the login carries
+// the session ID, so revoking the session invalidates them all.
+type Session struct {
+	ID         string     `gorm:"primaryKey;type:uuid" json:"id"`
+	UserID     uint       `gorm:"not null;index" json:"-"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"-"`
+}
+
+func (s *Session) Active(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
@@ -0,0 +1,33 @@
+// internal/models/topup.go
+package models
+
+import (
+	"time"
+)
+
+// Top-up states
+const (
+	TopUpPending   = "pending"
+	TopUpSucceeded = "succeeded"
+	TopUpFailed    = "failed"
+)
+
+// TopUp is a purchase of Coins paid through a payment provider. It is
+// credited when the provider's webhook reports the payment succeeded. A failed
+// attempt can still be followed by a successful retry, so only succeeded is
+// final. EventID is the last webhook applied and LedgerTxID is NULL until the
+// coins are credited.
+type TopUp struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	Username    string     `gorm:"not null;index" json:"username"`
+	Coins       int        `gorm:"not null" json:"coins"`
+	Price       int        `gorm:"not null" json:"price"`
+	Currency    string     `gorm:"not null" json:"currency"`
+	Provider    string     `gorm:"not null;unique_index:idx_top_ups_provider_intent" json:"provider"`
+	IntentID    string     `gorm:"not null;unique_index:idx_top_ups_provider_intent" json:"-"`
+	Status      string     `gorm:"not null" json:"status"`
+	EventID     string     `json:"-"`
+	LedgerTxID  *string    `gorm:"type:uuid" json:"-"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
@@ -0,0 +1,20 @@
+// internal/models/transfer.go
+package models
+
+import (
+	"time"
+)
+
+// Transfer is a payment from one user to another. Its coins move through the
+// ledger transaction LedgerTxID, NULL until the move is posted. ReversalID is
+// set once an admin reversed it.
+type Transfer struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	FromUser   string    `gorm:"not null;index" json:"from"`
+	ToUser     string    `gorm:"not null;index" json:"to"`
+	Amount     int       `gorm:"not null" json:"amount"`
+	Memo       string    `json:"memo"`
+	LedgerTxID *string   `gorm:"type:uuid" json:"-"`
+	ReversalID *uint     `json:"reversal_id,omitempty"`
+	CreatedAt  time.Time `gorm:"index" json:"created_at"`
+}
@@ -2,15 +2,33 @@
 package models
 
 import (
+	"time"
+
 	"github.com/jinzhu/gorm"
 	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
 type User struct {
 	gorm.Model
 	Username string `json:"username" gorm:"unique"`
 	Password string `json:"password"`
-	Coins    int    `json:"coins" gorm:"default:100"`
+	Email    string `json:"email"`
+	// Coins caches the balance of the user's ledger account
+	Coins int    `json:"coins" gorm:"not null;default:0"`
+	Role  string `json:"role" gorm:"not null;default:'user'"`
+	// SignupBonus is what the user was paid on registration
+	SignupBonus int `json:"-" gorm:"not null;default:0"`
+	// TokenVersion is bumped to invalidate every token issued to the user
+	TokenVersion int `json:"-" gorm:"not null;default:0"`
+	// TOTPSecret is set on enrollment, TOTPEnabled once a code confirmed it
+	TOTPSecret  string `json:"-"`
+	TOTPEnabled bool   `json:"-" gorm:"not null;default:false"`
 }
 
 func (user *User) HashPassword() error {
@@ -26,3 +44,26 @@ func (user *User) CheckPassword(password string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
 	return err == nil
 }
+
+func ValidRole(role string) bool {
+	return role == RoleUser || role == RoleModerator || role == RoleAdmin
+}
+
+func (user *User) HasRole(roles ...string) bool {
+	for _, role := range roles {
+		if user.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// PasswordResetToken stores the SHA-256 hash of a single-use reset token.
+type PasswordResetToken struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"not null;index"`
+	TokenHash string    `gorm:"not null;unique_index"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
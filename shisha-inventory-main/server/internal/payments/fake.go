@@ -0,0 +1,166 @@
+// internal/payments/fake.go
+package payments
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// FakeSignatureHeader carries "t=<unix time>,v1=<hex HMAC-SHA256>" of
+	// "<unix time>.<body>"
+	FakeSignatureHeader = "X-Fake-Signature"
+	// fakeTolerance bounds the age of a webhook, so captured ones cannot be
+	// replayed later
+	fakeTolerance = 5 * time.Minute
+)
+
+type fakeWebhook struct {
+	ID       string `json:"id"`
+	IntentID string `json:"intent_id"`
+	Status   string `json:"status"`
+}
+
+// FakeProvider is a local payment provider for development and tests. Users
+// are redirected to CheckoutURL, where Pay completes the payment and delivers
+// a signed webhook to WebhookURL like a real provider would. Intents are kept
+// in memory, so it only works on a single replica.
+type FakeProvider struct {
+	Secret      []byte
+	CheckoutURL string
+	WebhookURL  string
+	Client      *http.Client
+	// Now is the clock, time.Now unless a test sets it
+	Now func() time.Time
+
+	mu      sync.Mutex
+	intents map[string]int
+}
+
+func NewFakeProvider(secret, checkoutURL, webhookURL string) *FakeProvider {
+	return &FakeProvider{
+		Secret:      []byte(secret),
+		CheckoutURL: checkoutURL,
+		WebhookURL:  webhookURL,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		Now:         time.Now,
+		intents:     map[string]int{},
+	}
+}
+
+func (p *FakeProvider) Name() string {
+	return "fake"
+}
+
+func randomID(prefix string) (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(b), nil
+}
+
+func (p *FakeProvider) CreateIntent(ctx context.Context, amount int, currency, reference string) (Intent, error) {
+	id, err := randomID("pi_")
+	if err != nil {
+		return Intent{}, err
+	}
+	p.mu.Lock()
+	p.intents[id] = amount
+	p.mu.Unlock()
+	return Intent{ID: id, RedirectURL: strings.TrimRight(p.CheckoutURL, "/") + "/" + id}, nil
+}
+
+func (p *FakeProvider) sign(timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, p.Secret)
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Webhook builds the signed webhook the provider sends about intentID, as
+// body and signature header value.
+func (p *FakeProvider) Webhook(intentID, status string) ([]byte, string, error) {
+	id, err := randomID("evt_")
+	if err != nil {
+		return nil, "", err
+	}
+	body, err := json.Marshal(fakeWebhook{ID: id, IntentID: intentID, Status: status})
+	if err != nil {
+		return nil, "", err
+	}
+	timestamp := p.Now().Unix()
+	return body, fmt.Sprintf("t=%d,v1=%s", timestamp, p.sign(timestamp, body)), nil
+}
+
+func (p *FakeProvider) ParseWebhook(body []byte, header func(string) string) (Event, error) {
+	var timestamp int64
+	var signature string
+	for _, part := range strings.Split(header(FakeSignatureHeader), ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			timestamp, _ = strconv.ParseInt(value, 10, 64)
+		case "v1":
+			signature = value
+		}
+	}
+	age := p.Now().Sub(time.Unix(timestamp, 0))
+	if timestamp == 0 || age > fakeTolerance || age < -fakeTolerance {
+		return Event{}, ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(signature), []byte(p.sign(timestamp, body))) {
+		return Event{}, ErrInvalidSignature
+	}
+
+	var webhook fakeWebhook
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		return Event{}, err
+	}
+	if webhook.Status != StatusSucceeded && webhook.Status != StatusFailed {
+		return Event{}, fmt.Errorf("unknown payment status %q", webhook.Status)
+	}
+	return Event{ID: webhook.ID, IntentID: webhook.IntentID, Status: webhook.Status}, nil
+}
+
+// Pay completes an intent and delivers the webhook. The user always pays.
+func (p *FakeProvider) Pay(ctx context.Context, intentID string) error {
+	p.mu.Lock()
+	_, ok := p.intents[intentID]
+	delete(p.intents, intentID)
+	p.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown payment intent %s", intentID)
+	}
+
+	body, signature, err := p.Webhook(intentID, StatusSucceeded)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(FakeSignatureHeader, signature)
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+// internal/payments/payments.go
+package payments
+
+import (
+	"context"
+	"errors"
+)
+
+// Statuses a payment ends in
+const (
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// Intent is a payment the provider waits for the user to make.
+type Intent struct {
+	ID          string
+	RedirectURL string
+}
+
+// Event is a verified webhook notification about an intent. ID identifies the
+// delivery, providers send the same event again until it is acknowledged.
+type Event struct {
+	ID       string
+	IntentID string
+	Status   string
+}
+
+// PaymentProvider takes payments for coin top-ups. Implementations only talk
+// to the provider, crediting coins is left to the caller.
+type PaymentProvider interface {
+	Name() string
+	// CreateIntent starts a payment of amount in the smallest currency unit.
+	// reference is ours and comes back with the payment.
+	CreateIntent(ctx context.Context, amount int, currency, reference string) (Intent, error)
+	// ParseWebhook verifies a webhook and returns its event, or
+	// ErrInvalidSignature. header returns the request header of a name.
+	ParseWebhook(body []byte, header func(string) string) (Event, error)
+}
@@ -0,0 +1,305 @@
+// internal/rules/rules.go
+package rules
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"server/internal/ledger"
+	"server/internal/models"
+
+	"github.com/jinzhu/gorm"
+	"gopkg.in/yaml.v3"
+)
+
+// Operations rules apply to
+const (
+	KindTransfer = "transfer"
+	KindPurchase = "purchase"
+)
+
+type Action string
+
+const (
+	Allow Action = "allow"
+	Deny  Action = "deny"
+	Hold  Action = "hold"
+)
+
+// Rule types
+const (
+	// MaxAmount limits a single operation to Max coins
+	MaxAmount = "max_amount"
+	// OutgoingLimit limits the coins spent within Window to Max
+	OutgoingLimit = "outgoing_limit"
+	// MinAccountAge requires the account to be MinAge old
+	MinAccountAge = "min_account_age"
+	// Velocity limits the operations within Window to Max
+	Velocity = "velocity"
+	// Circular catches transfers that close a loop of at most Depth
+	// accounts, paid within Window, back to the sender
+	Circular = "circular"
+)
+
+const (
+	defaultWindow = 24 * time.Hour
+	defaultDepth  = 3
+	// maxCircularFanout bounds the accounts visited looking for a loop
+	maxCircularFanout = 1000
+)
+
+// Rule is one entry of the rules file. Action is what happens when the rule
+// matches, deny unless set to hold. Applies lists the operation kinds the rule
+// is checked for, all of them when empty.
+type Rule struct {
+	Name    string        `yaml:"name"`
+	Type    string        `yaml:"type"`
+	Action  Action        `yaml:"action"`
+	Applies []string      `yaml:"applies"`
+	Max     int           `yaml:"max"`
+	MinAge  time.Duration `yaml:"min_age"`
+	Window  time.Duration `yaml:"window"`
+	Depth   int           `yaml:"depth"`
+}
+
+// Operation is a payment about to be made by User.
+type Operation struct {
+	Kind         string
+	User         models.User
+	Counterparty string
+	Amount       int
+}
+
+// Decision is the outcome of evaluating the rules. Rule and Reason name the
+// rule that matched unless the operation is allowed.
+type Decision struct {
+	Action Action
+	Rule   string
+	Reason string
+}
+
+// Engine evaluates a set of rules. A nil Engine allows everything.
+type Engine struct {
+	rules []Rule
+}
+
+// Load reads a YAML rules file:
+//
+//	rules:
+//	  - name: big-transfers
+//	    type: max_amount
+//	    applies: [transfer]
+//	    max: 500
+//	  - name: new-accounts
+//	    type: min_account_age
+//	    min_age: 24h
+//	    action: hold
+func Load(path string) (*Engine, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	engine, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return engine, nil
+}
+
+func Parse(data []byte) (*Engine, error) {
+	var file struct {
+		Rules []Rule `yaml:"rules"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	for i := range file.Rules {
+		if err := file.Rules[i].validate(); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+	return &Engine{rules: file.Rules}, nil
+}
+
+func (r *Rule) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	switch r.Action {
+	case "":
+		r.Action = Deny
+	case Deny, Hold:
+	default:
+		return fmt.Errorf("%s: action must be deny or hold", r.Name)
+	}
+	for _, kind := range r.Applies {
+		if kind != KindTransfer && kind != KindPurchase {
+			return fmt.Errorf("%s: unknown operation %q", r.Name, kind)
+		}
+	}
+	if r.Window == 0 {
+		r.Window = defaultWindow
+	}
+	if r.Window < 0 {
+		return fmt.Errorf("%s: window must be positive", r.Name)
+	}
+
+	switch r.Type {
+	case MaxAmount, OutgoingLimit, Velocity:
+		if r.Max <= 0 {
+			return fmt.Errorf("%s: max must be greater than zero", r.Name)
+		}
+	case MinAccountAge:
+		if r.MinAge <= 0 {
+			return fmt.Errorf("%s: min_age must be positive", r.Name)
+		}
+	case Circular:
+		if r.Depth == 0 {
+			r.Depth = defaultDepth
+		}
+		if r.Depth < 2 {
+			return fmt.Errorf("%s: depth must be at least 2", r.Name)
+		}
+	default:
+		return fmt.Errorf("%s: unknown type %q", r.Name, r.Type)
+	}
+	return nil
+}
+
+func (r *Rule) applies(kind string) bool {
+	if len(r.Applies) == 0 {
+		return true
+	}
+	for _, k := range r.Applies {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate checks op against every rule. A deny wins over a hold, which wins
+// over allowing the operation. db should be the transaction the operation is
+// made in, with the user row locked, so concurrent operations of a user are
+// counted one after the other.
+func (e *Engine) Evaluate(db *gorm.DB, op Operation, now time.Time) (Decision, error) {
+	decision := Decision{Action: Allow}
+	if e == nil {
+		return decision, nil
+	}
+	for i := range e.rules {
+		rule := &e.rules[i]
+		if !rule.applies(op.Kind) {
+			continue
+		}
+		reason, err := rule.match(db, op, now)
+		if err != nil {
+			return Decision{}, fmt.Errorf("rule %s: %w", rule.Name, err)
+		}
+		if reason == "" {
+			continue
+		}
+		if rule.Action == Deny {
+			return Decision{Action: Deny, Rule: rule.Name, Reason: reason}, nil
+		}
+		if decision.Action == Allow {
+			decision = Decision{Action: Hold, Rule: rule.Name, Reason: reason}
+		}
+	}
+	return decision, nil
+}
+
+// match returns why op breaks the rule, or an empty string.
+func (r *Rule) match(db *gorm.DB, op Operation, now time.Time) (string, error) {
+	switch r.Type {
+	case MaxAmount:
+		if op.Amount > r.Max {
+			return fmt.Sprintf("amount is above the limit of %d coins", r.Max), nil
+		}
+	case OutgoingLimit:
+		spent, err := r.outgoing(db, op, now, "COALESCE(SUM(-amount), 0)")
+		if err != nil {
+			return "", err
+		}
+		if spent+op.Amount > r.Max {
+			return fmt.Sprintf("limit of %d coins per %s reached", r.Max, r.Window), nil
+		}
+	case MinAccountAge:
+		if now.Sub(op.User.CreatedAt) < r.MinAge {
+			return fmt.Sprintf("account must be at least %s old", r.MinAge), nil
+		}
+	case Velocity:
+		count, err := r.outgoing(db, op, now, "COUNT(*)")
+		if err != nil {
+			return "", err
+		}
+		if count+1 > r.Max {
+			return fmt.Sprintf("limit of %d operations per %s reached", r.Max, r.Window), nil
+		}
+	case Circular:
+		if op.Kind != KindTransfer {
+			return "", nil
+		}
+		loop, err := r.closesLoop(db, op, now)
+		if err != nil {
+			return "", err
+		}
+		if loop {
+			return "transfer closes a loop of recent transfers", nil
+		}
+	}
+	return "", nil
+}
+
+// outgoing aggregates the user's payments within the window over the ledger,
+// restricted to the kinds the rule applies to.
+func (r *Rule) outgoing(db *gorm.DB, op Operation, now time.Time, aggregate string) (int, error) {
+	var reasons []string
+	for _, kind := range []string{KindTransfer, KindPurchase} {
+		if r.applies(kind) {
+			reasons = append(reasons, ledgerReason(kind))
+		}
+	}
+	var result struct{ Total int }
+	err := db.Model(&models.LedgerEntry{}).
+		Select(aggregate+" AS total").
+		Where("account = ? AND amount < 0 AND reason IN (?) AND created_at >= ?", ledger.UserAccount(op.User.Username), reasons, now.Add(-r.Window)).
+		Scan(&result).Error
+	return result.Total, err
+}
+
+// closesLoop follows the transfers made within the window from the recipient
+// onwards and reports whether they lead back to the sender in fewer than
+// Depth hops.
+func (r *Rule) closesLoop(db *gorm.DB, op Operation, now time.Time) (bool, error) {
+	seen := map[string]bool{op.Counterparty: true}
+	frontier := []string{op.Counterparty}
+	for hop := 1; hop < r.Depth && len(frontier) > 0; hop++ {
+		var next []string
+		err := db.Model(&models.Transfer{}).
+			Where("from_user IN (?) AND created_at >= ? AND reversal_id IS NULL", frontier, now.Add(-r.Window)).
+			Pluck("DISTINCT to_user", &next).Error
+		if err != nil {
+			return false, err
+		}
+		frontier = frontier[:0]
+		for _, username := range next {
+			if username == op.User.Username {
+				return true, nil
+			}
+			if !seen[username] && len(seen) < maxCircularFanout {
+				seen[username] = true
+				frontier = append(frontier, username)
+			}
+		}
+	}
+	return false, nil
+}
+
+func ledgerReason(kind string) string {
+	if kind == KindPurchase {
+		return ledger.ReasonPurchase
+	}
+	return ledger.ReasonTransfer
+}
@@ -0,0 +1,229 @@
+// internal/schedule/schedule.go
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	Once    = "once"
+	Daily   = "daily"
+	Weekly  = "weekly"
+	Monthly = "monthly"
+	Cron    = "cron"
+)
+
+// cronSearchLimit bounds the search for the next cron match, so expressions
+// that can never fire, like 0 0 30 2 *, do not loop forever.
+const cronSearchLimit = 5 * 366 * 24 * time.Hour
+
+var ErrUnknownRecurrence = errors.New("recurrence must be once, daily, weekly, monthly or cron")
+
+// Schedule yields the run times of a job.
+type Schedule interface {
+	// Next returns the first run strictly after t, or the zero time when
+	// there is none.
+	Next(t time.Time) time.Time
+}
+
+// Parse builds the schedule for a recurrence starting at start. Daily, weekly
+// and monthly runs keep the wall clock time of start in its location, cron
+// expressions are evaluated in UTC. Only a location loaded by name follows
+// daylight saving changes, not the fixed offset of a parsed or stored time.
+func Parse(recurrence, expr string, start time.Time) (Schedule, error) {
+	switch recurrence {
+	case Once:
+		return once(start), nil
+	case Daily:
+		return interval{start: start, days: 1}, nil
+	case Weekly:
+		return interval{start: start, days: 7}, nil
+	case Monthly:
+		return monthly(start), nil
+	case Cron:
+		cron, err := ParseCron(expr)
+		if err != nil {
+			return nil, err
+		}
+		return cron, nil
+	}
+	return nil, ErrUnknownRecurrence
+}
+
+type once time.Time
+
+func (o once) Next(t time.Time) time.Time {
+	if at := time.Time(o); at.After(t) {
+		return at
+	}
+	return time.Time{}
+}
+
+type interval struct {
+	start time.Time
+	days  int
+}
+
+func (i interval) Next(t time.Time) time.Time {
+	if i.start.After(t) {
+		return i.start
+	}
+	// Jump close to t, then step past it. AddDate keeps the wall clock time
+	// across daylight saving changes.
+	n := int(t.Sub(i.start).Hours()/24) / i.days
+	next := i.start.AddDate(0, 0, n*i.days)
+	for !next.After(t) {
+		n++
+		next = i.start.AddDate(0, 0, n*i.days)
+	}
+	return next
+}
+
+// monthly runs on the day of month of start, or on the last day of shorter
+// months.
+type monthly time.Time
+
+func (m monthly) Next(t time.Time) time.Time {
+	start := time.Time(m)
+	if start.After(t) {
+		return start
+	}
+	n := (t.Year()-start.Year())*12 + int(t.Month()-start.Month())
+	for {
+		next := addMonths(start, n)
+		if next.After(t) {
+			return next
+		}
+		n++
+	}
+}
+
+func addMonths(t time.Time, n int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(n), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	lastDay := first.AddDate(0, 1, -1).Day()
+	day := t.Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+// CronSchedule is a standard five field cron expression: minute, hour, day
+// of month, month and day of week. Fields take *, numbers, ranges a-b, lists
+// and steps /n. As in cron, a job whose day of month and day of week are both
+// restricted runs when either matches.
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	anyDom, anyDow                bool
+}
+
+func ParseCron(expr string) (*CronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields", expr)
+	}
+
+	var s CronSchedule
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("cron minute: %w", err)
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("cron hour: %w", err)
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("cron day of month: %w", err)
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("cron month: %w", err)
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("cron day of week: %w", err)
+	}
+	// 7 is Sunday as well
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.anyDom = strings.HasPrefix(fields[2], "*")
+	s.anyDow = strings.HasPrefix(fields[4], "*")
+	return &s, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			var err error
+			rangePart = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+
+		lo, hi := min, max
+		switch {
+		case rangePart == "*":
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(bounds[0])
+			hi, err2 = strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("invalid range %q", rangePart)
+			}
+		default:
+			v, err := strconv.Atoi(rangePart)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", rangePart)
+			}
+			lo = v
+			// a/n counts up from a to the end of the field
+			hi = v
+			if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(cronSearchLimit)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *CronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.anyDom || s.anyDow {
+		return dom && dow
+	}
+	return dom || dow
+}
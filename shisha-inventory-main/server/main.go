@@ -7,9 +7,16 @@ import (
 	"os"
 	"server/internal/controllers"
 	"server/internal/database"
+	"server/internal/economy"
 	"server/internal/initializers"
+	"server/internal/ledger"
 	"server/internal/models"
+	"server/internal/notify"
+	"server/internal/payments"
+	"server/internal/rules"
+	"strings"
 	"time"
+	_ "time/tzdata"
 
 	"github.com/gofiber/contrib/fiberzerolog"
 	"github.com/gofiber/fiber/v2"
@@ -32,16 +39,52 @@ func beforeAction(c *cli.Context) error {
 	s3Endpoint := c.String("s3-endpoint")
 	s3AccessKey := c.String("s3-access-key")
 	s3SecretKey := c.String("s3-secret-key")
+	if s3Endpoint == "" {
+		return cli.Exit(`Required flag "s3-endpoint" not set`, 1)
+	}
 	// DB
 	err := database.Connect(databaseURL)
 	if err != nil {
 		return err
 	}
-	err = database.Migrate(&models.User{}, &models.Image{}, &models.PremiumImage{}, &models.Purchase{})
+	err = database.Migrate(&models.User{}, &models.Image{}, &models.PremiumImage{}, &models.Purchase{}, &models.RecoveryCode{}, &models.PasswordResetToken{}, &models.APIKey{}, &models.Session{}, &models.Transfer{}, &models.CoinRequest{}, &models.ScheduledTransfer{}, &models.ScheduledTransferRun{}, &models.RuleDecision{}, &models.Reversal{}, &models.DailyReward{}, &models.InviteCode{}, &models.Referral{}, &models.TopUp{}, &models.Listing{})
 
 	if err != nil {
 		return err
 	}
+	err = database.MigratePurchases(database.DB)
+	if err != nil {
+		return err
+	}
+	err = database.MigrateListings(database.DB)
+	if err != nil {
+		return err
+	}
+	policy := economy.Default
+	if economyFile := c.String("economy-file"); economyFile != "" {
+		policy, err = economy.Load(economyFile)
+		if err != nil {
+			return err
+		}
+	}
+	err = economy.Migrate(database.DB, policy)
+	if err != nil {
+		return err
+	}
+	err = ledger.Migrate(database.DB)
+	if err != nil {
+		return err
+	}
+	err = economy.Seed(database.DB, policy)
+	if err != nil {
+		return err
+	}
+	if adminUsername := c.String("admin-username"); adminUsername != "" {
+		err = database.DB.Model(&models.User{}).Where("username = ?", adminUsername).Update("role", models.RoleAdmin).Error
+		if err != nil {
+			return err
+		}
+	}
 	// RedPanda
 
 	topic := c.String("redpanda-topic")
@@ -78,6 +121,10 @@ func beforeAction(c *cli.Context) error {
 }
 
 func mainAction(c *cli.Context) error {
+	// Not the app's Before, commands such as reconcile open only what they need
+	if err := beforeAction(c); err != nil {
+		return err
+	}
 	listenAddr := c.String("listen")
 	jwtKey := c.String("secret-key")
 
@@ -96,6 +143,7 @@ func mainAction(c *cli.Context) error {
 	// Back
 	router := fiber.New(fiber.Config{
 		DisableStartupMessage: true,
+		ProxyHeader:           c.String("proxy-header"),
 	})
 	logger := zerolog.New(os.Stderr).With().Timestamp().Logger()
 
@@ -114,16 +162,125 @@ func mainAction(c *cli.Context) error {
 		ReadinessEndpoint: "/ready",
 	}))
 
-	router.Post("/api/register", controllers.Register)
-	router.Post("/api/login", controllers.Login(jwtKey))
-	router.Post("/api/transfer", controllers.Tranfser(topic, brokers, Ctx))
-	router.Get("/api/balance", controllers.Balance)
-	router.Post("/api/upload", controllers.AuthRequired, uploadController.HandleUpload)
+	keys, err := initializers.LoadKeySet(c.String("jwt-signing-key"), c.StringSlice("jwt-verification-keys"))
+	if err != nil {
+		return err
+	}
+	tokenManager := controllers.NewTokenManager(initializers.Rdb, keys, jwtKey, c.Duration("access-token-ttl"), c.Duration("refresh-token-ttl"))
+	if legacyUntil := c.Timestamp("jwt-legacy-until"); legacyUntil != nil {
+		if err := tokenManager.AcceptLegacy(*legacyUntil); err != nil {
+			return err
+		}
+	}
+	authRequired := controllers.AuthRequired(tokenManager)
+	loginGuard := controllers.NewLoginGuard(initializers.Rdb, brokers, topic)
+	twoFactor := controllers.NewTwoFactor(initializers.Rdb, loginGuard, c.String("totp-issuer"), c.Int("transfer-2fa-threshold"))
+
+	var notifier notify.Notifier
+	switch c.String("notifier") {
+	case "smtp":
+		notifier = notify.NewSMTPNotifier(c.String("smtp-addr"), c.String("smtp-from"), c.String("smtp-username"), c.String("smtp-password"))
+	case "log":
+		notifier = notify.NewLogNotifier(c.String("notifier-file"))
+	default:
+		return fmt.Errorf("unknown notifier %q", c.String("notifier"))
+	}
+	idempotency := controllers.NewIdempotency(initializers.Rdb, c.Duration("idempotency-ttl"))
+	passwordReset := controllers.NewPasswordReset(notifier, c.Duration("password-reset-ttl"), c.String("password-reset-url"))
+	var ruleEngine *rules.Engine
+	if rulesFile := c.String("rules-file"); rulesFile != "" {
+		ruleEngine, err = rules.Load(rulesFile)
+		if err != nil {
+			return err
+		}
+	}
+	ruleGuard := controllers.NewRuleGuard(ruleEngine, brokers, topic)
+	coinRequests := controllers.NewCoinRequests(brokers, topic, twoFactor, ruleGuard, c.Duration("coin-request-ttl"))
+	go coinRequests.Run(Ctx, time.Minute)
+	rewardLocation, err := time.LoadLocation(c.String("reward-timezone"))
+	if err != nil {
+		return err
+	}
+	dailyRewards := controllers.NewDailyRewards(brokers, topic, rewardLocation)
+	referrals := controllers.NewReferrals(c.Int("referral-ip-limit"))
+	scheduledTransfers := controllers.NewScheduledTransfers(brokers, topic, twoFactor, ruleGuard)
+	if interval := c.Duration("scheduler-interval"); interval > 0 {
+		go scheduledTransfers.Run(Ctx, interval)
+	}
+	if interval := c.Duration("reconcile-interval"); interval > 0 {
+		go ledger.RunReconcile(Ctx, database.DB, interval)
+	}
+
+	switch c.String("payment-provider") {
+	case "":
+	case "fake":
+		publicURL := strings.TrimRight(c.String("public-url"), "/")
+		fake := payments.NewFakeProvider(c.String("payment-webhook-secret"), publicURL+"/api/topups/fake", publicURL+"/api/topups/webhook")
+		topUps := controllers.NewTopUps(fake, c.Int("coin-price"), c.String("payment-currency"), brokers, topic)
+		router.Post("/api/topups", authRequired, idempotency.Handler, topUps.Create)
+		router.Get("/api/topups", authRequired, topUps.List)
+		router.Post("/api/topups/webhook", topUps.Webhook)
+		router.Get("/api/topups/fake/:intent", controllers.FakeCheckout(fake))
+	default:
+		return fmt.Errorf("unknown payment provider %q", c.String("payment-provider"))
+	}
+
+	router.Post("/api/register", controllers.Register(referrals))
+	router.Post("/api/login", controllers.Login(tokenManager, loginGuard))
+	router.Post("/api/login/2fa", controllers.LoginTwoFactor(tokenManager, twoFactor))
+	router.Post("/api/2fa/enroll", authRequired, twoFactor.Enroll)
+	router.Post("/api/2fa/confirm", authRequired, twoFactor.Confirm)
+	router.Post("/api/2fa/disable", authRequired, twoFactor.Disable)
+	router.Post("/api/password/change", authRequired, controllers.ChangePassword(tokenManager))
+	router.Post("/api/password/reset/request", passwordReset.Request)
+	router.Post("/api/password/reset/confirm", passwordReset.Confirm)
+	router.Post("/api/token/refresh", controllers.RefreshToken(tokenManager))
+	router.Post("/api/logout", authRequired, controllers.Logout(tokenManager))
+	router.Post("/api/logout-all", authRequired, controllers.LogoutAll)
+	router.Get("/api/sessions", authRequired, controllers.ListSessions)
+	router.Delete("/api/sessions/:id", authRequired, controllers.RevokeSession)
+	router.Post("/api/keys", authRequired, controllers.CreateAPIKey)
+	router.Get("/api/keys", authRequired, controllers.ListAPIKeys)
+	router.Delete("/api/keys/:id", authRequired, controllers.RevokeAPIKey)
+	router.Get("/.well-known/jwks.json", controllers.JWKS(keys))
+	router.Put("/api/admin/users/:username/role", authRequired, controllers.RoleRequired(models.RoleAdmin), controllers.SetUserRole)
+	router.Get("/api/admin/rule-decisions", authRequired, controllers.RoleRequired(models.RoleAdmin), controllers.ListRuleDecisions)
+	router.Post("/api/admin/rule-decisions/:id/approve", authRequired, controllers.RoleRequired(models.RoleAdmin), controllers.ReviewRuleDecision(true))
+	router.Post("/api/admin/rule-decisions/:id/reject", authRequired, controllers.RoleRequired(models.RoleAdmin), controllers.ReviewRuleDecision(false))
+	router.Get("/api/admin/economy", authRequired, controllers.RoleRequired(models.RoleAdmin), controllers.EconomyPolicy)
+	router.Put("/api/admin/economy", authRequired, controllers.RoleRequired(models.RoleAdmin), controllers.UpdateEconomyPolicy)
+	router.Get("/api/admin/economy/history", authRequired, controllers.RoleRequired(models.RoleAdmin), controllers.EconomyPolicyHistory)
+	router.Post("/api/admin/transfers/:id/reverse", authRequired, controllers.RoleRequired(models.RoleAdmin), controllers.ReverseTransfer(topic, brokers))
+	router.Post("/api/admin/purchases/:id/refund", authRequired, controllers.RoleRequired(models.RoleAdmin), controllers.RefundPurchase(topic, brokers))
+	router.Post("/api/transfer", controllers.AuthRequired(tokenManager, models.ScopeTransfer), idempotency.Handler, controllers.Tranfser(topic, brokers, Ctx, twoFactor, ruleGuard))
+	router.Get("/api/transfers", controllers.AuthRequired(tokenManager, models.ScopeTransferRead), controllers.Transfers)
+	router.Get("/api/transfers/export", controllers.AuthRequired(tokenManager, models.ScopeTransferRead), controllers.ExportTransfers)
+	router.Post("/api/coin-requests", controllers.AuthRequired(tokenManager, models.ScopeTransfer), coinRequests.Create)
+	router.Get("/api/coin-requests", controllers.AuthRequired(tokenManager, models.ScopeTransferRead), coinRequests.List)
+	router.Post("/api/coin-requests/:id/accept", controllers.AuthRequired(tokenManager, models.ScopeTransfer), idempotency.Handler, coinRequests.Accept)
+	router.Post("/api/coin-requests/:id/decline", controllers.AuthRequired(tokenManager, models.ScopeTransfer), coinRequests.Decline)
+	router.Post("/api/scheduled-transfers", controllers.AuthRequired(tokenManager, models.ScopeTransfer), scheduledTransfers.Create)
+	router.Get("/api/scheduled-transfers", controllers.AuthRequired(tokenManager, models.ScopeTransferRead), scheduledTransfers.List)
+	router.Get("/api/scheduled-transfers/:id/runs", controllers.AuthRequired(tokenManager, models.ScopeTransferRead), scheduledTransfers.Runs)
+	router.Delete("/api/scheduled-transfers/:id", controllers.AuthRequired(tokenManager, models.ScopeTransfer), scheduledTransfers.Cancel)
+	router.Get("/api/balance", controllers.AuthRequired(tokenManager, models.ScopeBalance), controllers.Balance)
+	router.Get("/api/rewards/daily", controllers.AuthRequired(tokenManager, models.ScopeBalance), dailyRewards.Status)
+	router.Post("/api/rewards/daily", authRequired, idempotency.Handler, dailyRewards.Claim)
+	router.Get("/api/referrals", authRequired, referrals.List)
+	router.Post("/api/referrals/codes", authRequired, referrals.CreateCode)
+	router.Delete("/api/referrals/codes/:code", authRequired, referrals.RevokeCode)
+	router.Get("/api/ledger", controllers.AuthRequired(tokenManager, models.ScopeBalance), controllers.Ledger)
+	router.Post("/api/upload", controllers.AuthRequired(tokenManager, models.ScopeUpload), idempotency.Handler, uploadController.HandleUpload)
 	router.Get("/api/prem-images", imageController.GetPremiumImages)
 	router.Get("/api/user-images", imageController.GetUserImages)
-	router.Post("/api/purchase", imageController.PurchaseImage(topic, brokers))
-	router.Get("/api/purchased/:userName", imageController.GetPurchasedImages)
-	router.Get("/api/purchased/ids/:userName", imageController.GetPurchasedImageIDs)
+	router.Post("/api/purchase", controllers.AuthRequired(tokenManager, models.ScopePurchase), idempotency.Handler, imageController.PurchaseImage(topic, brokers, ruleGuard))
+	router.Get("/api/listings", controllers.Listings)
+	router.Get("/api/listings/mine", authRequired, controllers.MyListings)
+	router.Post("/api/listings", controllers.AuthRequired(tokenManager, models.ScopeUpload), controllers.CreateListing)
+	router.Patch("/api/listings/:id", controllers.AuthRequired(tokenManager, models.ScopeUpload), controllers.UpdateListing)
+	router.Delete("/api/listings/:id", controllers.AuthRequired(tokenManager, models.ScopeUpload), controllers.WithdrawListing)
+	router.Get("/api/purchased/:userName", controllers.AuthRequired(tokenManager, models.ScopePurchase), imageController.GetPurchasedImages)
+	router.Get("/api/purchased/ids/:userName", controllers.AuthRequired(tokenManager, models.ScopePurchase), imageController.GetPurchasedImageIDs)
 	router.Get("/api/prem-images/url/:imageUUID", imageController.GetMinioURLOfPremiumImageByUUID)
 
 	return router.Listen(listenAddr)
@@ -133,10 +290,10 @@ func main() {
 	app := &cli.App{
 		Name:     "shisha-inventory",
 		Usage:    "shisha-inventory",
-		Before:   beforeAction,
 		Action:   mainAction,
 		Version:  Version,
 		Compiled: time.Now(),
+		Commands: []*cli.Command{reconcileCommand},
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:    "log-level",
@@ -152,6 +309,12 @@ func main() {
 				EnvVars: []string{"SHISHA_LISTEN"},
 			},
 
+			&cli.StringFlag{
+				Name:    "proxy-header",
+				Usage:   "header carrying the client IP when running behind a proxy, e.g. X-Real-IP",
+				EnvVars: []string{"SHISHA_PROXY_HEADER"},
+			},
+
 			&cli.StringFlag{
 				Name:    "database-url",
 				Usage:   "database url",
@@ -160,10 +323,174 @@ func main() {
 			},
 			&cli.StringFlag{
 				Name:    "secret-key",
-				Usage:   "secret key",
-				Value:   "your_secret_key",
+				Usage:   "HMAC secret key, used only when no jwt signing key is set and to verify the tokens it issued until jwt-legacy-until",
+				Value:   controllers.DefaultSecretKey,
 				EnvVars: []string{"SHISHA_SECRET_KEY"},
 			},
+			&cli.StringFlag{
+				Name:    "admin-username",
+				Usage:   "grant the admin role to `USERNAME` on startup",
+				EnvVars: []string{"SHISHA_ADMIN_USERNAME"},
+			},
+			&cli.StringFlag{
+				Name:    "jwt-signing-key",
+				Usage:   "PEM encoded RSA or Ed25519 private key `FILE` to sign tokens with",
+				EnvVars: []string{"SHISHA_JWT_SIGNING_KEY"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "jwt-verification-keys",
+				Usage:   "PEM encoded key `FILE`s still accepted for verification, e.g. the previous signing key",
+				EnvVars: []string{"SHISHA_JWT_VERIFICATION_KEYS"},
+			},
+			&cli.TimestampFlag{
+				Name:    "jwt-legacy-until",
+				Usage:   "accept session tokens signed with the secret key until `TIME` (RFC 3339), set to when the jwt signing key was introduced plus the refresh token TTL",
+				Layout:  time.RFC3339,
+				EnvVars: []string{"SHISHA_JWT_LEGACY_UNTIL"},
+			},
+			&cli.StringFlag{
+				Name:    "totp-issuer",
+				Usage:   "issuer shown in authenticator apps",
+				Value:   "shisha-inventory",
+				EnvVars: []string{"SHISHA_TOTP_ISSUER"},
+			},
+			&cli.IntFlag{
+				Name:    "transfer-2fa-threshold",
+				Usage:   "require a two-factor code for transfers above `AMOUNT` coins, 0 disables",
+				Value:   0,
+				EnvVars: []string{"SHISHA_TRANSFER_2FA_THRESHOLD"},
+			},
+			&cli.DurationFlag{
+				Name:    "access-token-ttl",
+				Usage:   "access token lifetime",
+				Value:   15 * time.Minute,
+				EnvVars: []string{"SHISHA_ACCESS_TOKEN_TTL"},
+			},
+			&cli.DurationFlag{
+				Name:    "refresh-token-ttl",
+				Usage:   "refresh token lifetime",
+				Value:   30 * 24 * time.Hour,
+				EnvVars: []string{"SHISHA_REFRESH_TOKEN_TTL"},
+			},
+			&cli.StringFlag{
+				Name:    "notifier",
+				Usage:   "how to deliver password reset links, `log` or `smtp`",
+				Value:   "log",
+				EnvVars: []string{"SHISHA_NOTIFIER"},
+			},
+			&cli.StringFlag{
+				Name:    "notifier-file",
+				Usage:   "append log notifier messages to `FILE` instead of the application log",
+				EnvVars: []string{"SHISHA_NOTIFIER_FILE"},
+			},
+			&cli.StringFlag{
+				Name:    "smtp-addr",
+				Usage:   "smtp server address",
+				Value:   "localhost:25",
+				EnvVars: []string{"SHISHA_SMTP_ADDR"},
+			},
+			&cli.StringFlag{
+				Name:    "smtp-from",
+				Usage:   "sender address of notification mails",
+				Value:   "no-reply@localhost",
+				EnvVars: []string{"SHISHA_SMTP_FROM"},
+			},
+			&cli.StringFlag{
+				Name:    "smtp-username",
+				Usage:   "smtp username, empty disables authentication",
+				EnvVars: []string{"SHISHA_SMTP_USERNAME"},
+			},
+			&cli.StringFlag{
+				Name:    "smtp-password",
+				Usage:   "smtp password",
+				EnvVars: []string{"SHISHA_SMTP_PASSWORD"},
+			},
+			&cli.DurationFlag{
+				Name:    "password-reset-ttl",
+				Usage:   "password reset link lifetime",
+				Value:   time.Hour,
+				EnvVars: []string{"SHISHA_PASSWORD_RESET_TTL"},
+			},
+			&cli.StringFlag{
+				Name:    "password-reset-url",
+				Usage:   "client page the reset token is appended to",
+				Value:   "http://localhost:3000/reset-password",
+				EnvVars: []string{"SHISHA_PASSWORD_RESET_URL"},
+			},
+			&cli.DurationFlag{
+				Name:    "idempotency-ttl",
+				Usage:   "how long responses are kept for requests retried with the same Idempotency-Key",
+				Value:   24 * time.Hour,
+				EnvVars: []string{"SHISHA_IDEMPOTENCY_TTL"},
+			},
+			&cli.DurationFlag{
+				Name:    "coin-request-ttl",
+				Usage:   "how long a coin request waits for an answer before it expires",
+				Value:   72 * time.Hour,
+				EnvVars: []string{"SHISHA_COIN_REQUEST_TTL"},
+			},
+			&cli.DurationFlag{
+				Name:    "scheduler-interval",
+				Usage:   "how often due scheduled transfers are run, 0 disables the scheduler on this replica",
+				Value:   30 * time.Second,
+				EnvVars: []string{"SHISHA_SCHEDULER_INTERVAL"},
+			},
+			&cli.DurationFlag{
+				Name:    "reconcile-interval",
+				Usage:   "how often cached balances are compared with the ledger, 0 disables the check",
+				Value:   time.Hour,
+				EnvVars: []string{"SHISHA_RECONCILE_INTERVAL"},
+			},
+			&cli.StringFlag{
+				Name:    "economy-file",
+				Usage:   "YAML `FILE` with the starting economy policy, later changes are made through the admin API",
+				EnvVars: []string{"SHISHA_ECONOMY_FILE"},
+			},
+			&cli.StringFlag{
+				Name:    "reward-timezone",
+				Usage:   "IANA `TIMEZONE` whose calendar days daily rewards follow",
+				Value:   "UTC",
+				EnvVars: []string{"SHISHA_REWARD_TIMEZONE"},
+			},
+			&cli.IntFlag{
+				Name:    "referral-ip-limit",
+				Usage:   "invited registrations paid per client IP a day, 0 disables the limit",
+				Value:   3,
+				EnvVars: []string{"SHISHA_REFERRAL_IP_LIMIT"},
+			},
+			&cli.StringFlag{
+				Name:    "payment-provider",
+				Usage:   "payment `PROVIDER` coin top-ups go through, only fake for now, empty disables top-ups",
+				EnvVars: []string{"SHISHA_PAYMENT_PROVIDER"},
+			},
+			&cli.StringFlag{
+				Name:    "payment-webhook-secret",
+				Usage:   "secret payment provider webhooks are signed with",
+				EnvVars: []string{"SHISHA_PAYMENT_WEBHOOK_SECRET"},
+			},
+			&cli.IntFlag{
+				Name:    "coin-price",
+				Usage:   "price of a coin in the smallest unit of the payment currency",
+				Value:   1,
+				EnvVars: []string{"SHISHA_COIN_PRICE"},
+			},
+			&cli.StringFlag{
+				Name:    "payment-currency",
+				Usage:   "ISO 4217 currency code top-ups are paid in",
+				Value:   "EUR",
+				EnvVars: []string{"SHISHA_PAYMENT_CURRENCY"},
+			},
+			&cli.StringFlag{
+				Name:    "public-url",
+				Usage:   "`URL` this server is reached at, used by the fake payment provider",
+				Value:   "http://localhost:8080",
+				EnvVars: []string{"SHISHA_PUBLIC_URL"},
+			},
+			&cli.StringFlag{
+				Name:    "rules-file",
+				Usage:   "YAML `FILE` with the transfer and purchase rules",
+				EnvVars: []string{"SHISHA_RULES_FILE"},
+			},
 			&cli.StringSliceFlag{
 				Name:    "redpanda-url",
 				Usage:   "redpand url",
@@ -179,10 +506,9 @@ func main() {
 			},
 
 			&cli.StringFlag{
-				Name:     "s3-endpoint",
-				Usage:    "s3 endpoint",
-				Required: true,
-				EnvVars:  []string{"SHISHA_S3_ENDPOINT"},
+				Name:    "s3-endpoint",
+				Usage:   "s3 endpoint, required to run the server",
+				EnvVars: []string{"SHISHA_S3_ENDPOINT"},
 			},
 			&cli.StringFlag{
 				Name:    "s3-access-key",
@@ -0,0 +1,111 @@
+// reconcile.go
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"server/internal/database"
+	"server/internal/ledger"
+
+	"github.com/rs/zerolog"
+	zlog "github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v2"
+)
+
+// reconcileBefore only connects to Postgres. Reconciling needs none of the
+// server's other services and leaves migrations to the server.
+func reconcileBefore(c *cli.Context) error {
+	zerolog.MessageFieldName = "msg"
+	return database.Connect(c.String("database-url"))
+}
+
+// reconcileAction prints the drift report. With --apply every drifted balance
+// is shown and only corrected once the operator confirms it, unless --yes is
+// given. It exits with an error while drift remains, so it can run from cron.
+func reconcileAction(c *cli.Context) error {
+	report, err := ledger.Reconcile(database.DB)
+	if err != nil {
+		return err
+	}
+
+	switch c.String("format") {
+	case "json":
+		encoder := json.NewEncoder(c.App.Writer)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	case "text":
+		err = ledger.WriteText(c.App.Writer, report)
+	default:
+		return fmt.Errorf("unknown format %q", c.String("format"))
+	}
+	if err != nil {
+		return err
+	}
+	if report.Clean() {
+		return nil
+	}
+	if !c.Bool("apply") {
+		return cli.Exit("balances drifted", 1)
+	}
+
+	operator := c.String("operator")
+	if operator == "" {
+		return fmt.Errorf("--operator is required to apply corrections")
+	}
+	input := bufio.NewReader(os.Stdin)
+	remaining := len(report.Drifts)
+	for _, drift := range report.Drifts {
+		if !c.Bool("yes") {
+			fmt.Fprintf(c.App.ErrWriter, "Set %s from %d coins (%d in the ledger) to %d? [y/N] ", drift.Username, drift.Coins, drift.Ledger, drift.Expected)
+			answer, _ := input.ReadString('\n')
+			if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+				continue
+			}
+		}
+		correction, err := ledger.Correct(database.DB, drift, operator)
+		if err != nil {
+			fmt.Fprintf(c.App.ErrWriter, "%s: %v\n", drift.Username, err)
+			continue
+		}
+		remaining--
+		zlog.Info().Str("operator", operator).Str("user", drift.Username).Int("coins", correction.Coins).
+			Int("ledger", correction.Ledger).Int("expected", correction.Expected).Uint("correction", correction.ID).Msg("balance corrected")
+	}
+
+	// Unbalanced transactions cannot be corrected per user, they are fixed by hand
+	if remaining > 0 || len(report.Unbalanced) > 0 {
+		return cli.Exit("balances drifted", 1)
+	}
+	return nil
+}
+
+var reconcileCommand = &cli.Command{
+	Name:   "reconcile",
+	Usage:  "recompute balances from user activity and report drift in users.coins and the ledger",
+	Before: reconcileBefore,
+	Action: reconcileAction,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "report `FORMAT`, text or json",
+			Value: "text",
+		},
+		&cli.BoolFlag{
+			Name:  "apply",
+			Usage: "reset drifted balances to the expected balance after confirmation",
+		},
+		&cli.BoolFlag{
+			Name:  "yes",
+			Usage: "apply corrections without asking",
+		},
+		&cli.StringFlag{
+			Name:    "operator",
+			Usage:   "`NAME` recorded with the corrections",
+			EnvVars: []string{"USER"},
+		},
+	},
+}
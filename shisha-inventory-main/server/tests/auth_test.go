@@ -1,28 +1,77 @@
 package tests
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"server/internal/controllers"
 	"server/internal/database"
+	"server/internal/ledger"
 	"server/internal/models"
+	"server/internal/notify"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-redis/redis/v8"
 	"github.com/gofiber/fiber/v2"
 	"github.com/jinzhu/gorm"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/modules/postgres"
+	tcredis "github.com/testcontainers/testcontainers-go/modules/redis"
 	"github.com/testcontainers/testcontainers-go/wait"
 )
 
 var jwtKey = "your_secret_key"
 
+func newTestTokenManager(rdb *redis.Client) *controllers.TokenManager {
+	return controllers.NewTokenManager(rdb, nil, jwtKey, 15*time.Minute, 24*time.Hour)
+}
+
+func newTestToken(t *testing.T, tm *controllers.TokenManager, username string) string {
+	var user models.User
+	err := database.DB.Where("username = ?", username).First(&user).Error
+	assert.NoError(t, err)
+	tokens, err := tm.Issue(user, "")
+	assert.NoError(t, err)
+	return tokens.AccessToken
+}
+
+// Set up Redis container
+func setupRedis(ctx context.Context) (*redis.Client, func(), error) {
+	redisContainer, err := tcredis.RunContainer(ctx,
+		testcontainers.WithImage(getContainerImage("redis:latest")),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	connStr, err := redisContainer.ConnectionString(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts, err := redis.ParseURL(connStr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	teardown := func() {
+		if err = redisContainer.Terminate(ctx); err != nil {
+			log.Fatalf("failed to terminate container: %s", err)
+		}
+	}
+
+	return redis.NewClient(opts), teardown, nil
+}
+
 // Set up PostgreSQL container
 func setupPostgres(ctx context.Context) (string, func(), error) {
 	dbName := "shishaDB"
@@ -60,20 +109,47 @@ func setupDatabase(dsn string) (*gorm.DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	err = db.AutoMigrate(&models.User{}).Error
+	err = db.AutoMigrate(&models.User{}, &models.RecoveryCode{}, &models.PasswordResetToken{}, &models.APIKey{}, &models.Session{}).Error
+	if err != nil {
+		return nil, err
+	}
+	err = ledger.Migrate(db)
 	if err != nil {
 		return nil, err
 	}
 	return db, nil
 }
 
-func setupTestApp(db *gorm.DB) *fiber.App {
+func setupTestApp(db *gorm.DB, tm *controllers.TokenManager, notifier notify.Notifier) *fiber.App {
 	database.DB = db
 	app := fiber.New()
 
-	app.Post("/register", controllers.Register)
-	app.Post("/login", controllers.Login(jwtKey))
-	app.Post("/auth", controllers.AuthRequired, func(c *fiber.Ctx) error {
+	app.Post("/register", controllers.Register(nil))
+	guard := controllers.NewLoginGuard(tm.RedisClient, []string{"redpanda:9092"}, "shisha")
+	tf := controllers.NewTwoFactor(tm.RedisClient, guard, "shisha", 0)
+	app.Post("/login", controllers.Login(tm, guard))
+	app.Post("/login/2fa", controllers.LoginTwoFactor(tm, tf))
+	app.Post("/2fa/enroll", controllers.AuthRequired(tm), tf.Enroll)
+	app.Post("/2fa/confirm", controllers.AuthRequired(tm), tf.Confirm)
+	app.Post("/refresh", controllers.RefreshToken(tm))
+	reset := controllers.NewPasswordReset(notifier, time.Hour, "http://localhost/reset")
+	app.Post("/password/change", controllers.AuthRequired(tm), controllers.ChangePassword(tm))
+	app.Post("/password/reset/request", reset.Request)
+	app.Post("/password/reset/confirm", reset.Confirm)
+	app.Post("/logout", controllers.AuthRequired(tm), controllers.Logout(tm))
+	app.Post("/logout-all", controllers.AuthRequired(tm), controllers.LogoutAll)
+	app.Get("/admin", controllers.AuthRequired(tm), controllers.RoleRequired(models.RoleAdmin), func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
+	app.Put("/admin/users/:username/role", controllers.AuthRequired(tm), controllers.RoleRequired(models.RoleAdmin), controllers.SetUserRole)
+	app.Get("/sessions", controllers.AuthRequired(tm), controllers.ListSessions)
+	app.Delete("/sessions/:id", controllers.AuthRequired(tm), controllers.RevokeSession)
+	app.Post("/keys", controllers.AuthRequired(tm), controllers.CreateAPIKey)
+	app.Get("/keys", controllers.AuthRequired(tm), controllers.ListAPIKeys)
+	app.Delete("/keys/:id", controllers.AuthRequired(tm), controllers.RevokeAPIKey)
+	app.Get("/balance", controllers.AuthRequired(tm, models.ScopeBalance), controllers.Balance)
+	app.Get("/ledger", controllers.AuthRequired(tm), controllers.Ledger)
+	app.Post("/auth", controllers.AuthRequired(tm), func(c *fiber.Ctx) error {
 		user := c.Locals("user").(models.User)
 		return c.JSON(fiber.Map{"username": user.Username})
 	})
@@ -87,10 +163,16 @@ func TestAuthControllers(t *testing.T) {
 	assert.NoError(t, err)
 	defer teardown()
 
+	rdb, teardownRedis, err := setupRedis(ctx)
+	assert.NoError(t, err)
+	defer teardownRedis()
+
 	db, err := setupDatabase(dsn)
 	assert.NoError(t, err)
 
-	app := setupTestApp(db)
+	tm := newTestTokenManager(rdb)
+	mail := newMailbox()
+	app := setupTestApp(db, tm, mail)
 
 	t.Run("Register", func(t *testing.T) {
 		payload := `{"username":"testuser","password":"testpass"}`
@@ -152,4 +234,569 @@ func TestAuthControllers(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, "testuser", authBody["username"])
 	})
+
+	t.Run("AuthRequired without token", func(t *testing.T) {
+		authReq, _ := http.NewRequest("POST", "/auth", strings.NewReader(`{"username":"testuser"}`))
+		authReq.Header.Set("Content-Type", "application/json")
+
+		authResp, err := app.Test(authReq)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusUnauthorized, authResp.StatusCode)
+	})
+
+	t.Run("AuthRequired with forged token", func(t *testing.T) {
+		claims := &controllers.Claims{
+			Username:  "testuser",
+			TokenType: controllers.TokenTypeAccess,
+			StandardClaims: jwt.StandardClaims{
+				Id:        "forged",
+				ExpiresAt: time.Now().Add(time.Hour).Unix(),
+			},
+		}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("not_the_secret_key"))
+		assert.NoError(t, err)
+
+		authReq, _ := http.NewRequest("POST", "/auth", nil)
+		authReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+		authResp, err := app.Test(authReq)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusUnauthorized, authResp.StatusCode)
+	})
+
+	t.Run("AuthRequired with expired token", func(t *testing.T) {
+		claims := &controllers.Claims{
+			Username:  "testuser",
+			TokenType: controllers.TokenTypeAccess,
+			StandardClaims: jwt.StandardClaims{
+				Id:        "expired",
+				ExpiresAt: time.Now().Add(-time.Minute).Unix(),
+			},
+		}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(jwtKey))
+		assert.NoError(t, err)
+
+		authReq, _ := http.NewRequest("POST", "/auth", nil)
+		authReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+		authResp, err := app.Test(authReq)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusUnauthorized, authResp.StatusCode)
+	})
+
+	t.Run("AuthRequired with multipart body", func(t *testing.T) {
+		token := newTestToken(t, tm, "testuser")
+
+		var buf bytes.Buffer
+		writer := multipart.NewWriter(&buf)
+		part, err := writer.CreateFormFile("file", "shishka.jpg")
+		assert.NoError(t, err)
+		_, err = part.Write([]byte("not really a jpeg"))
+		assert.NoError(t, err)
+		assert.NoError(t, writer.Close())
+
+		authReq, _ := http.NewRequest("POST", "/auth", &buf)
+		authReq.Header.Set("Content-Type", writer.FormDataContentType())
+		authReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+		authResp, err := app.Test(authReq)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, authResp.StatusCode)
+
+		var authBody map[string]interface{}
+		err = json.NewDecoder(authResp.Body).Decode(&authBody)
+		assert.NoError(t, err)
+		assert.Equal(t, "testuser", authBody["username"])
+	})
+
+	login := func(t *testing.T) map[string]interface{} {
+		payload := `{"username":"testuser","password":"testpass"}`
+		req, _ := http.NewRequest("POST", "/login", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+		var body map[string]interface{}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		assert.NoError(t, err)
+		return body
+	}
+
+	refresh := func(t *testing.T, refreshToken string) *http.Response {
+		payload := fmt.Sprintf(`{"refresh_token":%q}`, refreshToken)
+		req, _ := http.NewRequest("POST", "/refresh", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		return resp
+	}
+
+	authStatus := func(t *testing.T, token string) int {
+		req, _ := http.NewRequest("POST", "/auth", nil)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	t.Run("Refresh rotates tokens", func(t *testing.T) {
+		body := login(t)
+		refreshToken := body["refresh_token"].(string)
+
+		resp := refresh(t, refreshToken)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+		var pair controllers.TokenPair
+		err := json.NewDecoder(resp.Body).Decode(&pair)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, pair.AccessToken)
+		assert.NotEqual(t, refreshToken, pair.RefreshToken)
+		assert.Equal(t, fiber.StatusOK, authStatus(t, pair.AccessToken))
+	})
+
+	t.Run("Refresh token reuse revokes all tokens", func(t *testing.T) {
+		body := login(t)
+		refreshToken := body["refresh_token"].(string)
+
+		resp := refresh(t, refreshToken)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		var pair controllers.TokenPair
+		err := json.NewDecoder(resp.Body).Decode(&pair)
+		assert.NoError(t, err)
+
+		resp = refresh(t, refreshToken)
+		assert.Equal(t, fiber.StatusUnauthorized, resp.StatusCode)
+		assert.Equal(t, fiber.StatusUnauthorized, authStatus(t, pair.AccessToken))
+		assert.Equal(t, fiber.StatusUnauthorized, refresh(t, pair.RefreshToken).StatusCode)
+	})
+
+	t.Run("Access token cannot be used as refresh token", func(t *testing.T) {
+		body := login(t)
+		resp := refresh(t, body["token"].(string))
+		assert.Equal(t, fiber.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("Logout revokes access and refresh tokens", func(t *testing.T) {
+		body := login(t)
+		token := body["token"].(string)
+		refreshToken := body["refresh_token"].(string)
+
+		payload := fmt.Sprintf(`{"refresh_token":%q}`, refreshToken)
+		req, _ := http.NewRequest("POST", "/logout", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+		assert.Equal(t, fiber.StatusUnauthorized, authStatus(t, token))
+		assert.Equal(t, fiber.StatusUnauthorized, refresh(t, refreshToken).StatusCode)
+	})
+
+	t.Run("Logout all revokes every session", func(t *testing.T) {
+		first := login(t)["token"].(string)
+		second := login(t)["token"].(string)
+
+		req, _ := http.NewRequest("POST", "/logout-all", nil)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", first))
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+		assert.Equal(t, fiber.StatusUnauthorized, authStatus(t, first))
+		assert.Equal(t, fiber.StatusUnauthorized, authStatus(t, second))
+		assert.Equal(t, fiber.StatusOK, authStatus(t, login(t)["token"].(string)))
+	})
+
+	t.Run("RoleRequired", func(t *testing.T) {
+		payload := `{"username":"sneaky","password":"testpass","role":"admin"}`
+		req, _ := http.NewRequest("POST", "/register", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+		adminStatus := func(token string) int {
+			req, _ := http.NewRequest("GET", "/admin", nil)
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+			resp, err := app.Test(req)
+			assert.NoError(t, err)
+			return resp.StatusCode
+		}
+		setRole := func(token, username, role string) int {
+			payload := fmt.Sprintf(`{"role":%q}`, role)
+			req, _ := http.NewRequest("PUT", "/admin/users/"+username+"/role", strings.NewReader(payload))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+			resp, err := app.Test(req)
+			assert.NoError(t, err)
+			return resp.StatusCode
+		}
+
+		sneakyToken := newTestToken(t, tm, "sneaky")
+		assert.Equal(t, fiber.StatusForbidden, adminStatus(sneakyToken))
+		assert.Equal(t, fiber.StatusForbidden, setRole(sneakyToken, "sneaky", models.RoleAdmin))
+
+		err = db.Model(&models.User{}).Where("username = ?", "testuser").Update("role", models.RoleAdmin).Error
+		assert.NoError(t, err)
+		adminToken := newTestToken(t, tm, "testuser")
+		assert.Equal(t, fiber.StatusOK, adminStatus(adminToken))
+
+		assert.Equal(t, fiber.StatusBadRequest, setRole(adminToken, "sneaky", "overlord"))
+		assert.Equal(t, fiber.StatusOK, setRole(adminToken, "sneaky", models.RoleModerator))
+
+		// The role change revokes tokens issued with the old role
+		assert.Equal(t, fiber.StatusUnauthorized, adminStatus(sneakyToken))
+
+		var sneaky models.User
+		err = db.Where("username = ?", "sneaky").First(&sneaky).Error
+		assert.NoError(t, err)
+		assert.Equal(t, models.RoleModerator, sneaky.Role)
+	})
+
+	t.Run("Login lockout", func(t *testing.T) {
+		payload := `{"username":"bruteforced","password":"testpass"}`
+		req, _ := http.NewRequest("POST", "/register", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+		attempt := func(username, password string) (*http.Response, map[string]interface{}) {
+			payload := fmt.Sprintf(`{"username":%q,"password":%q}`, username, password)
+			req, _ := http.NewRequest("POST", "/login", strings.NewReader(payload))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req, -1)
+			assert.NoError(t, err)
+
+			var body map[string]interface{}
+			err = json.NewDecoder(resp.Body).Decode(&body)
+			assert.NoError(t, err)
+			return resp, body
+		}
+
+		// Unknown users and wrong passwords are indistinguishable
+		resp, unknown := attempt("nobody", "testpass")
+		assert.Equal(t, fiber.StatusUnauthorized, resp.StatusCode)
+		resp, wrong := attempt("bruteforced", "wrongpass")
+		assert.Equal(t, fiber.StatusUnauthorized, resp.StatusCode)
+		assert.Equal(t, unknown["error"], wrong["error"])
+
+		for i := 0; i < 4; i++ {
+			resp, _ = attempt("bruteforced", "wrongpass")
+			assert.Equal(t, fiber.StatusUnauthorized, resp.StatusCode)
+		}
+
+		// Locked out even with the right password
+		resp, _ = attempt("bruteforced", "testpass")
+		assert.Equal(t, fiber.StatusTooManyRequests, resp.StatusCode)
+		assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+
+		// Other accounts are not affected
+		resp, _ = attempt("testuser", "testpass")
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("Two-factor login", func(t *testing.T) {
+		payload := `{"username":"cautious","password":"testpass"}`
+		req, _ := http.NewRequest("POST", "/register", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+		post := func(path, token, payload string) (*http.Response, map[string]interface{}) {
+			req, _ := http.NewRequest("POST", path, strings.NewReader(payload))
+			req.Header.Set("Content-Type", "application/json")
+			if token != "" {
+				req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+			}
+			resp, err := app.Test(req, -1)
+			assert.NoError(t, err)
+
+			var body map[string]interface{}
+			err = json.NewDecoder(resp.Body).Decode(&body)
+			assert.NoError(t, err)
+			return resp, body
+		}
+
+		token := newTestToken(t, tm, "cautious")
+		resp, enroll := post("/2fa/enroll", token, "")
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		secret := enroll["secret"].(string)
+		assert.True(t, strings.HasPrefix(enroll["otpauth_uri"].(string), "otpauth://totp/"))
+
+		resp, _ = post("/2fa/confirm", token, `{"code":"000000"}`)
+		assert.Equal(t, fiber.StatusUnauthorized, resp.StatusCode)
+
+		code, err := models.TOTPCode(secret, time.Now())
+		assert.NoError(t, err)
+		resp, confirm := post("/2fa/confirm", token, fmt.Sprintf(`{"code":%q}`, code))
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		recoveryCodes := confirm["recovery_codes"].([]interface{})
+		assert.Len(t, recoveryCodes, 10)
+
+		// The password alone no longer yields tokens
+		resp, login := post("/login", "", `{"username":"cautious","password":"testpass"}`)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Equal(t, true, login["mfa_required"])
+		assert.Nil(t, login["token"])
+		mfaToken := login["mfa_token"].(string)
+
+		// The code used for confirmation cannot be replayed
+		resp, _ = post("/login/2fa", "", fmt.Sprintf(`{"mfa_token":%q,"code":%q}`, mfaToken, code))
+		assert.Equal(t, fiber.StatusUnauthorized, resp.StatusCode)
+
+		recoveryCode := recoveryCodes[0].(string)
+		resp, tokens := post("/login/2fa", "", fmt.Sprintf(`{"mfa_token":%q,"code":%q}`, mfaToken, recoveryCode))
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.NotEmpty(t, tokens["token"])
+
+		// Both the mfa token and the recovery code are single use
+		resp, _ = post("/login/2fa", "", fmt.Sprintf(`{"mfa_token":%q,"code":%q}`, mfaToken, recoveryCode))
+		assert.Equal(t, fiber.StatusUnauthorized, resp.StatusCode)
+		_, login = post("/login", "", `{"username":"cautious","password":"testpass"}`)
+		resp, _ = post("/login/2fa", "", fmt.Sprintf(`{"mfa_token":%q,"code":%q}`, login["mfa_token"].(string), recoveryCode))
+		assert.Equal(t, fiber.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("Password change", func(t *testing.T) {
+		payload := `{"username":"forgetful","password":"oldpass"}`
+		req, _ := http.NewRequest("POST", "/register", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+		change := func(token, payload string) *http.Response {
+			req, _ := http.NewRequest("POST", "/password/change", strings.NewReader(payload))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+			resp, err := app.Test(req, -1)
+			assert.NoError(t, err)
+			return resp
+		}
+
+		token := newTestToken(t, tm, "forgetful")
+		resp = change(token, `{"old_password":"wrong","new_password":"newpass"}`)
+		assert.Equal(t, fiber.StatusUnauthorized, resp.StatusCode)
+
+		resp = change(token, `{"old_password":"oldpass","new_password":"newpass"}`)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		var body map[string]interface{}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, body["token"])
+
+		// Tokens issued before the change are revoked
+		assert.Equal(t, fiber.StatusUnauthorized, change(token, `{"old_password":"newpass","new_password":"other"}`).StatusCode)
+		assert.Equal(t, fiber.StatusOK, change(body["token"].(string), `{"old_password":"newpass","new_password":"oldpass"}`).StatusCode)
+	})
+
+	t.Run("Password reset", func(t *testing.T) {
+		post := func(path, payload string) int {
+			req, _ := http.NewRequest("POST", path, strings.NewReader(payload))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req, -1)
+			assert.NoError(t, err)
+			return resp.StatusCode
+		}
+
+		assert.Equal(t, fiber.StatusOK, post("/register", `{"username":"resetter","password":"oldpass","email":"resetter@example.com"}`))
+
+		// Unknown users get the same answer and no mail
+		assert.Equal(t, fiber.StatusOK, post("/password/reset/request", `{"username":"nobody"}`))
+		assert.Equal(t, fiber.StatusOK, post("/password/reset/request", `{"username":"resetter"}`))
+
+		select {
+		case <-mail.received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no reset mail sent")
+		}
+		msg := mail.last()
+		assert.Equal(t, "resetter@example.com", msg.To)
+		_, query, found := strings.Cut(msg.Body, "?token=")
+		require.True(t, found)
+		resetToken := strings.Fields(query)[0]
+
+		var stored models.PasswordResetToken
+		require.NoError(t, db.Last(&stored).Error)
+		assert.NotEqual(t, resetToken, stored.TokenHash)
+
+		assert.Equal(t, fiber.StatusBadRequest, post("/password/reset/confirm", `{"token":"bogus","new_password":"newpass"}`))
+		payload := fmt.Sprintf(`{"token":%q,"new_password":"newpass"}`, resetToken)
+		assert.Equal(t, fiber.StatusOK, post("/password/reset/confirm", payload))
+		// Reset tokens are single use
+		assert.Equal(t, fiber.StatusBadRequest, post("/password/reset/confirm", payload))
+
+		assert.Equal(t, fiber.StatusUnauthorized, post("/login", `{"username":"resetter","password":"oldpass"}`))
+		assert.Equal(t, fiber.StatusOK, post("/login", `{"username":"resetter","password":"newpass"}`))
+	})
+
+	t.Run("API keys", func(t *testing.T) {
+		payload := `{"username":"robot","password":"testpass"}`
+		req, _ := http.NewRequest("POST", "/register", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+		request := func(method, path, token, payload string) (*http.Response, []byte) {
+			req, _ := http.NewRequest(method, path, strings.NewReader(payload))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+			resp, err := app.Test(req, -1)
+			assert.NoError(t, err)
+			body, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			return resp, body
+		}
+
+		token := newTestToken(t, tm, "robot")
+		resp, _ = request("POST", "/keys", token, `{"name":"ci","scopes":["root"]}`)
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+
+		resp, body := request("POST", "/keys", token, `{"name":"ci","scopes":["balance","upload"]}`)
+		assert.Equal(t, fiber.StatusCreated, resp.StatusCode)
+		var created map[string]interface{}
+		require.NoError(t, json.Unmarshal(body, &created))
+		key := created["key"].(string)
+		assert.True(t, strings.HasPrefix(key, models.APIKeyPrefix))
+
+		var stored models.APIKey
+		require.NoError(t, db.Where("prefix = ?", created["prefix"]).First(&stored).Error)
+		assert.NotContains(t, stored.KeyHash, key)
+
+		resp, body = request("GET", "/balance", key, "")
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.JSONEq(t, `{"balance":100}`, string(body))
+
+		// Keys cannot be used for account management or to mint new keys
+		resp, _ = request("POST", "/keys", key, `{"name":"escalate","scopes":["transfer"]}`)
+		assert.Equal(t, fiber.StatusForbidden, resp.StatusCode)
+		resp, _ = request("POST", "/auth", key, "")
+		assert.Equal(t, fiber.StatusForbidden, resp.StatusCode)
+
+		resp, _ = request("GET", "/balance", key+"x", "")
+		assert.Equal(t, fiber.StatusUnauthorized, resp.StatusCode)
+
+		resp, body = request("GET", "/keys", token, "")
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.NotContains(t, string(body), key)
+		assert.Contains(t, string(body), `"scopes":["balance","upload"]`)
+
+		resp, _ = request("DELETE", fmt.Sprintf("/keys/%v", created["id"]), token, "")
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		resp, _ = request("GET", "/balance", key, "")
+		assert.Equal(t, fiber.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("Sessions", func(t *testing.T) {
+		payload := `{"username":"traveller","password":"testpass"}`
+		req, _ := http.NewRequest("POST", "/register", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+		loginFrom := func(userAgent string) map[string]interface{} {
+			req, _ := http.NewRequest("POST", "/login", strings.NewReader(payload))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("User-Agent", userAgent)
+			resp, err := app.Test(req, -1)
+			assert.NoError(t, err)
+			assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+			var body map[string]interface{}
+			err = json.NewDecoder(resp.Body).Decode(&body)
+			assert.NoError(t, err)
+			return body
+		}
+		request := func(method, path, token string) (*http.Response, []map[string]interface{}) {
+			req, _ := http.NewRequest(method, path, nil)
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+			resp, err := app.Test(req, -1)
+			assert.NoError(t, err)
+
+			var sessions []map[string]interface{}
+			if method == "GET" && resp.StatusCode == fiber.StatusOK {
+				err = json.NewDecoder(resp.Body).Decode(&sessions)
+				assert.NoError(t, err)
+			}
+			return resp, sessions
+		}
+
+		laptop := loginFrom("laptop")
+		phone := loginFrom("phone")
+
+		resp, sessions := request("GET", "/sessions", laptop["token"].(string))
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		require.Len(t, sessions, 2)
+		var phoneSession string
+		for _, session := range sessions {
+			assert.Equal(t, session["user_agent"] == "laptop", session["current"])
+			if session["user_agent"] == "phone" {
+				phoneSession = session["id"].(string)
+			}
+		}
+		require.NotEmpty(t, phoneSession)
+
+		resp, _ = request("DELETE", "/sessions/"+phoneSession, laptop["token"].(string))
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+		// Both tokens of the revoked session stop working, the other session is untouched
+		assert.Equal(t, fiber.StatusUnauthorized, authStatus(t, phone["token"].(string)))
+		assert.Equal(t, fiber.StatusUnauthorized, refresh(t, phone["refresh_token"].(string)).StatusCode)
+		assert.Equal(t, fiber.StatusOK, authStatus(t, laptop["token"].(string)))
+		assert.Equal(t, fiber.StatusOK, refresh(t, laptop["refresh_token"].(string)).StatusCode)
+
+		_, sessions = request("GET", "/sessions", laptop["token"].(string))
+		assert.Len(t, sessions, 1)
+
+		// Sessions of other users cannot be revoked
+		other := newTestToken(t, tm, "testuser")
+		resp, _ = request("DELETE", "/sessions/"+sessions[0]["id"].(string), other)
+		assert.Equal(t, fiber.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("Ledger", func(t *testing.T) {
+		payload := `{"username":"accountant","password":"testpass","coins":1000000}`
+		req, _ := http.NewRequest("POST", "/register", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+		req, _ = http.NewRequest("GET", "/ledger", nil)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", newTestToken(t, tm, "accountant")))
+		resp, err = app.Test(req, -1)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+		var body struct {
+			Balance int `json:"balance"`
+			Entries []struct {
+				Amount int    `json:"amount"`
+				Reason string `json:"reason"`
+			} `json:"entries"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		assert.NoError(t, err)
+		assert.Equal(t, 100, body.Balance)
+		require.Len(t, body.Entries, 1)
+		assert.Equal(t, 100, body.Entries[0].Amount)
+		assert.Equal(t, ledger.ReasonSignupBonus, body.Entries[0].Reason)
+
+		// Every movement is balanced by the mint
+		balance, err := ledger.Balance(db, ledger.AccountMint)
+		assert.NoError(t, err)
+		var total struct{ Coins int }
+		require.NoError(t, db.Model(&models.User{}).Select("SUM(coins) AS coins").Scan(&total).Error)
+		assert.Equal(t, -total.Coins, balance)
+
+		// Entries cannot be rewritten
+		err = db.Model(&models.LedgerEntry{}).Where("account = ?", ledger.UserAccount("accountant")).UpdateColumn("amount", 1000000).Error
+		assert.Error(t, err)
+	})
 }
@@ -0,0 +1,181 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"server/internal/controllers"
+	"server/internal/database"
+	"server/internal/ledger"
+	"server/internal/models"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupTestAppCoinRequests(db *gorm.DB, tm *controllers.TokenManager, cr *controllers.CoinRequests) *fiber.App {
+	database.DB = db
+	app := fiber.New()
+
+	app.Post("/coin-requests", controllers.AuthRequired(tm), cr.Create)
+	app.Get("/coin-requests", controllers.AuthRequired(tm), cr.List)
+	app.Post("/coin-requests/:id/accept", controllers.AuthRequired(tm), cr.Accept)
+	app.Post("/coin-requests/:id/decline", controllers.AuthRequired(tm), cr.Decline)
+
+	return app
+}
+
+func TestCoinRequests(t *testing.T) {
+	ctx := context.Background()
+	dsn, teardown, err := setupPostgres(ctx)
+	require.NoError(t, err)
+	defer teardown()
+
+	rdb, teardownRedis, err := setupRedis(ctx)
+	require.NoError(t, err)
+	defer teardownRedis()
+
+	db, err := setupDatabase(dsn)
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.Transfer{}, &models.CoinRequest{}).Error)
+
+	tm := newTestTokenManager(rdb)
+	cr := controllers.NewCoinRequests([]string{"redpanda:9092"}, "shisha", nil, nil, time.Hour)
+	app := setupTestAppCoinRequests(db, tm, cr)
+
+	newUser := func(t *testing.T, username string, coins int) string {
+		require.NoError(t, db.Create(&models.User{Username: username, Password: "password"}).Error)
+		_, err := ledger.Move(db, nil, ledger.AccountMint, ledger.UserAccount(username), coins, ledger.ReasonSignupBonus, "")
+		require.NoError(t, err)
+		return newTestToken(t, tm, username)
+	}
+	send := func(method, path, token, payload string) (int, []byte) {
+		req, _ := http.NewRequest(method, path, strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Error(err)
+			return 0, nil
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, body
+	}
+	create := func(t *testing.T, token, payer string, amount int) models.CoinRequest {
+		status, body := send("POST", "/coin-requests", token, fmt.Sprintf(`{"payer":%q,"amount":%d,"note":"pizza"}`, payer, amount))
+		require.Equal(t, fiber.StatusCreated, status, string(body))
+		var request models.CoinRequest
+		require.NoError(t, json.Unmarshal(body, &request))
+		return request
+	}
+	coins := func(username string) int {
+		var user models.User
+		db.Where("username = ?", username).First(&user)
+		return user.Coins
+	}
+
+	alice := newUser(t, "alice", 100)
+	bob := newUser(t, "bob", 100)
+
+	t.Run("Accept pays the requester", func(t *testing.T) {
+		request := create(t, alice, "bob", 30)
+		assert.Equal(t, models.CoinRequestPending, request.Status)
+
+		status, body := send("GET", "/coin-requests?direction=incoming&status=pending", bob, "")
+		assert.Equal(t, fiber.StatusOK, status)
+		var incoming struct {
+			Requests []models.CoinRequest `json:"requests"`
+		}
+		require.NoError(t, json.Unmarshal(body, &incoming))
+		require.Len(t, incoming.Requests, 1)
+		assert.Equal(t, request.ID, incoming.Requests[0].ID)
+
+		// Only the payer can answer
+		status, _ = send("POST", fmt.Sprintf("/coin-requests/%d/accept", request.ID), alice, "")
+		assert.Equal(t, fiber.StatusNotFound, status)
+
+		status, _ = send("POST", fmt.Sprintf("/coin-requests/%d/accept", request.ID), bob, "")
+		assert.Equal(t, fiber.StatusOK, status)
+		assert.Equal(t, 130, coins("alice"))
+		assert.Equal(t, 70, coins("bob"))
+
+		var transfer models.Transfer
+		require.NoError(t, db.Where("from_user = ? AND to_user = ?", "bob", "alice").First(&transfer).Error)
+		assert.Equal(t, "pizza", transfer.Memo)
+
+		status, _ = send("POST", fmt.Sprintf("/coin-requests/%d/accept", request.ID), bob, "")
+		assert.Equal(t, fiber.StatusConflict, status)
+		status, _ = send("POST", fmt.Sprintf("/coin-requests/%d/decline", request.ID), bob, "")
+		assert.Equal(t, fiber.StatusConflict, status)
+	})
+
+	t.Run("Decline moves no coins", func(t *testing.T) {
+		request := create(t, alice, "bob", 10)
+
+		status, _ := send("POST", fmt.Sprintf("/coin-requests/%d/decline", request.ID), bob, "")
+		assert.Equal(t, fiber.StatusOK, status)
+		assert.Equal(t, 130, coins("alice"))
+
+		status, _ = send("POST", fmt.Sprintf("/coin-requests/%d/accept", request.ID), bob, "")
+		assert.Equal(t, fiber.StatusConflict, status)
+	})
+
+	t.Run("Insufficient coins keep the request pending", func(t *testing.T) {
+		request := create(t, bob, "alice", 500)
+
+		status, _ := send("POST", fmt.Sprintf("/coin-requests/%d/accept", request.ID), alice, "")
+		assert.Equal(t, fiber.StatusBadRequest, status)
+
+		var stored models.CoinRequest
+		require.NoError(t, db.First(&stored, request.ID).Error)
+		assert.Equal(t, models.CoinRequestPending, stored.Status)
+	})
+
+	t.Run("Expired requests cannot be accepted", func(t *testing.T) {
+		request := create(t, alice, "bob", 5)
+		require.NoError(t, db.Model(&request).UpdateColumn("expires_at", time.Now().Add(-time.Minute)).Error)
+
+		status, _ := send("POST", fmt.Sprintf("/coin-requests/%d/accept", request.ID), bob, "")
+		assert.Equal(t, fiber.StatusGone, status)
+
+		var stored models.CoinRequest
+		require.NoError(t, db.First(&stored, request.ID).Error)
+		assert.Equal(t, models.CoinRequestExpired, stored.Status)
+		assert.Equal(t, 70, coins("bob"))
+	})
+
+	t.Run("Concurrent accepts pay once", func(t *testing.T) {
+		request := create(t, alice, "bob", 20)
+
+		var wg sync.WaitGroup
+		var succeeded int64
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				status, _ := send("POST", fmt.Sprintf("/coin-requests/%d/accept", request.ID), bob, "")
+				if status == fiber.StatusOK {
+					atomic.AddInt64(&succeeded, 1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, int64(1), succeeded)
+		assert.Equal(t, 50, coins("bob"))
+	})
+
+	t.Run("Cannot request from yourself", func(t *testing.T) {
+		status, _ := send("POST", "/coin-requests", alice, `{"payer":"alice","amount":1}`)
+		assert.Equal(t, fiber.StatusBadRequest, status)
+	})
+}
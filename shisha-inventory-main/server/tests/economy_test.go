@@ -0,0 +1,186 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"server/internal/controllers"
+	"server/internal/database"
+	"server/internal/economy"
+	"server/internal/ledger"
+	"server/internal/models"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEconomyFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "economy.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		return path
+	}
+
+	policy, err := economy.Load(write("signup_bonus: 50\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 50, policy.SignupBonus)
+	assert.Equal(t, economy.Default.UploadReward, policy.UploadReward)
+	assert.Equal(t, economy.Default.PremiumPrice, policy.PremiumPrice)
+
+	for _, content := range []string{"signup_bonus: -1\n", "premium_price: 0\n", "upload_reward: lots\n", "daily_reward: 10\ndaily_reward_max: 5\n", "marketplace_commission: 101\n"} {
+		_, err := economy.Load(write(content))
+		assert.Error(t, err, content)
+	}
+}
+
+func TestDailyRewardFor(t *testing.T) {
+	policy := models.EconomyPolicy{DailyReward: 5, DailyRewardStep: 2, DailyRewardMax: 10}
+	assert.Equal(t, 5, policy.DailyRewardFor(1))
+	assert.Equal(t, 9, policy.DailyRewardFor(3))
+	assert.Equal(t, 10, policy.DailyRewardFor(4))
+	assert.Equal(t, 10, policy.DailyRewardFor(30))
+
+	policy.DailyRewardMax = 0
+	assert.Equal(t, 63, policy.DailyRewardFor(30))
+}
+
+func setupTestAppEconomy(db *gorm.DB, tm *controllers.TokenManager) *fiber.App {
+	database.DB = db
+	app := fiber.New()
+
+	app.Post("/register", controllers.Register(nil))
+	app.Get("/admin/economy", controllers.AuthRequired(tm), controllers.RoleRequired(models.RoleAdmin), controllers.EconomyPolicy)
+	app.Put("/admin/economy", controllers.AuthRequired(tm), controllers.RoleRequired(models.RoleAdmin), controllers.UpdateEconomyPolicy)
+	app.Get("/admin/economy/history", controllers.AuthRequired(tm), controllers.RoleRequired(models.RoleAdmin), controllers.EconomyPolicyHistory)
+
+	return app
+}
+
+func TestEconomyPolicy(t *testing.T) {
+	ctx := context.Background()
+	dsn, teardown, err := setupPostgres(ctx)
+	require.NoError(t, err)
+	defer teardown()
+
+	rdb, teardownRedis, err := setupRedis(ctx)
+	require.NoError(t, err)
+	defer teardownRedis()
+
+	db, err := setupDatabase(dsn)
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.PremiumImage{}).Error)
+	require.NoError(t, economy.Seed(db, economy.Default))
+
+	tm := newTestTokenManager(rdb)
+	app := setupTestAppEconomy(db, tm)
+
+	require.NoError(t, db.Create(&models.User{Username: "admin", Password: "password", Role: models.RoleAdmin}).Error)
+	admin := newTestToken(t, tm, "admin")
+
+	send := func(method, path, token, payload string) (int, []byte) {
+		req, _ := http.NewRequest(method, path, strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := app.Test(req, -1)
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, body
+	}
+	register := func(t *testing.T, username string) models.LedgerEntry {
+		status, body := send("POST", "/register", "", `{"username":"`+username+`","password":"password"}`)
+		require.Equal(t, fiber.StatusOK, status, string(body))
+		entries, err := ledger.Entries(db, ledger.UserAccount(username), 0, 1)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		return entries[0]
+	}
+
+	t.Run("Seeded policy applies", func(t *testing.T) {
+		entry := register(t, "early")
+		assert.Equal(t, 100, entry.Amount)
+		require.NotNil(t, entry.PolicyVersion)
+		assert.Equal(t, uint(1), *entry.PolicyVersion)
+
+		// Seeding again keeps the stored policy
+		require.NoError(t, economy.Seed(db, models.EconomyPolicy{SignupBonus: 1, PremiumPrice: 1}))
+		policy, err := economy.Current(db)
+		require.NoError(t, err)
+		assert.Equal(t, uint(1), policy.ID)
+	})
+
+	t.Run("Changes apply at runtime", func(t *testing.T) {
+		listed := models.PremiumImage{Name: "shishka", Hash: "listed", Price: 25}
+		require.NoError(t, db.Create(&listed).Error)
+
+		status, body := send("PUT", "/admin/economy", admin, `{"signup_bonus":50,"premium_price":30,"comment":"winter sale"}`)
+		require.Equal(t, fiber.StatusOK, status, string(body))
+		var policy models.EconomyPolicy
+		require.NoError(t, json.Unmarshal(body, &policy))
+		assert.Equal(t, uint(2), policy.ID)
+		assert.Equal(t, 1, policy.UploadReward)
+		assert.Equal(t, "admin", policy.ChangedBy)
+
+		entry := register(t, "late")
+		assert.Equal(t, 50, entry.Amount)
+		require.NotNil(t, entry.PolicyVersion)
+		assert.Equal(t, uint(2), *entry.PolicyVersion)
+
+		// Stored images are not repriced behind the operator's back
+		db.First(&listed, listed.ID)
+		assert.Equal(t, 25, listed.Price)
+	})
+
+	t.Run("History", func(t *testing.T) {
+		status, body := send("GET", "/admin/economy/history", admin, "")
+		require.Equal(t, fiber.StatusOK, status)
+		var history struct {
+			Policies []models.EconomyPolicy `json:"policies"`
+		}
+		require.NoError(t, json.Unmarshal(body, &history))
+		require.Len(t, history.Policies, 2)
+		assert.Equal(t, "winter sale", history.Policies[0].Comment)
+		assert.Equal(t, "config", history.Policies[1].ChangedBy)
+	})
+
+	t.Run("Invalid policies are rejected", func(t *testing.T) {
+		status, _ := send("PUT", "/admin/economy", admin, `{"premium_price":0}`)
+		assert.Equal(t, fiber.StatusBadRequest, status)
+
+		status, _ = send("PUT", "/admin/economy", newTestToken(t, tm, "late"), `{"signup_bonus":1000}`)
+		assert.Equal(t, fiber.StatusForbidden, status)
+	})
+
+	t.Run("Upgrades carry added amounts forward", func(t *testing.T) {
+		// A deployment from before daily rewards, referrals and the marketplace
+		require.NoError(t, db.Exec("ALTER TABLE economy_policies DROP COLUMN daily_reward, DROP COLUMN daily_reward_step, DROP COLUMN daily_reward_max, DROP COLUMN referral_bonus, DROP COLUMN invitee_bonus, DROP COLUMN marketplace_commission").Error)
+
+		configured := economy.Default
+		configured.DailyReward = 7
+		require.NoError(t, economy.Migrate(db, configured))
+		policy, err := economy.Current(db)
+		require.NoError(t, err)
+		assert.Equal(t, uint(3), policy.ID)
+		assert.Equal(t, "migration", policy.ChangedBy)
+		assert.Equal(t, 7, policy.DailyReward)
+		assert.Equal(t, economy.Default.DailyRewardMax, policy.DailyRewardMax)
+		assert.Equal(t, economy.Default.ReferralBonus, policy.ReferralBonus)
+		assert.Equal(t, economy.Default.InviteeBonus, policy.InviteeBonus)
+		assert.Equal(t, economy.Default.MarketplaceCommission, policy.MarketplaceCommission)
+		assert.Equal(t, 50, policy.SignupBonus)
+
+		require.NoError(t, economy.Migrate(db, configured))
+		policy, err = economy.Current(db)
+		require.NoError(t, err)
+		assert.Equal(t, uint(3), policy.ID)
+	})
+}
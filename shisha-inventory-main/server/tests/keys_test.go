@@ -0,0 +1,180 @@
+package tests
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"server/internal/controllers"
+	"server/internal/initializers"
+	"server/internal/models"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePrivateKey(t *testing.T, dir, name string, key interface{}) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	path := filepath.Join(dir, name)
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	require.NoError(t, err)
+	return path
+}
+
+func writePublicKey(t *testing.T, dir, name string, key interface{}) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	require.NoError(t, err)
+	path := filepath.Join(dir, name)
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)
+	require.NoError(t, err)
+	return path
+}
+
+func TestSigningKeys(t *testing.T) {
+	dir := t.TempDir()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	rsaFile := writePrivateKey(t, dir, "rsa.pem", rsaKey)
+	rsaPubFile := writePublicKey(t, dir, "rsa.pub.pem", &rsaKey.PublicKey)
+	edFile := writePrivateKey(t, dir, "ed25519.pem", edKey)
+
+	user := models.User{Username: "testuser"}
+
+	// The RSA key signed tokens before the rotation to Ed25519
+	oldKeys, err := initializers.LoadKeySet(rsaFile, nil)
+	require.NoError(t, err)
+	oldManager := controllers.NewTokenManager(nil, oldKeys, "", time.Minute, time.Hour)
+
+	keys, err := initializers.LoadKeySet(edFile, []string{rsaPubFile})
+	require.NoError(t, err)
+	manager := controllers.NewTokenManager(nil, keys, "", time.Minute, time.Hour)
+
+	t.Run("Tokens carry kid", func(t *testing.T) {
+		tokens, err := manager.Issue(user, "")
+		require.NoError(t, err)
+
+		token, _, err := new(jwt.Parser).ParseUnverified(tokens.AccessToken, &controllers.Claims{})
+		require.NoError(t, err)
+		assert.Equal(t, "EdDSA", token.Header["alg"])
+		assert.Equal(t, keys.Signing().ID, token.Header["kid"])
+
+		claims, err := manager.Parse(tokens.AccessToken, controllers.TokenTypeAccess)
+		require.NoError(t, err)
+		assert.Equal(t, "testuser", claims.Username)
+	})
+
+	t.Run("Rotated key still verifies", func(t *testing.T) {
+		tokens, err := oldManager.Issue(user, "")
+		require.NoError(t, err)
+
+		claims, err := manager.Parse(tokens.AccessToken, controllers.TokenTypeAccess)
+		require.NoError(t, err)
+		assert.Equal(t, "testuser", claims.Username)
+	})
+
+	t.Run("Unknown key is rejected", func(t *testing.T) {
+		tokens, err := manager.Issue(user, "")
+		require.NoError(t, err)
+
+		_, err = oldManager.Parse(tokens.AccessToken, controllers.TokenTypeAccess)
+		assert.Error(t, err)
+	})
+
+	t.Run("HMAC token is rejected", func(t *testing.T) {
+		claims := &controllers.Claims{
+			Username:  "testuser",
+			TokenType: controllers.TokenTypeAccess,
+			StandardClaims: jwt.StandardClaims{
+				Id:        "hmac",
+				ExpiresAt: time.Now().Add(time.Hour).Unix(),
+			},
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		token.Header["kid"] = keys.Signing().ID
+		tokenString, err := token.SignedString([]byte(jwtKey))
+		require.NoError(t, err)
+
+		_, err = manager.Parse(tokenString, controllers.TokenTypeAccess)
+		assert.Error(t, err)
+	})
+
+	t.Run("HMAC tokens from before the signing key expire naturally", func(t *testing.T) {
+		secret := "legacy secret"
+		legacyManager := controllers.NewTokenManager(nil, nil, secret, time.Minute, time.Hour)
+		switched := controllers.NewTokenManager(nil, keys, secret, time.Minute, time.Hour)
+		tokens, err := legacyManager.Issue(user, "session")
+		require.NoError(t, err)
+
+		// Nothing is accepted without an explicit cutover
+		_, err = switched.Parse(tokens.RefreshToken, controllers.TokenTypeRefresh)
+		assert.Error(t, err)
+
+		require.NoError(t, switched.AcceptLegacy(time.Now().Add(time.Hour)))
+		claims, err := switched.Parse(tokens.RefreshToken, controllers.TokenTypeRefresh)
+		require.NoError(t, err)
+		assert.Equal(t, "testuser", claims.Username)
+
+		// Tokens without a session are not bound to a login that can be checked
+		sessionless, err := legacyManager.Issue(user, "")
+		require.NoError(t, err)
+		_, err = switched.Parse(sessionless.AccessToken, controllers.TokenTypeAccess)
+		assert.Error(t, err)
+
+		// The secret never issued tokens outliving the transition
+		long := &controllers.Claims{
+			Username:  "testuser",
+			TokenType: controllers.TokenTypeAccess,
+			SessionID: "session",
+			StandardClaims: jwt.StandardClaims{
+				Id:        "long",
+				ExpiresAt: time.Now().Add(2 * time.Hour).Unix(),
+			},
+		}
+		tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, long).SignedString([]byte(secret))
+		require.NoError(t, err)
+		_, err = switched.Parse(tokenString, controllers.TokenTypeAccess)
+		assert.Error(t, err)
+
+		require.NoError(t, switched.AcceptLegacy(time.Now().Add(-time.Second)))
+		_, err = switched.Parse(tokens.AccessToken, controllers.TokenTypeAccess)
+		assert.Error(t, err)
+	})
+
+	t.Run("The default secret never verifies next to a signing key", func(t *testing.T) {
+		assert.Error(t, controllers.NewTokenManager(nil, keys, controllers.DefaultSecretKey, time.Minute, time.Hour).AcceptLegacy(time.Now().Add(time.Hour)))
+		assert.Error(t, controllers.NewTokenManager(nil, keys, "", time.Minute, time.Hour).AcceptLegacy(time.Now().Add(time.Hour)))
+		assert.Error(t, controllers.NewTokenManager(nil, nil, "legacy secret", time.Minute, time.Hour).AcceptLegacy(time.Now().Add(time.Hour)))
+	})
+
+	t.Run("JWKS publishes public keys", func(t *testing.T) {
+		set := keys.JWKS()
+		require.Len(t, set.Keys, 2)
+
+		assert.Equal(t, "OKP", set.Keys[0].Kty)
+		assert.Equal(t, "EdDSA", set.Keys[0].Alg)
+		assert.Equal(t, keys.Signing().ID, set.Keys[0].Kid)
+
+		assert.Equal(t, "RSA", set.Keys[1].Kty)
+		assert.Equal(t, "RS256", set.Keys[1].Alg)
+		assert.Equal(t, oldKeys.Signing().ID, set.Keys[1].Kid)
+		assert.Equal(t, "AQAB", set.Keys[1].E)
+	})
+
+	t.Run("Public key cannot sign", func(t *testing.T) {
+		_, err := initializers.LoadKeySet(rsaPubFile, nil)
+		require.Error(t, err)
+		assert.True(t, strings.Contains(err.Error(), "private key"))
+	})
+}
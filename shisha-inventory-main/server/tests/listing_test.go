@@ -0,0 +1,212 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"server/internal/controllers"
+	"server/internal/database"
+	"server/internal/economy"
+	"server/internal/ledger"
+	"server/internal/models"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupTestAppListings(db *gorm.DB, tm *controllers.TokenManager) *fiber.App {
+	database.DB = db
+	app := fiber.New()
+	imageController := controllers.NewImageController(db, nil, context.Background(), "")
+
+	app.Get("/listings", controllers.Listings)
+	app.Get("/listings/mine", controllers.AuthRequired(tm), controllers.MyListings)
+	app.Post("/listings", controllers.AuthRequired(tm), controllers.CreateListing)
+	app.Patch("/listings/:id", controllers.AuthRequired(tm), controllers.UpdateListing)
+	app.Delete("/listings/:id", controllers.AuthRequired(tm), controllers.WithdrawListing)
+	app.Post("/purchase", controllers.AuthRequired(tm), imageController.PurchaseImage("shisha", []string{"redpanda:9092"}, nil))
+	app.Get("/purchased-images", controllers.AuthRequired(tm), imageController.GetPurchasedImageIDs)
+
+	return app
+}
+
+func TestListings(t *testing.T) {
+	ctx := context.Background()
+	dsn, teardown, err := setupPostgres(ctx)
+	require.NoError(t, err)
+	defer teardown()
+
+	rdb, teardownRedis, err := setupRedis(ctx)
+	require.NoError(t, err)
+	defer teardownRedis()
+
+	db, err := setupDatabase(dsn)
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.Image{}, &models.PremiumImage{}, &models.Purchase{}, &models.Reversal{}, &models.Listing{}).Error)
+	require.NoError(t, database.MigratePurchases(db))
+	require.NoError(t, database.MigrateListings(db))
+	policy := economy.Default
+	policy.MarketplaceCommission = 10
+	require.NoError(t, economy.Seed(db, policy))
+
+	tm := newTestTokenManager(rdb)
+	app := setupTestAppListings(db, tm)
+
+	newUser := func(t *testing.T, username string, coins int) string {
+		require.NoError(t, db.Create(&models.User{Username: username, Password: "password"}).Error)
+		if coins > 0 {
+			_, err := ledger.Move(db, nil, ledger.AccountMint, ledger.UserAccount(username), coins, ledger.ReasonSignupBonus, "")
+			require.NoError(t, err)
+		}
+		return newTestToken(t, tm, username)
+	}
+	newImage := func(t *testing.T, username string) models.Image {
+		image := models.Image{Name: "cone-" + username + ".jpg", Hash: "hash-" + username, Username: username}
+		require.NoError(t, db.Create(&image).Error)
+		return image
+	}
+	send := func(method, path, token, payload string) (int, fiber.Map) {
+		req, _ := http.NewRequest(method, path, strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := app.Test(req, -1)
+		require.NoError(t, err)
+		var body fiber.Map
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body
+	}
+	list := func(t *testing.T, token string, imageID uint, price int) uint {
+		status, body := send("POST", "/listings", token, fmt.Sprintf(`{"image_id":%d,"price":%d}`, imageID, price))
+		require.Equal(t, fiber.StatusCreated, status, body)
+		return uint(body["id"].(float64))
+	}
+	buy := func(token string, listingID uint) int {
+		status, _ := send("POST", "/purchase", token, fmt.Sprintf(`{"listing_id":%d}`, listingID))
+		return status
+	}
+	balance := func(account string) int {
+		balance, err := ledger.Balance(db, account)
+		require.NoError(t, err)
+		return balance
+	}
+
+	sellerToken := newUser(t, "seller", 0)
+	buyerToken := newUser(t, "buyer", 500)
+	image := newImage(t, "seller")
+
+	t.Run("Only uploaders list their images", func(t *testing.T) {
+		status, _ := send("POST", "/listings", buyerToken, fmt.Sprintf(`{"image_id":%d,"price":100}`, image.ID))
+		assert.Equal(t, fiber.StatusNotFound, status)
+		status, _ = send("POST", "/listings", sellerToken, fmt.Sprintf(`{"image_id":%d,"price":0}`, image.ID))
+		assert.Equal(t, fiber.StatusBadRequest, status)
+	})
+
+	t.Run("Sale credits the seller minus commission", func(t *testing.T) {
+		listingID := list(t, sellerToken, image.ID, 100)
+
+		status, _ := send("POST", "/listings", sellerToken, fmt.Sprintf(`{"image_id":%d,"price":50}`, image.ID))
+		assert.Equal(t, fiber.StatusConflict, status)
+		assert.Equal(t, fiber.StatusBadRequest, buy(sellerToken, listingID))
+
+		status, body := send("GET", "/listings?seller=seller", "", "")
+		require.Equal(t, fiber.StatusOK, status)
+		require.Len(t, body["listings"], 1)
+		assert.Equal(t, image.Name, body["listings"].([]interface{})[0].(map[string]interface{})["image_name"])
+
+		assert.Equal(t, fiber.StatusOK, buy(buyerToken, listingID))
+		assert.Equal(t, 400, balance(ledger.UserAccount("buyer")))
+		assert.Equal(t, 90, balance(ledger.UserAccount("seller")))
+		assert.Equal(t, 10, balance(ledger.AccountShop))
+
+		assert.Equal(t, fiber.StatusBadRequest, buy(buyerToken, listingID))
+		assert.Equal(t, 400, balance(ledger.UserAccount("buyer")))
+
+		var purchase models.Purchase
+		require.NoError(t, db.Where("user_name = ? AND seller = ?", "buyer", "seller").First(&purchase).Error)
+		assert.Equal(t, image.ID, purchase.ImageID)
+		assert.Equal(t, listingID, *purchase.ListingID)
+
+		// Uploaded images are numbered apart from the premium ids listed here
+		req, _ := http.NewRequest("GET", "/purchased-images", nil)
+		req.Header.Set("Authorization", "Bearer "+buyerToken)
+		resp, err := app.Test(req, -1)
+		require.NoError(t, err)
+		var ids []string
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&ids))
+		assert.Empty(t, ids)
+	})
+
+	t.Run("Paused and withdrawn listings are not for sale", func(t *testing.T) {
+		other := newImage(t, "seller2")
+		otherToken := newUser(t, "seller2", 0)
+		listingID := list(t, otherToken, other.ID, 40)
+		path := fmt.Sprintf("/listings/%d", listingID)
+
+		status, _ := send("PATCH", path, buyerToken, `{"status":"paused"}`)
+		assert.Equal(t, fiber.StatusNotFound, status)
+		status, body := send("PATCH", path, otherToken, `{"status":"paused"}`)
+		require.Equal(t, fiber.StatusOK, status)
+		assert.Equal(t, models.ListingPaused, body["status"])
+		assert.Equal(t, fiber.StatusConflict, buy(buyerToken, listingID))
+
+		status, body = send("GET", "/listings?seller=seller2", "", "")
+		require.Equal(t, fiber.StatusOK, status)
+		assert.Len(t, body["listings"], 0)
+		status, body = send("GET", "/listings/mine", otherToken, "")
+		require.Equal(t, fiber.StatusOK, status)
+		assert.Len(t, body["listings"], 1)
+
+		status, _ = send("DELETE", path, buyerToken, "")
+		assert.Equal(t, fiber.StatusNotFound, status)
+		status, _ = send("DELETE", path, otherToken, "")
+		assert.Equal(t, fiber.StatusOK, status)
+		assert.Equal(t, fiber.StatusConflict, buy(buyerToken, listingID))
+		status, _ = send("PATCH", path, otherToken, `{"status":"active"}`)
+		assert.Equal(t, fiber.StatusNotFound, status)
+
+		// A withdrawn image can be listed again, at a new price
+		relisted := list(t, otherToken, other.ID, 60)
+		assert.Equal(t, fiber.StatusOK, buy(buyerToken, relisted))
+		assert.Equal(t, 340, balance(ledger.UserAccount("buyer")))
+		assert.Equal(t, 54, balance(ledger.UserAccount("seller2")))
+	})
+
+	t.Run("Insufficient coins buy nothing", func(t *testing.T) {
+		poorToken := newUser(t, "pauper", 10)
+		listingID := list(t, newUser(t, "seller3", 0), newImage(t, "seller3").ID, 30)
+
+		assert.Equal(t, fiber.StatusPaymentRequired, buy(poorToken, listingID))
+		assert.Equal(t, 10, balance(ledger.UserAccount("pauper")))
+		assert.Equal(t, 0, balance(ledger.UserAccount("seller3")))
+	})
+
+	t.Run("Refund takes back the seller's share and the commission", func(t *testing.T) {
+		var purchase models.Purchase
+		require.NoError(t, db.Where("user_name = ? AND seller = ?", "buyer", "seller").First(&purchase).Error)
+
+		reversal, err := ledger.RefundPurchase(db, purchase.ID, "admin", "chargeback")
+		require.NoError(t, err)
+		assert.Equal(t, 100, reversal.Amount)
+		assert.Equal(t, "seller", reversal.Counterparty)
+		assert.Equal(t, 440, balance(ledger.UserAccount("buyer")))
+		assert.Equal(t, 0, balance(ledger.UserAccount("seller")))
+	})
+
+	t.Run("Refund fails when the seller spent the coins", func(t *testing.T) {
+		var purchase models.Purchase
+		require.NoError(t, db.Where("user_name = ? AND seller = ?", "buyer", "seller2").First(&purchase).Error)
+		_, err := ledger.Move(db, nil, ledger.UserAccount("seller2"), ledger.AccountShop, 54, ledger.ReasonPurchase, "")
+		require.NoError(t, err)
+
+		_, err = ledger.RefundPurchase(db, purchase.ID, "admin", "chargeback")
+		assert.Equal(t, ledger.ErrInsufficientFunds, err)
+		assert.Equal(t, 440, balance(ledger.UserAccount("buyer")))
+	})
+}
@@ -0,0 +1,134 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"server/internal/notify"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mailbox is a notifier that keeps messages in memory.
+type mailbox struct {
+	mu       sync.Mutex
+	messages []notify.Message
+	received chan struct{}
+}
+
+func newMailbox() *mailbox {
+	return &mailbox{received: make(chan struct{}, 16)}
+}
+
+func (m *mailbox) Notify(ctx context.Context, msg notify.Message) error {
+	m.mu.Lock()
+	m.messages = append(m.messages, msg)
+	m.mu.Unlock()
+	m.received <- struct{}{}
+	return nil
+}
+
+func (m *mailbox) last() notify.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.messages[len(m.messages)-1]
+}
+
+// mockSMTPServer accepts a single mail and sends its DATA section to mails.
+func mockSMTPServer(t *testing.T) (string, <-chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	mails := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(cmd, "DATA"):
+				reply("354 go ahead")
+				var data strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				mails <- data.String()
+				reply("250 queued")
+			case strings.HasPrefix(cmd, "QUIT"):
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return ln.Addr().String(), mails
+}
+
+func TestNotifiers(t *testing.T) {
+	msg := notify.Message{
+		To:      "user@example.com",
+		Subject: "Reset your password",
+		Body:    "line one\nline two",
+	}
+
+	t.Run("SMTP", func(t *testing.T) {
+		addr, mails := mockSMTPServer(t)
+		notifier := notify.NewSMTPNotifier(addr, "no-reply@example.com", "", "")
+
+		err := notifier.Notify(context.Background(), msg)
+		require.NoError(t, err)
+
+		mail := <-mails
+		assert.Contains(t, mail, "From: no-reply@example.com\r\n")
+		assert.Contains(t, mail, "To: user@example.com\r\n")
+		assert.Contains(t, mail, "Subject: Reset your password\r\n")
+		assert.Contains(t, mail, "line one\r\nline two")
+	})
+
+	t.Run("SMTP without recipient", func(t *testing.T) {
+		notifier := notify.NewSMTPNotifier("127.0.0.1:1", "no-reply@example.com", "", "")
+		err := notifier.Notify(context.Background(), notify.Message{Subject: "nobody"})
+		assert.Error(t, err)
+	})
+
+	t.Run("Log file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "mail.log")
+		notifier := notify.NewLogNotifier(path)
+
+		require.NoError(t, notifier.Notify(context.Background(), msg))
+		require.NoError(t, notifier.Notify(context.Background(), msg))
+
+		content, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, 2, strings.Count(string(content), "To: user@example.com\n"))
+		assert.Contains(t, string(content), "line one\nline two")
+	})
+}
@@ -0,0 +1,149 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"server/internal/controllers"
+	"server/internal/database"
+	"server/internal/ledger"
+	"server/internal/models"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupTestAppPurchase(db *gorm.DB, tm *controllers.TokenManager) *fiber.App {
+	database.DB = db
+	app := fiber.New()
+
+	imageController := controllers.NewImageController(db, nil, context.Background(), "")
+	app.Post("/purchase", controllers.AuthRequired(tm), imageController.PurchaseImage("shisha", []string{"redpanda:9092"}, nil))
+
+	return app
+}
+
+func TestPurchase(t *testing.T) {
+	ctx := context.Background()
+	dsn, teardown, err := setupPostgres(ctx)
+	require.NoError(t, err)
+	defer teardown()
+
+	rdb, teardownRedis, err := setupRedis(ctx)
+	require.NoError(t, err)
+	defer teardownRedis()
+
+	db, err := setupDatabase(dsn)
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.PremiumImage{}, &models.Purchase{}).Error)
+	require.NoError(t, database.MigratePurchases(db))
+	db.DB().SetMaxOpenConns(20)
+
+	tm := newTestTokenManager(rdb)
+	app := setupTestAppPurchase(db, tm)
+
+	newBuyer := func(t *testing.T, username string, coins int) string {
+		require.NoError(t, db.Create(&models.User{Username: username, Password: "password"}).Error)
+		_, err := ledger.Move(db, nil, ledger.AccountMint, ledger.UserAccount(username), coins, ledger.ReasonSignupBonus, "")
+		require.NoError(t, err)
+		return newTestToken(t, tm, username)
+	}
+	newImage := func(t *testing.T, price int) models.PremiumImage {
+		image := models.PremiumImage{Name: "shishka", Hash: fmt.Sprintf("hash-%d", price), Price: price}
+		require.NoError(t, db.Create(&image).Error)
+		return image
+	}
+	purchase := func(token string, imageID uint) int {
+		payload := fmt.Sprintf(`{"image_id":%d}`, imageID)
+		req, _ := http.NewRequest("POST", "/purchase", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+		return resp.StatusCode
+	}
+	coins := func(username string) int {
+		var user models.User
+		db.Where("username = ?", username).First(&user)
+		return user.Coins
+	}
+
+	t.Run("Charges the catalog price", func(t *testing.T) {
+		token := newBuyer(t, "collector", 100)
+		image := newImage(t, 40)
+
+		assert.Equal(t, fiber.StatusOK, purchase(token, image.ID))
+		assert.Equal(t, 60, coins("collector"))
+
+		balance, err := ledger.Balance(db, ledger.AccountShop)
+		assert.NoError(t, err)
+		assert.Equal(t, 40, balance)
+
+		assert.Equal(t, fiber.StatusBadRequest, purchase(token, image.ID))
+		assert.Equal(t, 60, coins("collector"))
+	})
+
+	t.Run("Insufficient coins grant nothing", func(t *testing.T) {
+		token := newBuyer(t, "pauper", 10)
+		image := newImage(t, 25)
+
+		assert.Equal(t, fiber.StatusPaymentRequired, purchase(token, image.ID))
+		assert.Equal(t, 10, coins("pauper"))
+
+		var count int
+		db.Model(&models.Purchase{}).Where("user_name = ?", "pauper").Count(&count)
+		assert.Equal(t, 0, count)
+	})
+
+	t.Run("Concurrent purchases charge once", func(t *testing.T) {
+		token := newBuyer(t, "impatient", 100)
+		image := newImage(t, 30)
+
+		var wg sync.WaitGroup
+		var succeeded int64
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if purchase(token, image.ID) == fiber.StatusOK {
+					atomic.AddInt64(&succeeded, 1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, int64(1), succeeded)
+		assert.Equal(t, 70, coins("impatient"))
+
+		var count int
+		db.Model(&models.Purchase{}).Where("user_name = ?", "impatient").Count(&count)
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("Duplicates from before the index are marked refunded", func(t *testing.T) {
+		require.NoError(t, db.Exec("DROP INDEX idx_purchases_user_seller_image_active").Error)
+		for i := 0; i < 3; i++ {
+			require.NoError(t, db.Create(&models.Purchase{UserName: "legacy", ImageID: 42}).Error)
+		}
+
+		require.NoError(t, database.MigratePurchases(db))
+		var purchases []models.Purchase
+		require.NoError(t, db.Where("user_name = ?", "legacy").Order("id").Find(&purchases).Error)
+		require.Len(t, purchases, 3)
+		assert.Nil(t, purchases[0].RefundedAt)
+		assert.NotNil(t, purchases[1].RefundedAt)
+		assert.NotNil(t, purchases[2].RefundedAt)
+
+		err := db.Create(&models.Purchase{UserName: "legacy", ImageID: 42}).Error
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,121 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"server/internal/ledger"
+	"server/internal/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+	dsn, teardown, err := setupPostgres(ctx)
+	require.NoError(t, err)
+	defer teardown()
+
+	db, err := setupDatabase(dsn)
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.Transfer{}, &models.Image{}, &models.Purchase{}, &models.DailyReward{}, &models.Referral{}, &models.TopUp{}).Error)
+
+	for _, username := range []string{"alice", "bob"} {
+		require.NoError(t, db.Create(&models.User{Username: username, Password: "password", SignupBonus: 100}).Error)
+		_, err := ledger.Move(db, nil, ledger.AccountMint, ledger.UserAccount(username), 100, ledger.ReasonSignupBonus, "")
+		require.NoError(t, err)
+	}
+	_, err = ledger.Transfer(db, "alice", "bob", 30, "")
+	require.NoError(t, err)
+
+	t.Run("Clean", func(t *testing.T) {
+		report, err := ledger.Reconcile(db)
+		require.NoError(t, err)
+		assert.True(t, report.Clean())
+		assert.Equal(t, 2, report.Users)
+	})
+
+	// A balance changed outside the ledger
+	require.NoError(t, db.Model(&models.User{}).Where("username = ?", "bob").UpdateColumn("coins", 150).Error)
+
+	t.Run("Drift is reported", func(t *testing.T) {
+		report, err := ledger.Reconcile(db)
+		require.NoError(t, err)
+		require.Len(t, report.Drifts, 1)
+		drift := report.Drifts[0]
+		assert.Equal(t, "bob", drift.Username)
+		assert.Equal(t, 130, drift.Ledger)
+		assert.Equal(t, 130, drift.Expected)
+		assert.Equal(t, 20, drift.Difference)
+		assert.Empty(t, drift.Sources)
+
+		var text bytes.Buffer
+		require.NoError(t, ledger.WriteText(&text, report))
+		assert.Contains(t, text.String(), "bob")
+		assert.Contains(t, text.String(), "+20")
+	})
+
+	t.Run("Stale reports are not applied", func(t *testing.T) {
+		report, err := ledger.Reconcile(db)
+		require.NoError(t, err)
+		require.NoError(t, db.Model(&models.User{}).Where("username = ?", "bob").UpdateColumn("coins", 160).Error)
+
+		_, err = ledger.Correct(db, report.Drifts[0], "ops")
+		assert.ErrorIs(t, err, ledger.ErrDriftChanged)
+	})
+
+	t.Run("Corrections reset to the expected balance", func(t *testing.T) {
+		report, err := ledger.Reconcile(db)
+		require.NoError(t, err)
+		require.Len(t, report.Drifts, 1)
+
+		correction, err := ledger.Correct(db, report.Drifts[0], "ops")
+		require.NoError(t, err)
+		assert.Equal(t, 160, correction.Coins)
+		assert.Equal(t, "ops", correction.Operator)
+
+		var bob models.User
+		require.NoError(t, db.Where("username = ?", "bob").First(&bob).Error)
+		assert.Equal(t, 130, bob.Coins)
+
+		report, err = ledger.Reconcile(db)
+		require.NoError(t, err)
+		assert.True(t, report.Clean())
+	})
+
+	// A reward booked without the upload it pays for
+	_, err = ledger.Move(db, nil, ledger.AccountMint, ledger.UserAccount("alice"), 5, ledger.ReasonUploadReward, "image:missing")
+	require.NoError(t, err)
+
+	t.Run("Ledger drift is reported by source", func(t *testing.T) {
+		report, err := ledger.Reconcile(db)
+		require.NoError(t, err)
+		require.Len(t, report.Drifts, 1)
+		drift := report.Drifts[0]
+		assert.Equal(t, "alice", drift.Username)
+		assert.Equal(t, 75, drift.Coins)
+		assert.Equal(t, 75, drift.Ledger)
+		assert.Equal(t, 70, drift.Expected)
+		assert.Equal(t, map[string]ledger.SourceDrift{"uploads": {Expected: 0, Ledger: 5}}, drift.Sources)
+
+		var text bytes.Buffer
+		require.NoError(t, ledger.WriteText(&text, report))
+		assert.Contains(t, text.String(), "uploads=0/5")
+
+		correction, err := ledger.Correct(db, drift, "ops")
+		require.NoError(t, err)
+		assert.Equal(t, 75, correction.Ledger)
+
+		balance, err := ledger.Balance(db, ledger.UserAccount("alice"))
+		require.NoError(t, err)
+		assert.Equal(t, 70, balance)
+		var alice models.User
+		require.NoError(t, db.Where("username = ?", "alice").First(&alice).Error)
+		assert.Equal(t, 70, alice.Coins)
+
+		report, err = ledger.Reconcile(db)
+		require.NoError(t, err)
+		assert.True(t, report.Clean())
+	})
+}
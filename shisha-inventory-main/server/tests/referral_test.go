@@ -0,0 +1,151 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"server/internal/controllers"
+	"server/internal/database"
+	"server/internal/economy"
+	"server/internal/models"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupTestAppReferrals(db *gorm.DB, tm *controllers.TokenManager, rf *controllers.Referrals) *fiber.App {
+	database.DB = db
+	app := fiber.New()
+
+	app.Post("/register", controllers.Register(rf))
+	app.Get("/referrals", controllers.AuthRequired(tm), rf.List)
+	app.Post("/referrals/codes", controllers.AuthRequired(tm), rf.CreateCode)
+	app.Delete("/referrals/codes/:code", controllers.AuthRequired(tm), rf.RevokeCode)
+
+	return app
+}
+
+func TestReferrals(t *testing.T) {
+	ctx := context.Background()
+	dsn, teardown, err := setupPostgres(ctx)
+	require.NoError(t, err)
+	defer teardown()
+
+	rdb, teardownRedis, err := setupRedis(ctx)
+	require.NoError(t, err)
+	defer teardownRedis()
+
+	db, err := setupDatabase(dsn)
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.InviteCode{}, &models.Referral{}).Error)
+	require.NoError(t, economy.Seed(db, economy.Default))
+
+	tm := newTestTokenManager(rdb)
+	app := setupTestAppReferrals(db, tm, controllers.NewReferrals(2))
+
+	send := func(method, path, token, payload string) (int, []byte) {
+		req, _ := http.NewRequest(method, path, strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := app.Test(req, -1)
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, body
+	}
+	register := func(username, code string) int {
+		status, _ := send("POST", "/register", "", fmt.Sprintf(`{"username":%q,"password":"password","invite_code":%q}`, username, code))
+		return status
+	}
+	referral := func(t *testing.T, invitee string) models.Referral {
+		var referral models.Referral
+		require.NoError(t, db.Where("invitee = ?", invitee).First(&referral).Error)
+		return referral
+	}
+	coins := func(username string) int {
+		var user models.User
+		db.Where("username = ?", username).First(&user)
+		return user.Coins
+	}
+
+	require.Equal(t, fiber.StatusOK, register("host", ""))
+	host := newTestToken(t, tm, "host")
+	status, body := send("POST", "/referrals/codes", host, "")
+	require.Equal(t, fiber.StatusCreated, status)
+	var code models.InviteCode
+	require.NoError(t, json.Unmarshal(body, &code))
+
+	t.Run("Bonuses wait for a first upload", func(t *testing.T) {
+		require.Equal(t, fiber.StatusOK, register("guest", strings.ToLower(code.Code)))
+		assert.Equal(t, models.ReferralPending, referral(t, "guest").Status)
+		assert.Equal(t, 100, coins("guest"))
+
+		require.NoError(t, controllers.QualifyReferral(db, "guest"))
+		assert.Equal(t, models.ReferralRewarded, referral(t, "guest").Status)
+		assert.Equal(t, 150, coins("host"))
+		assert.Equal(t, 125, coins("guest"))
+
+		// Later uploads pay nothing more
+		require.NoError(t, controllers.QualifyReferral(db, "guest"))
+		assert.Equal(t, 150, coins("host"))
+	})
+
+	t.Run("Per IP limit", func(t *testing.T) {
+		// guest already registered from this IP
+		require.Equal(t, fiber.StatusOK, register("second", code.Code))
+		assert.Equal(t, models.ReferralPending, referral(t, "second").Status)
+		require.Equal(t, fiber.StatusOK, register("third", code.Code))
+		rejected := referral(t, "third")
+		assert.Equal(t, models.ReferralRejected, rejected.Status)
+		assert.Equal(t, "ip_limit", rejected.RejectReason)
+
+		require.NoError(t, controllers.QualifyReferral(db, "third"))
+		assert.Equal(t, 100, coins("third"))
+	})
+
+	t.Run("Self referral", func(t *testing.T) {
+		// Checked before the IP limit, which this IP has reached already
+		var inviter models.User
+		require.NoError(t, db.Where("username = ?", "host").First(&inviter).Error)
+		require.NoError(t, db.Create(&models.Session{ID: "8c5f5f8e-3a43-4a43-9a5e-1b8f0c7c1f01", UserID: inviter.ID, IP: "0.0.0.0"}).Error)
+
+		require.Equal(t, fiber.StatusOK, register("sockpuppet", code.Code))
+		rejected := referral(t, "sockpuppet")
+		assert.Equal(t, models.ReferralRejected, rejected.Status)
+		assert.Equal(t, "self_referral", rejected.RejectReason)
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		status, body := send("GET", "/referrals", host, "")
+		require.Equal(t, fiber.StatusOK, status)
+		var response struct {
+			Codes []models.InviteCode `json:"codes"`
+			Stats map[string]int      `json:"stats"`
+		}
+		require.NoError(t, json.Unmarshal(body, &response))
+		assert.Len(t, response.Codes, 1)
+		assert.Equal(t, 4, response.Stats["invited"])
+		assert.Equal(t, 1, response.Stats[models.ReferralRewarded])
+		assert.Equal(t, 1, response.Stats[models.ReferralPending])
+		assert.Equal(t, 2, response.Stats[models.ReferralRejected])
+		assert.Equal(t, 50, response.Stats["earned"])
+	})
+
+	t.Run("Revoked and unknown codes", func(t *testing.T) {
+		status, _ := send("DELETE", "/referrals/codes/"+code.Code, host, "")
+		assert.Equal(t, fiber.StatusOK, status)
+		assert.Equal(t, fiber.StatusBadRequest, register("latecomer", code.Code))
+		assert.Equal(t, fiber.StatusBadRequest, register("latecomer", "NOSUCHCODE"))
+
+		var count int
+		db.Model(&models.User{}).Where("username = ?", "latecomer").Count(&count)
+		assert.Equal(t, 0, count)
+	})
+}
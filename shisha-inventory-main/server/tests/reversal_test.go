@@ -0,0 +1,171 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"server/internal/controllers"
+	"server/internal/database"
+	"server/internal/ledger"
+	"server/internal/models"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupTestAppReversals(db *gorm.DB, tm *controllers.TokenManager) *fiber.App {
+	database.DB = db
+	app := fiber.New()
+	imageController := controllers.NewImageController(db, nil, context.Background(), "")
+
+	app.Post("/purchase", controllers.AuthRequired(tm), imageController.PurchaseImage("shisha", []string{"redpanda:9092"}, nil))
+	app.Get("/purchased-images", controllers.AuthRequired(tm), imageController.GetPurchasedImageIDs)
+	app.Post("/admin/transfers/:id/reverse", controllers.AuthRequired(tm), controllers.RoleRequired(models.RoleAdmin), controllers.ReverseTransfer("shisha", []string{"redpanda:9092"}))
+	app.Post("/admin/purchases/:id/refund", controllers.AuthRequired(tm), controllers.RoleRequired(models.RoleAdmin), controllers.RefundPurchase("shisha", []string{"redpanda:9092"}))
+
+	return app
+}
+
+func TestReversals(t *testing.T) {
+	ctx := context.Background()
+	dsn, teardown, err := setupPostgres(ctx)
+	require.NoError(t, err)
+	defer teardown()
+
+	rdb, teardownRedis, err := setupRedis(ctx)
+	require.NoError(t, err)
+	defer teardownRedis()
+
+	db, err := setupDatabase(dsn)
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.PremiumImage{}, &models.Purchase{}, &models.Transfer{}, &models.Reversal{}).Error)
+	require.NoError(t, database.MigratePurchases(db))
+
+	tm := newTestTokenManager(rdb)
+	app := setupTestAppReversals(db, tm)
+
+	newUser := func(t *testing.T, username string, coins int) string {
+		require.NoError(t, db.Create(&models.User{Username: username, Password: "password"}).Error)
+		_, err := ledger.Move(db, nil, ledger.AccountMint, ledger.UserAccount(username), coins, ledger.ReasonSignupBonus, "")
+		require.NoError(t, err)
+		return newTestToken(t, tm, username)
+	}
+	send := func(method, path, token, payload string) (int, string) {
+		req, _ := http.NewRequest(method, path, strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := app.Test(req, -1)
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	coins := func(username string) int {
+		var user models.User
+		db.Where("username = ?", username).First(&user)
+		return user.Coins
+	}
+
+	alice := newUser(t, "alice", 100)
+	newUser(t, "bob", 0)
+	require.NoError(t, db.Create(&models.User{Username: "admin", Password: "password", Role: models.RoleAdmin}).Error)
+	admin := newTestToken(t, tm, "admin")
+
+	t.Run("Reverse a transfer", func(t *testing.T) {
+		transfer, err := ledger.Transfer(db, "alice", "bob", 30, "oops")
+		require.NoError(t, err)
+
+		path := fmt.Sprintf("/admin/transfers/%d/reverse", transfer.ID)
+		status, _ := send("POST", path, alice, `{"reason":"mistake"}`)
+		assert.Equal(t, fiber.StatusForbidden, status)
+
+		status, body := send("POST", path, admin, `{"reason":"mistake"}`)
+		require.Equal(t, fiber.StatusOK, status, body)
+		assert.Equal(t, 100, coins("alice"))
+		assert.Equal(t, 0, coins("bob"))
+
+		var stored models.Transfer
+		require.NoError(t, db.First(&stored, transfer.ID).Error)
+		require.NotNil(t, stored.ReversalID)
+		var reversal models.Reversal
+		require.NoError(t, db.First(&reversal, *stored.ReversalID).Error)
+		assert.Equal(t, "admin", reversal.Admin)
+		assert.Equal(t, 30, reversal.Amount)
+
+		status, _ = send("POST", path, admin, `{"reason":"mistake"}`)
+		assert.Equal(t, fiber.StatusConflict, status)
+		assert.Equal(t, 100, coins("alice"))
+	})
+
+	t.Run("Spent coins cannot be reversed", func(t *testing.T) {
+		transfer, err := ledger.Transfer(db, "alice", "bob", 20, "")
+		require.NoError(t, err)
+		_, err = ledger.Transfer(db, "bob", "alice", 20, "")
+		require.NoError(t, err)
+
+		status, _ := send("POST", fmt.Sprintf("/admin/transfers/%d/reverse", transfer.ID), admin, `{"reason":"mistake"}`)
+		assert.Equal(t, fiber.StatusConflict, status)
+		assert.Equal(t, 100, coins("alice"))
+	})
+
+	t.Run("Unknown transfer", func(t *testing.T) {
+		status, _ := send("POST", "/admin/transfers/9999/reverse", admin, `{"reason":"mistake"}`)
+		assert.Equal(t, fiber.StatusNotFound, status)
+	})
+
+	t.Run("Refund revokes the image", func(t *testing.T) {
+		image := models.PremiumImage{Name: "shishka", Hash: "refund", Price: 40}
+		require.NoError(t, db.Create(&image).Error)
+
+		status, _ := send("POST", "/purchase", alice, fmt.Sprintf(`{"image_id":%d}`, image.ID))
+		require.Equal(t, fiber.StatusOK, status)
+		assert.Equal(t, 60, coins("alice"))
+
+		var purchase models.Purchase
+		require.NoError(t, db.Where("user_name = ? AND image_id = ?", "alice", image.ID).First(&purchase).Error)
+
+		status, body := send("POST", fmt.Sprintf("/admin/purchases/%d/refund", purchase.ID), admin, `{"reason":"disputed"}`)
+		require.Equal(t, fiber.StatusOK, status, body)
+		assert.Equal(t, 100, coins("alice"))
+		balance, err := ledger.Balance(db, ledger.AccountShop)
+		require.NoError(t, err)
+		assert.Equal(t, 0, balance)
+
+		_, body = send("GET", "/purchased-images", alice, "")
+		assert.NotContains(t, body, purchase.ImageUUID)
+
+		status, _ = send("POST", fmt.Sprintf("/admin/purchases/%d/refund", purchase.ID), admin, `{"reason":"disputed"}`)
+		assert.Equal(t, fiber.StatusConflict, status)
+
+		// The refunded purchase is kept and the image can be bought again
+		status, _ = send("POST", "/purchase", alice, fmt.Sprintf(`{"image_id":%d}`, image.ID))
+		assert.Equal(t, fiber.StatusOK, status)
+		assert.Equal(t, 60, coins("alice"))
+		var count int
+		db.Model(&models.Purchase{}).Where("user_name = ?", "alice").Count(&count)
+		assert.Equal(t, 2, count)
+	})
+
+	t.Run("Refund of a purchase made before the ledger", func(t *testing.T) {
+		purchase := models.Purchase{UserName: "bob", ImageID: 9999, ImageName: "legacy", Hash: "legacy"}
+		require.NoError(t, db.Create(&purchase).Error)
+
+		status, body := send("POST", fmt.Sprintf("/admin/purchases/%d/refund", purchase.ID), admin, `{"reason":"disputed"}`)
+		require.Equal(t, fiber.StatusOK, status, body)
+		assert.Equal(t, 0, coins("bob"))
+
+		var reversal models.Reversal
+		require.NoError(t, db.Where("purchase_id = ?", purchase.ID).First(&reversal).Error)
+		assert.Equal(t, 0, reversal.Amount)
+		assert.Nil(t, reversal.LedgerTxID)
+	})
+
+	t.Run("A reason is required", func(t *testing.T) {
+		status, _ := send("POST", "/admin/purchases/1/refund", admin, `{}`)
+		assert.Equal(t, fiber.StatusBadRequest, status)
+	})
+}
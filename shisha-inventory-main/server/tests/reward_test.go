@@ -0,0 +1,117 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"server/internal/controllers"
+	"server/internal/database"
+	"server/internal/economy"
+	"server/internal/models"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupTestAppRewards(db *gorm.DB, tm *controllers.TokenManager, dr *controllers.DailyRewards) *fiber.App {
+	database.DB = db
+	app := fiber.New()
+
+	app.Get("/rewards/daily", controllers.AuthRequired(tm), dr.Status)
+	app.Post("/rewards/daily", controllers.AuthRequired(tm), dr.Claim)
+
+	return app
+}
+
+func TestDailyRewards(t *testing.T) {
+	ctx := context.Background()
+	dsn, teardown, err := setupPostgres(ctx)
+	require.NoError(t, err)
+	defer teardown()
+
+	rdb, teardownRedis, err := setupRedis(ctx)
+	require.NoError(t, err)
+	defer teardownRedis()
+
+	db, err := setupDatabase(dsn)
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.DailyReward{}).Error)
+	require.NoError(t, economy.Seed(db, models.EconomyPolicy{SignupBonus: 100, UploadReward: 1, PremiumPrice: 25, DailyReward: 5, DailyRewardStep: 5, DailyRewardMax: 15}))
+
+	location := time.FixedZone("JST", 9*60*60)
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, location)
+	tm := newTestTokenManager(rdb)
+	dr := controllers.NewDailyRewards([]string{"redpanda:9092"}, "shisha", location)
+	dr.Now = func() time.Time { return now }
+	app := setupTestAppRewards(db, tm, dr)
+
+	require.NoError(t, db.Create(&models.User{Username: "regular", Password: "password"}).Error)
+	token := newTestToken(t, tm, "regular")
+
+	send := func(method string) fiber.Map {
+		req, _ := http.NewRequest(method, "/rewards/daily", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := app.Test(req, -1)
+		require.NoError(t, err)
+		require.Equal(t, fiber.StatusOK, resp.StatusCode)
+		body, _ := io.ReadAll(resp.Body)
+		var response fiber.Map
+		require.NoError(t, json.Unmarshal(body, &response))
+		return response
+	}
+	coins := func() int {
+		var user models.User
+		db.Where("username = ?", "regular").First(&user)
+		return user.Coins
+	}
+
+	t.Run("Claims once per day", func(t *testing.T) {
+		status := send("GET")
+		assert.Equal(t, false, status["claimed"])
+		assert.Equal(t, float64(5), status["amount"])
+
+		claim := send("POST")
+		assert.Equal(t, float64(1), claim["streak"])
+		assert.Equal(t, false, claim["already_claimed"])
+		assert.Equal(t, 5, coins())
+
+		claim = send("POST")
+		assert.Equal(t, true, claim["already_claimed"])
+		assert.Equal(t, 5, coins())
+		assert.Equal(t, true, send("GET")["claimed"])
+	})
+
+	t.Run("Streak grows up to the cap", func(t *testing.T) {
+		for day, amount := range []int{10, 15, 15} {
+			now = time.Date(2024, time.March, 2+day, 9, 0, 0, 0, location)
+			claim := send("POST")
+			assert.Equal(t, float64(day+2), claim["streak"])
+			assert.Equal(t, float64(amount), claim["amount"])
+		}
+		assert.Equal(t, 45, coins())
+	})
+
+	t.Run("Days follow the reward timezone", func(t *testing.T) {
+		// Still March 4 in Tokyo, though already March 5 in UTC
+		now = time.Date(2024, time.March, 4, 23, 30, 0, 0, location)
+		assert.Equal(t, true, send("POST")["already_claimed"])
+
+		// March 5 in Tokyo, still March 4 in UTC
+		now = time.Date(2024, time.March, 5, 0, 30, 0, 0, location)
+		assert.Equal(t, float64(5), send("POST")["streak"])
+	})
+
+	t.Run("Missed days reset the streak", func(t *testing.T) {
+		now = time.Date(2024, time.March, 7, 12, 0, 0, 0, location)
+		assert.Equal(t, float64(0), send("GET")["streak"])
+
+		claim := send("POST")
+		assert.Equal(t, float64(1), claim["streak"])
+		assert.Equal(t, float64(5), claim["amount"])
+	})
+}
@@ -0,0 +1,206 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"server/internal/controllers"
+	"server/internal/database"
+	"server/internal/ledger"
+	"server/internal/models"
+	"server/internal/rules"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRulesFile(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		_, err := rules.Parse([]byte(`
+rules:
+  - name: big
+    type: max_amount
+    applies: [transfer]
+    max: 500
+  - name: daily
+    type: outgoing_limit
+    max: 1000
+    window: 24h
+  - name: new-accounts
+    type: min_account_age
+    min_age: 48h
+    action: hold
+  - name: bursts
+    type: velocity
+    max: 10
+    window: 10m
+  - name: rings
+    type: circular
+`))
+		assert.NoError(t, err)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, file := range []string{
+			"rules:\n  - type: max_amount\n    max: 1\n",
+			"rules:\n  - name: a\n    type: max_amount\n",
+			"rules:\n  - name: a\n    type: unknown\n",
+			"rules:\n  - name: a\n    type: max_amount\n    max: 1\n    action: shrug\n",
+			"rules:\n  - name: a\n    type: max_amount\n    max: 1\n    applies: [upload]\n",
+			"rules:\n  - name: a\n    type: min_account_age\n",
+			"rules:\n  - name: a\n    type: circular\n    depth: 1\n",
+			"rules:\n  - name: a\n    type: velocity\n    max: 1\n    window: soon\n",
+		} {
+			_, err := rules.Parse([]byte(file))
+			assert.Error(t, err, file)
+		}
+	})
+}
+
+func setupTestAppRules(db *gorm.DB, tm *controllers.TokenManager, rg *controllers.RuleGuard) *fiber.App {
+	database.DB = db
+	app := fiber.New()
+
+	app.Post("/transfer", controllers.AuthRequired(tm), controllers.Tranfser("shisha", []string{"redpanda:9092"}, context.Background(), nil, rg))
+	app.Get("/admin/rule-decisions", controllers.AuthRequired(tm), controllers.RoleRequired(models.RoleAdmin), controllers.ListRuleDecisions)
+	app.Post("/admin/rule-decisions/:id/approve", controllers.AuthRequired(tm), controllers.RoleRequired(models.RoleAdmin), controllers.ReviewRuleDecision(true))
+
+	return app
+}
+
+func TestTransferRules(t *testing.T) {
+	ctx := context.Background()
+	dsn, teardown, err := setupPostgres(ctx)
+	require.NoError(t, err)
+	defer teardown()
+
+	rdb, teardownRedis, err := setupRedis(ctx)
+	require.NoError(t, err)
+	defer teardownRedis()
+
+	db, err := setupDatabase(dsn)
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.Transfer{}, &models.RuleDecision{}).Error)
+
+	engine, err := rules.Parse([]byte(`
+rules:
+  - name: big
+    type: max_amount
+    max: 100
+  - name: daily
+    type: outgoing_limit
+    max: 150
+  - name: new-accounts
+    type: min_account_age
+    min_age: 1h
+    action: hold
+  - name: bursts
+    type: velocity
+    max: 5
+    window: 1m
+  - name: rings
+    type: circular
+    depth: 3
+`))
+	require.NoError(t, err)
+
+	tm := newTestTokenManager(rdb)
+	app := setupTestAppRules(db, tm, controllers.NewRuleGuard(engine, []string{"redpanda:9092"}, "shisha"))
+
+	newUser := func(t *testing.T, username string, age time.Duration) string {
+		user := models.User{Username: username, Password: "password"}
+		user.CreatedAt = time.Now().Add(-age)
+		require.NoError(t, db.Create(&user).Error)
+		_, err := ledger.Move(db, nil, ledger.AccountMint, ledger.UserAccount(username), 1000, ledger.ReasonSignupBonus, "")
+		require.NoError(t, err)
+		return newTestToken(t, tm, username)
+	}
+	transfer := func(token, to string, amount int) (int, fiber.Map) {
+		payload := fmt.Sprintf(`{"to_username":%q,"amount":%d}`, to, amount)
+		req, _ := http.NewRequest("POST", "/transfer", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := app.Test(req, -1)
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		var response fiber.Map
+		json.Unmarshal(body, &response)
+		return resp.StatusCode, response
+	}
+
+	day := 24 * time.Hour
+	alice := newUser(t, "alice", day)
+	bob := newUser(t, "bob", day)
+	carol := newUser(t, "carol", day)
+	newcomer := newUser(t, "newcomer", time.Minute)
+	require.NoError(t, db.Create(&models.User{Username: "admin", Password: "password", Role: models.RoleAdmin}).Error)
+	admin := newTestToken(t, tm, "admin")
+
+	t.Run("Per transfer maximum", func(t *testing.T) {
+		status, response := transfer(alice, "bob", 101)
+		assert.Equal(t, fiber.StatusForbidden, status)
+		assert.Equal(t, "big", response["rule"])
+
+		var decision models.RuleDecision
+		require.NoError(t, db.Where("username = ?", "alice").Last(&decision).Error)
+		assert.Equal(t, string(rules.Deny), decision.Action)
+	})
+
+	t.Run("Daily outgoing limit", func(t *testing.T) {
+		status, _ := transfer(alice, "bob", 100)
+		assert.Equal(t, fiber.StatusOK, status)
+		status, response := transfer(alice, "bob", 60)
+		assert.Equal(t, fiber.StatusForbidden, status)
+		assert.Equal(t, "daily", response["rule"])
+		status, _ = transfer(alice, "bob", 50)
+		assert.Equal(t, fiber.StatusOK, status)
+	})
+
+	t.Run("Circular transfers", func(t *testing.T) {
+		status, _ := transfer(bob, "carol", 10)
+		assert.Equal(t, fiber.StatusOK, status)
+		// alice -> bob -> carol -> alice
+		status, response := transfer(carol, "alice", 10)
+		assert.Equal(t, fiber.StatusForbidden, status)
+		assert.Equal(t, "rings", response["rule"])
+	})
+
+	t.Run("Velocity", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			status, _ := transfer(carol, "newcomer", 1)
+			assert.Equal(t, fiber.StatusOK, status)
+		}
+		status, response := transfer(carol, "newcomer", 1)
+		assert.Equal(t, fiber.StatusForbidden, status)
+		assert.Equal(t, "bursts", response["rule"])
+	})
+
+	t.Run("New accounts are held for review", func(t *testing.T) {
+		status, response := transfer(newcomer, "alice", 20)
+		assert.Equal(t, fiber.StatusAccepted, status)
+		assert.Equal(t, "new-accounts", response["rule"])
+
+		var balance models.User
+		db.Where("username = ?", "newcomer").First(&balance)
+		assert.Equal(t, 1005, balance.Coins)
+
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/admin/rule-decisions/%v/approve", response["decision_id"]), nil)
+		req.Header.Set("Authorization", "Bearer "+admin)
+		resp, err := app.Test(req, -1)
+		require.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+		// The approval lets the same transfer through once
+		status, _ = transfer(newcomer, "alice", 20)
+		assert.Equal(t, fiber.StatusOK, status)
+		status, _ = transfer(newcomer, "alice", 20)
+		assert.Equal(t, fiber.StatusAccepted, status)
+	})
+}
@@ -0,0 +1,80 @@
+package tests
+
+import (
+	"server/internal/schedule"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchedule(t *testing.T) {
+	start := time.Date(2024, time.January, 31, 9, 0, 0, 0, time.UTC)
+	next := func(t *testing.T, recurrence, expr string, after time.Time) time.Time {
+		s, err := schedule.Parse(recurrence, expr, start)
+		require.NoError(t, err)
+		return s.Next(after)
+	}
+
+	t.Run("Once", func(t *testing.T) {
+		assert.Equal(t, start, next(t, schedule.Once, "", start.Add(-time.Second)))
+		assert.True(t, next(t, schedule.Once, "", start).IsZero())
+	})
+
+	t.Run("Daily and weekly keep the time of day", func(t *testing.T) {
+		assert.Equal(t, start.AddDate(0, 0, 1), next(t, schedule.Daily, "", start))
+		assert.Equal(t, start.AddDate(0, 0, 3), next(t, schedule.Daily, "", start.AddDate(0, 0, 2).Add(time.Hour)))
+		assert.Equal(t, start.AddDate(0, 0, 14), next(t, schedule.Weekly, "", start.AddDate(0, 0, 8)))
+	})
+
+	t.Run("Daily across daylight saving", func(t *testing.T) {
+		berlin, err := time.LoadLocation("Europe/Berlin")
+		if err != nil {
+			t.Skip("no time zone data")
+		}
+		local := time.Date(2024, time.March, 30, 9, 0, 0, 0, berlin)
+		s, err := schedule.Parse(schedule.Daily, "", local)
+		require.NoError(t, err)
+		assert.Equal(t, time.Date(2024, time.April, 1, 9, 0, 0, 0, berlin), s.Next(local.Add(25*time.Hour)))
+	})
+
+	t.Run("Monthly clamps to the end of short months", func(t *testing.T) {
+		assert.Equal(t, time.Date(2024, time.February, 29, 9, 0, 0, 0, time.UTC), next(t, schedule.Monthly, "", start))
+		assert.Equal(t, time.Date(2024, time.March, 31, 9, 0, 0, 0, time.UTC), next(t, schedule.Monthly, "", time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)))
+		assert.Equal(t, time.Date(2024, time.April, 30, 9, 0, 0, 0, time.UTC), next(t, schedule.Monthly, "", time.Date(2024, time.March, 31, 9, 0, 0, 0, time.UTC)))
+	})
+
+	t.Run("Cron", func(t *testing.T) {
+		cases := []struct {
+			expr  string
+			after time.Time
+			want  time.Time
+		}{
+			{"*/15 * * * *", start.Add(time.Minute), start.Add(15 * time.Minute)},
+			{"0 9 * * 1-5", start, time.Date(2024, time.February, 1, 9, 0, 0, 0, time.UTC)},
+			{"0 9 * * 1-5", time.Date(2024, time.February, 2, 9, 0, 0, 0, time.UTC), time.Date(2024, time.February, 5, 9, 0, 0, 0, time.UTC)},
+			{"30 8 1 * *", start, time.Date(2024, time.February, 1, 8, 30, 0, 0, time.UTC)},
+			{"0 0 29 2 *", start, time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+			{"0 12 * * 7", start, time.Date(2024, time.February, 4, 12, 0, 0, 0, time.UTC)},
+			// Day of month or day of week when both are restricted
+			{"0 0 15 * 5", start, time.Date(2024, time.February, 2, 0, 0, 0, 0, time.UTC)},
+		}
+		for _, c := range cases {
+			assert.Equal(t, c.want, next(t, schedule.Cron, c.expr, c.after), c.expr)
+		}
+
+		s, err := schedule.ParseCron("0 0 30 2 *")
+		require.NoError(t, err)
+		assert.True(t, s.Next(start).IsZero())
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+			_, err := schedule.Parse(schedule.Cron, expr, start)
+			assert.Error(t, err, expr)
+		}
+		_, err := schedule.Parse("hourly", "", start)
+		assert.ErrorIs(t, err, schedule.ErrUnknownRecurrence)
+	})
+}
@@ -0,0 +1,196 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"server/internal/controllers"
+	"server/internal/database"
+	"server/internal/ledger"
+	"server/internal/models"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupTestAppScheduledTransfers(db *gorm.DB, tm *controllers.TokenManager, st *controllers.ScheduledTransfers) *fiber.App {
+	database.DB = db
+	app := fiber.New()
+
+	app.Post("/scheduled-transfers", controllers.AuthRequired(tm), st.Create)
+	app.Get("/scheduled-transfers", controllers.AuthRequired(tm), st.List)
+	app.Get("/scheduled-transfers/:id/runs", controllers.AuthRequired(tm), st.Runs)
+	app.Delete("/scheduled-transfers/:id", controllers.AuthRequired(tm), st.Cancel)
+
+	return app
+}
+
+func TestScheduledTransfers(t *testing.T) {
+	ctx := context.Background()
+	dsn, teardown, err := setupPostgres(ctx)
+	require.NoError(t, err)
+	defer teardown()
+
+	rdb, teardownRedis, err := setupRedis(ctx)
+	require.NoError(t, err)
+	defer teardownRedis()
+
+	db, err := setupDatabase(dsn)
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.Transfer{}, &models.ScheduledTransfer{}, &models.ScheduledTransferRun{}).Error)
+	db.DB().SetMaxOpenConns(20)
+
+	tm := newTestTokenManager(rdb)
+	st := controllers.NewScheduledTransfers([]string{"redpanda:9092"}, "shisha", nil, nil)
+	app := setupTestAppScheduledTransfers(db, tm, st)
+
+	newUser := func(t *testing.T, username string, coins int) string {
+		require.NoError(t, db.Create(&models.User{Username: username, Password: "password"}).Error)
+		_, err := ledger.Move(db, nil, ledger.AccountMint, ledger.UserAccount(username), coins, ledger.ReasonSignupBonus, "")
+		require.NoError(t, err)
+		return newTestToken(t, tm, username)
+	}
+	send := func(method, path, token, payload string) (int, []byte) {
+		req, _ := http.NewRequest(method, path, strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Error(err)
+			return 0, nil
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, body
+	}
+	create := func(t *testing.T, token, payload string) models.ScheduledTransfer {
+		status, body := send("POST", "/scheduled-transfers", token, payload)
+		require.Equal(t, fiber.StatusCreated, status, string(body))
+		var scheduled models.ScheduledTransfer
+		require.NoError(t, json.Unmarshal(body, &scheduled))
+		return scheduled
+	}
+	runs := func(t *testing.T, token string, id uint) []models.ScheduledTransferRun {
+		status, body := send("GET", fmt.Sprintf("/scheduled-transfers/%d/runs", id), token, "")
+		require.Equal(t, fiber.StatusOK, status)
+		var page struct {
+			Runs []models.ScheduledTransferRun `json:"runs"`
+		}
+		require.NoError(t, json.Unmarshal(body, &page))
+		return page.Runs
+	}
+	coins := func(username string) int {
+		var user models.User
+		db.Where("username = ?", username).First(&user)
+		return user.Coins
+	}
+
+	team := newUser(t, "team", 100)
+	newUser(t, "member", 0)
+
+	t.Run("Daily allowance", func(t *testing.T) {
+		now := time.Now()
+		scheduled := create(t, team, `{"to_username":"member","amount":10,"memo":"allowance","recurrence":"daily"}`)
+
+		ran, err := st.RunDue(now.Add(time.Second))
+		require.NoError(t, err)
+		assert.Equal(t, 1, ran)
+		assert.Equal(t, 10, coins("member"))
+
+		// Not due again before tomorrow
+		ran, err = st.RunDue(now.Add(time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, 0, ran)
+
+		ran, err = st.RunDue(now.Add(25 * time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, 1, ran)
+		assert.Equal(t, 20, coins("member"))
+		assert.Equal(t, 80, coins("team"))
+
+		history := runs(t, team, scheduled.ID)
+		require.Len(t, history, 2)
+		assert.Equal(t, models.ScheduledRunSucceeded, history[0].Status)
+		assert.NotNil(t, history[0].TransferID)
+
+		status, _ := send("DELETE", fmt.Sprintf("/scheduled-transfers/%d", scheduled.ID), team, "")
+		assert.Equal(t, fiber.StatusOK, status)
+		ran, err = st.RunDue(now.Add(49 * time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, 0, ran)
+	})
+
+	t.Run("Failed runs are recorded", func(t *testing.T) {
+		start := time.Now().Add(time.Minute).UTC().Format(time.RFC3339)
+		scheduled := create(t, team, fmt.Sprintf(`{"to_username":"member","amount":1000,"recurrence":"once","start_at":%q}`, start))
+
+		ran, err := st.RunDue(time.Now().Add(2 * time.Minute))
+		require.NoError(t, err)
+		assert.Equal(t, 1, ran)
+		assert.Equal(t, 80, coins("team"))
+
+		history := runs(t, team, scheduled.ID)
+		require.Len(t, history, 1)
+		assert.Equal(t, models.ScheduledRunFailed, history[0].Status)
+		assert.Equal(t, ledger.ErrInsufficientFunds.Error(), history[0].Error)
+		assert.Nil(t, history[0].TransferID)
+
+		var stored models.ScheduledTransfer
+		require.NoError(t, db.First(&stored, scheduled.ID).Error)
+		assert.Equal(t, models.ScheduledTransferCompleted, stored.Status)
+		assert.Nil(t, stored.NextRunAt)
+	})
+
+	t.Run("Replicas run each transfer once", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			create(t, team, `{"to_username":"member","amount":1,"recurrence":"cron","cron":"* * * * *"}`)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := st.RunDue(time.Now().Add(time.Minute))
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, 75, coins("team"))
+		assert.Equal(t, 25, coins("member"))
+	})
+
+	t.Run("Invalid schedules", func(t *testing.T) {
+		for _, payload := range []string{
+			`{"to_username":"member","amount":1,"recurrence":"hourly"}`,
+			`{"to_username":"member","amount":1,"recurrence":"cron","cron":"* * *"}`,
+			`{"to_username":"member","amount":1,"recurrence":"once"}`,
+			`{"to_username":"member","amount":1,"recurrence":"once","start_at":"2001-01-01T00:00:00Z"}`,
+			`{"to_username":"team","amount":1,"recurrence":"daily"}`,
+			`{"to_username":"member","amount":1,"recurrence":"daily","time_zone":"Mars/Olympus"}`,
+		} {
+			status, _ := send("POST", "/scheduled-transfers", team, payload)
+			assert.Equal(t, fiber.StatusBadRequest, status, payload)
+		}
+	})
+
+	t.Run("Runs keep the wall clock time across daylight saving", func(t *testing.T) {
+		// The day before clocks go forward in Berlin
+		scheduled := create(t, team, `{"to_username":"member","amount":1,"recurrence":"daily","start_at":"2030-03-30T09:00:00+01:00","time_zone":"Europe/Berlin"}`)
+		assert.Equal(t, "Europe/Berlin", scheduled.TimeZone)
+
+		_, err := st.RunDue(time.Date(2030, time.March, 30, 8, 0, 30, 0, time.UTC))
+		require.NoError(t, err)
+		require.NoError(t, db.First(&scheduled, scheduled.ID).Error)
+		require.NotNil(t, scheduled.NextRunAt)
+		assert.True(t, scheduled.NextRunAt.Equal(time.Date(2030, time.March, 31, 7, 0, 0, 0, time.UTC)), scheduled.NextRunAt)
+	})
+}
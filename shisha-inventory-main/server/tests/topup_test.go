@@ -0,0 +1,241 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"server/internal/controllers"
+	"server/internal/database"
+	"server/internal/ledger"
+	"server/internal/models"
+	"server/internal/payments"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeProviderSignature(t *testing.T) {
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	provider := payments.NewFakeProvider("whsec", "http://checkout", "http://webhook")
+	provider.Now = func() time.Time { return now }
+
+	body, signature, err := provider.Webhook("pi_1", payments.StatusSucceeded)
+	require.NoError(t, err)
+	header := func(value string) func(string) string {
+		return func(name string) string {
+			if name == payments.FakeSignatureHeader {
+				return value
+			}
+			return ""
+		}
+	}
+
+	t.Run("Valid signature", func(t *testing.T) {
+		event, err := provider.ParseWebhook(body, header(signature))
+		require.NoError(t, err)
+		assert.Equal(t, "pi_1", event.IntentID)
+		assert.Equal(t, payments.StatusSucceeded, event.Status)
+		assert.NotEmpty(t, event.ID)
+	})
+
+	t.Run("Tampered body", func(t *testing.T) {
+		tampered := bytes.Replace(body, []byte("pi_1"), []byte("pi_2"), 1)
+		_, err := provider.ParseWebhook(tampered, header(signature))
+		assert.Equal(t, payments.ErrInvalidSignature, err)
+	})
+
+	t.Run("Missing signature", func(t *testing.T) {
+		_, err := provider.ParseWebhook(body, header(""))
+		assert.Equal(t, payments.ErrInvalidSignature, err)
+	})
+
+	t.Run("Other secret", func(t *testing.T) {
+		other := payments.NewFakeProvider("other", "http://checkout", "http://webhook")
+		other.Now = provider.Now
+		_, err := other.ParseWebhook(body, header(signature))
+		assert.Equal(t, payments.ErrInvalidSignature, err)
+	})
+
+	t.Run("Expired webhook", func(t *testing.T) {
+		later := payments.NewFakeProvider("whsec", "http://checkout", "http://webhook")
+		later.Now = func() time.Time { return now.Add(10 * time.Minute) }
+		_, err := later.ParseWebhook(body, header(signature))
+		assert.Equal(t, payments.ErrInvalidSignature, err)
+	})
+}
+
+func setupTestAppTopUps(db *gorm.DB, tm *controllers.TokenManager, tu *controllers.TopUps) *fiber.App {
+	database.DB = db
+	app := fiber.New()
+
+	app.Post("/topups", controllers.AuthRequired(tm), tu.Create)
+	app.Get("/topups", controllers.AuthRequired(tm), tu.List)
+	app.Post("/topups/webhook", tu.Webhook)
+
+	return app
+}
+
+func TestTopUps(t *testing.T) {
+	ctx := context.Background()
+	dsn, teardown, err := setupPostgres(ctx)
+	require.NoError(t, err)
+	defer teardown()
+
+	rdb, teardownRedis, err := setupRedis(ctx)
+	require.NoError(t, err)
+	defer teardownRedis()
+
+	db, err := setupDatabase(dsn)
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.TopUp{}).Error)
+
+	tm := newTestTokenManager(rdb)
+	provider := payments.NewFakeProvider("whsec", "http://checkout", "http://webhook")
+	tu := controllers.NewTopUps(provider, 2, "EUR", []string{"redpanda:9092"}, "shisha")
+	app := setupTestAppTopUps(db, tm, tu)
+
+	require.NoError(t, db.Create(&models.User{Username: "buyer", Password: "password"}).Error)
+	token := newTestToken(t, tm, "buyer")
+
+	create := func(coins int) (int, fiber.Map) {
+		req, _ := http.NewRequest("POST", "/topups", strings.NewReader(fmt.Sprintf(`{"coins":%d}`, coins)))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := app.Test(req, -1)
+		require.NoError(t, err)
+		var body fiber.Map
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body
+	}
+	deliver := func(body []byte, signature string) int {
+		req, _ := http.NewRequest("POST", "/topups/webhook", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(payments.FakeSignatureHeader, signature)
+		resp, err := app.Test(req, -1)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+	intentOf := func(body fiber.Map) string {
+		return strings.TrimPrefix(body["redirect_url"].(string), "http://checkout/")
+	}
+	coins := func() int {
+		var user models.User
+		db.Where("username = ?", "buyer").First(&user)
+		return user.Coins
+	}
+
+	t.Run("Rejects invalid amounts", func(t *testing.T) {
+		status, _ := create(0)
+		assert.Equal(t, fiber.StatusBadRequest, status)
+		status, _ = create(100001)
+		assert.Equal(t, fiber.StatusBadRequest, status)
+	})
+
+	t.Run("Webhook credits once", func(t *testing.T) {
+		status, body := create(50)
+		require.Equal(t, fiber.StatusCreated, status)
+		assert.True(t, strings.HasPrefix(intentOf(body), "pi_"))
+		assert.Equal(t, float64(100), body["top_up"].(map[string]interface{})["price"])
+		assert.Equal(t, 0, coins())
+
+		webhook, signature, err := provider.Webhook(intentOf(body), payments.StatusSucceeded)
+		require.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, deliver(webhook, signature))
+		assert.Equal(t, 50, coins())
+
+		// Providers redeliver, the top-up is settled already
+		assert.Equal(t, fiber.StatusOK, deliver(webhook, signature))
+		webhook, signature, err = provider.Webhook(intentOf(body), payments.StatusSucceeded)
+		require.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, deliver(webhook, signature))
+		assert.Equal(t, 50, coins())
+
+		var topUp models.TopUp
+		require.NoError(t, db.Where("intent_id = ?", intentOf(body)).First(&topUp).Error)
+		assert.Equal(t, models.TopUpSucceeded, topUp.Status)
+		assert.NotEmpty(t, topUp.LedgerTxID)
+		assert.NotNil(t, topUp.CompletedAt)
+
+		balance, err := ledger.Balance(db, ledger.AccountPayments)
+		require.NoError(t, err)
+		assert.Equal(t, -50, balance)
+
+		var pending models.TopUp
+		_, body = create(5)
+		require.NoError(t, db.Where("intent_id = ?", intentOf(body)).First(&pending).Error)
+		assert.Equal(t, models.TopUpPending, pending.Status)
+		assert.Nil(t, pending.LedgerTxID)
+	})
+
+	t.Run("Invalid signature credits nothing", func(t *testing.T) {
+		_, body := create(10)
+		webhook, _, err := provider.Webhook(intentOf(body), payments.StatusSucceeded)
+		require.NoError(t, err)
+		assert.Equal(t, fiber.StatusUnauthorized, deliver(webhook, "t=1,v1=00"))
+		assert.Equal(t, 50, coins())
+	})
+
+	t.Run("Failed payment credits nothing", func(t *testing.T) {
+		_, body := create(20)
+		webhook, signature, err := provider.Webhook(intentOf(body), payments.StatusFailed)
+		require.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, deliver(webhook, signature))
+		assert.Equal(t, 50, coins())
+
+		var topUp models.TopUp
+		require.NoError(t, db.Where("intent_id = ?", intentOf(body)).First(&topUp).Error)
+		assert.Equal(t, models.TopUpFailed, topUp.Status)
+		assert.Nil(t, topUp.LedgerTxID)
+	})
+
+	t.Run("Successful retry after a failed attempt credits once", func(t *testing.T) {
+		_, body := create(30)
+		failed, failedSignature, err := provider.Webhook(intentOf(body), payments.StatusFailed)
+		require.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, deliver(failed, failedSignature))
+		assert.Equal(t, 50, coins())
+
+		webhook, signature, err := provider.Webhook(intentOf(body), payments.StatusSucceeded)
+		require.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, deliver(webhook, signature))
+		assert.Equal(t, 80, coins())
+
+		// A late redelivery of the failure does not undo the credit
+		assert.Equal(t, fiber.StatusOK, deliver(failed, failedSignature))
+		assert.Equal(t, fiber.StatusOK, deliver(webhook, signature))
+		assert.Equal(t, 80, coins())
+
+		var topUp models.TopUp
+		require.NoError(t, db.Where("intent_id = ?", intentOf(body)).First(&topUp).Error)
+		assert.Equal(t, models.TopUpSucceeded, topUp.Status)
+	})
+
+	t.Run("Unknown intent", func(t *testing.T) {
+		webhook, signature, err := provider.Webhook("pi_unknown", payments.StatusSucceeded)
+		require.NoError(t, err)
+		assert.Equal(t, fiber.StatusNotFound, deliver(webhook, signature))
+	})
+
+	t.Run("Lists top-ups", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/topups?limit=2", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := app.Test(req, -1)
+		require.NoError(t, err)
+		var body struct {
+			TopUps []models.TopUp `json:"top_ups"`
+			Next   uint           `json:"next"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		require.Len(t, body.TopUps, 2)
+		assert.Equal(t, models.TopUpSucceeded, body.TopUps[0].Status)
+		assert.Equal(t, models.TopUpFailed, body.TopUps[1].Status)
+		assert.Equal(t, body.TopUps[1].ID, body.Next)
+	})
+}
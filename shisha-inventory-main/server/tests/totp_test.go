@@ -0,0 +1,53 @@
+package tests
+
+import (
+	"server/internal/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238 appendix B, SHA1 secret "12345678901234567890", truncated to 6 digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+
+	t.Run("RFC 6238 vectors", func(t *testing.T) {
+		for ts, want := range vectors {
+			code, err := models.TOTPCode(secret, time.Unix(ts, 0))
+			require.NoError(t, err)
+			assert.Equal(t, want, code, "time %d", ts)
+		}
+	})
+
+	t.Run("Validate accepts adjacent periods", func(t *testing.T) {
+		now := time.Unix(1111111109, 0)
+		_, ok := models.ValidateTOTP(secret, "081804", now.Add(30*time.Second))
+		assert.True(t, ok)
+		_, ok = models.ValidateTOTP(secret, "081804", now.Add(-30*time.Second))
+		assert.True(t, ok)
+		_, ok = models.ValidateTOTP(secret, "081804", now.Add(90*time.Second))
+		assert.False(t, ok)
+		_, ok = models.ValidateTOTP(secret, "81804", now)
+		assert.False(t, ok)
+	})
+
+	t.Run("Generated secrets round trip", func(t *testing.T) {
+		generated, err := models.GenerateTOTPSecret()
+		require.NoError(t, err)
+		now := time.Now()
+		code, err := models.TOTPCode(generated, now)
+		require.NoError(t, err)
+		_, ok := models.ValidateTOTP(generated, code, now)
+		assert.True(t, ok)
+		assert.Contains(t, models.TOTPURI("shisha", "user name", generated), "otpauth://totp/shisha:user%20name?")
+	})
+}
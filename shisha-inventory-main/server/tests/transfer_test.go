@@ -3,19 +3,26 @@ package tests
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"server/internal/controllers"
 	"server/internal/database"
+	"server/internal/ledger"
 	"server/internal/models"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/jinzhu/gorm"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/modules/postgres"
 	"github.com/testcontainers/testcontainers-go/wait"
@@ -59,18 +66,27 @@ func setupDatabaseTransfer(dsn string) (*gorm.DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	err = db.AutoMigrate(&models.User{}).Error
+	err = db.AutoMigrate(&models.User{}, &models.Transfer{}).Error
+	if err != nil {
+		return nil, err
+	}
+	err = ledger.Migrate(db)
 	if err != nil {
 		return nil, err
 	}
 	return db, nil
 }
 
-func setupTestAppTransfer(db *gorm.DB, brokers []string, topic string, ctx context.Context) *fiber.App {
+func setupTestAppTransfer(db *gorm.DB, tm *controllers.TokenManager, brokers []string, topic string, ctx context.Context) *fiber.App {
 	database.DB = db
 	app := fiber.New()
 
-	app.Post("/transfer", controllers.Tranfser(topic, brokers, ctx))
+	guard := controllers.NewLoginGuard(tm.RedisClient, brokers, topic)
+	tf := controllers.NewTwoFactor(tm.RedisClient, guard, "shisha", 1000)
+	idempotency := controllers.NewIdempotency(tm.RedisClient, time.Hour)
+	app.Post("/transfer", controllers.AuthRequired(tm), idempotency.Handler, controllers.Tranfser(topic, brokers, ctx, tf, nil))
+	app.Get("/transfers", controllers.AuthRequired(tm), controllers.Transfers)
+	app.Get("/transfers/export", controllers.AuthRequired(tm), controllers.ExportTransfers)
 
 	return app
 }
@@ -81,6 +97,10 @@ func TestTransfer(t *testing.T) {
 	assert.NoError(t, err)
 	defer teardown()
 
+	rdb, teardownRedis, err := setupRedis(ctx)
+	assert.NoError(t, err)
+	defer teardownRedis()
+
 	db, err := setupDatabaseTransfer(dsn)
 	assert.NoError(t, err)
 
@@ -100,16 +120,22 @@ func TestTransfer(t *testing.T) {
 	assert.NoError(t, err)
 	err = db.Create(&toUser).Error
 	assert.NoError(t, err)
+	// Open ledger accounts for the balances created behind its back
+	err = ledger.Migrate(db)
+	assert.NoError(t, err)
 
 	// Brokers and topic for testing purposes
 	brokers := []string{"redpanda:9092"}
 	topic := "transfers"
-	app := setupTestAppTransfer(db, brokers, topic, ctx)
+	tm := newTestTokenManager(rdb)
+	app := setupTestAppTransfer(db, tm, brokers, topic, ctx)
+	token := newTestToken(t, tm, fromUser.Username)
 
 	t.Run("Transfer success", func(t *testing.T) {
 		payload := `{"from_username":"sender","to_username":"receiver","amount":50}`
 		req, _ := http.NewRequest("POST", "/transfer", strings.NewReader(payload))
 		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
 
 		resp, err := app.Test(req)
 		assert.NoError(t, err)
@@ -126,12 +152,19 @@ func TestTransfer(t *testing.T) {
 
 		assert.Equal(t, fromUser.Coins-50, updatedFromUser.Coins)
 		assert.Equal(t, toUser.Coins+50, updatedToUser.Coins)
+
+		for _, user := range []models.User{updatedFromUser, updatedToUser} {
+			balance, err := ledger.Balance(db, ledger.UserAccount(user.Username))
+			assert.NoError(t, err)
+			assert.Equal(t, user.Coins, balance)
+		}
 	})
 
 	t.Run("Transfer with insufficient coins", func(t *testing.T) {
 		payload := `{"from_username":"sender","to_username":"receiver","amount":100}`
 		req, _ := http.NewRequest("POST", "/transfer", strings.NewReader(payload))
 		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
 
 		resp, err := app.Test(req)
 		assert.NoError(t, err)
@@ -147,6 +180,7 @@ func TestTransfer(t *testing.T) {
 		payload := `{"from_username":"sender","to_username":"receiver","amount":-10}`
 		req, _ := http.NewRequest("POST", "/transfer", strings.NewReader(payload))
 		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
 
 		resp, err := app.Test(req)
 		assert.NoError(t, err)
@@ -158,25 +192,37 @@ func TestTransfer(t *testing.T) {
 		assert.Equal(t, "Amount must be greater than zero", body["error"])
 	})
 
-	t.Run("Transfer from non-existing user", func(t *testing.T) {
-		payload := `{"from_username":"nonexistent","to_username":"receiver","amount":10}`
+	t.Run("Transfer on behalf of another user", func(t *testing.T) {
+		payload := `{"from_username":"receiver","to_username":"sender","amount":10}`
 		req, _ := http.NewRequest("POST", "/transfer", strings.NewReader(payload))
 		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
 
 		resp, err := app.Test(req)
 		assert.NoError(t, err)
-		assert.Equal(t, fiber.StatusNotFound, resp.StatusCode)
+		assert.Equal(t, fiber.StatusForbidden, resp.StatusCode)
 
 		var body map[string]interface{}
 		err = json.NewDecoder(resp.Body).Decode(&body)
 		assert.NoError(t, err)
-		assert.Equal(t, "Ebat' ti kto?", body["error"])
+		assert.Equal(t, "Forbidden", body["error"])
+	})
+
+	t.Run("Transfer without token", func(t *testing.T) {
+		payload := `{"to_username":"receiver","amount":10}`
+		req, _ := http.NewRequest("POST", "/transfer", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusUnauthorized, resp.StatusCode)
 	})
 
 	t.Run("Transfer to non-existing user", func(t *testing.T) {
 		payload := `{"from_username":"sender","to_username":"nonexistent","amount":10}`
 		req, _ := http.NewRequest("POST", "/transfer", strings.NewReader(payload))
 		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
 
 		resp, err := app.Test(req)
 		assert.NoError(t, err)
@@ -187,4 +233,276 @@ func TestTransfer(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, "Recipient not found", body["error"])
 	})
+
+	t.Run("Transfer to yourself", func(t *testing.T) {
+		payload := `{"to_username":"sender","amount":10}`
+		req, _ := http.NewRequest("POST", "/transfer", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("Transfer retried with Idempotency-Key", func(t *testing.T) {
+		send := func(key, payload string) (*http.Response, string) {
+			req, _ := http.NewRequest("POST", "/transfer", strings.NewReader(payload))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.Header.Set(controllers.HeaderIdempotencyKey, key)
+			resp, err := app.Test(req, -1)
+			assert.NoError(t, err)
+			body, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			return resp, string(body)
+		}
+		balance := func(username string) int {
+			var user models.User
+			db.Where("username = ?", username).First(&user)
+			return user.Coins
+		}
+
+		before := balance("receiver")
+		payload := `{"to_username":"receiver","amount":5}`
+		resp, first := send("retry-1", payload)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get(controllers.HeaderIdempotentReplayed))
+
+		resp, second := send("retry-1", payload)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Equal(t, "true", resp.Header.Get(controllers.HeaderIdempotentReplayed))
+		assert.Equal(t, first, second)
+		assert.Equal(t, before+5, balance("receiver"))
+
+		resp, _ = send("retry-1", `{"to_username":"receiver","amount":6}`)
+		assert.Equal(t, fiber.StatusConflict, resp.StatusCode)
+		assert.Equal(t, before+5, balance("receiver"))
+
+		// A new key is a new transfer
+		resp, _ = send("retry-2", payload)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Equal(t, before+10, balance("receiver"))
+	})
+
+	t.Run("Transfer history", func(t *testing.T) {
+		get := func(token, query string) (*http.Response, []byte) {
+			req, _ := http.NewRequest("GET", query, nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, err := app.Test(req, -1)
+			assert.NoError(t, err)
+			body, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			return resp, body
+		}
+		type page struct {
+			Transfers []models.Transfer `json:"transfers"`
+			Next      uint              `json:"next"`
+		}
+
+		receiverToken := newTestToken(t, tm, "receiver")
+		payload := `{"to_username":"sender","amount":1,"memo":"=thanks"}`
+		req, _ := http.NewRequest("POST", "/transfer", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+receiverToken)
+		resp, err := app.Test(req, -1)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+		resp, body := get(token, "/transfers")
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		var all page
+		require.NoError(t, json.Unmarshal(body, &all))
+		require.NotEmpty(t, all.Transfers)
+		assert.Equal(t, "=thanks", all.Transfers[0].Memo)
+		assert.Equal(t, "receiver", all.Transfers[0].FromUser)
+
+		_, body = get(token, "/transfers?direction=received")
+		var received page
+		require.NoError(t, json.Unmarshal(body, &received))
+		require.Len(t, received.Transfers, 1)
+
+		_, body = get(token, "/transfers?direction=sent")
+		var sent page
+		require.NoError(t, json.Unmarshal(body, &sent))
+		assert.Len(t, sent.Transfers, len(all.Transfers)-1)
+		for _, transfer := range sent.Transfers {
+			assert.Equal(t, "sender", transfer.FromUser)
+		}
+
+		// Walk the history one transfer at a time
+		var walked int
+		next := "/transfers?limit=1"
+		for next != "" && walked <= len(all.Transfers) {
+			_, body = get(token, next)
+			var p page
+			require.NoError(t, json.Unmarshal(body, &p))
+			walked += len(p.Transfers)
+			next = ""
+			if p.Next != 0 {
+				next = fmt.Sprintf("/transfers?limit=1&before=%d", p.Next)
+			}
+		}
+		assert.Equal(t, len(all.Transfers), walked)
+
+		tomorrow := time.Now().AddDate(0, 0, 1).Format("2006-01-02")
+		_, body = get(token, "/transfers?from="+tomorrow)
+		var future page
+		require.NoError(t, json.Unmarshal(body, &future))
+		assert.Empty(t, future.Transfers)
+
+		resp, _ = get(token, "/transfers?direction=sideways")
+		assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+
+		resp, body = get(token, "/transfers/export?counterparty=receiver")
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.Contains(t, resp.Header.Get("Content-Type"), "text/csv")
+		lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+		assert.Equal(t, "id,created_at,direction,counterparty,amount,memo", lines[0])
+		assert.Len(t, lines, len(all.Transfers)+1)
+		assert.True(t, strings.HasSuffix(lines[1], ",received,receiver,1,'=thanks"), lines[1])
+	})
+
+	t.Run("Transfer above 2FA threshold", func(t *testing.T) {
+		payload := `{"to_username":"receiver","amount":1001}`
+		req, _ := http.NewRequest("POST", "/transfer", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, fiber.StatusForbidden, resp.StatusCode)
+	})
+}
+
+func TestConcurrentTransfers(t *testing.T) {
+	ctx := context.Background()
+	dsn, teardown, err := setupPostgresTransfer(ctx)
+	require.NoError(t, err)
+	defer teardown()
+
+	rdb, teardownRedis, err := setupRedis(ctx)
+	require.NoError(t, err)
+	defer teardownRedis()
+
+	db, err := setupDatabaseTransfer(dsn)
+	require.NoError(t, err)
+	// Stay below the max_connections of the postgres container
+	db.DB().SetMaxOpenConns(20)
+
+	const (
+		userCount    = 10
+		startCoins   = 100
+		requestCount = 400
+	)
+	usernames := make([]string, userCount)
+	for i := range usernames {
+		usernames[i] = fmt.Sprintf("user%d", i)
+		err := db.Create(&models.User{Username: usernames[i], Password: "password", Coins: startCoins}).Error
+		require.NoError(t, err)
+	}
+	require.NoError(t, ledger.Migrate(db))
+
+	tm := newTestTokenManager(rdb)
+	app := setupTestAppTransfer(db, tm, []string{"redpanda:9092"}, "transfers", ctx)
+	tokens := make(map[string]string, userCount)
+	for _, username := range usernames {
+		tokens[username] = newTestToken(t, tm, username)
+	}
+
+	transfer := func(from, to string, amount int) int {
+		payload := fmt.Sprintf(`{"to_username":%q,"amount":%d}`, to, amount)
+		req, _ := http.NewRequest("POST", "/transfer", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+tokens[from])
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+		return resp.StatusCode
+	}
+
+	assertConserved := func(t *testing.T) {
+		var users []models.User
+		require.NoError(t, db.Find(&users).Error)
+		total := 0
+		for _, user := range users {
+			total += user.Coins
+			assert.GreaterOrEqual(t, user.Coins, 0, user.Username)
+
+			balance, err := ledger.Balance(db, ledger.UserAccount(user.Username))
+			assert.NoError(t, err)
+			assert.Equal(t, user.Coins, balance, user.Username)
+		}
+		assert.Equal(t, userCount*startCoins, total)
+	}
+
+	t.Run("Random transfers conserve coins", func(t *testing.T) {
+		rng := rand.New(rand.NewSource(1))
+		type transferCase struct {
+			from, to string
+			amount   int
+		}
+		cases := make([]transferCase, requestCount)
+		for i := range cases {
+			cases[i] = transferCase{
+				from:   usernames[rng.Intn(userCount)],
+				to:     usernames[rng.Intn(userCount)],
+				amount: 1 + rng.Intn(60),
+			}
+		}
+
+		var wg sync.WaitGroup
+		var succeeded, rejected int64
+		for _, tc := range cases {
+			wg.Add(1)
+			go func(tc transferCase) {
+				defer wg.Done()
+				switch status := transfer(tc.from, tc.to, tc.amount); status {
+				case fiber.StatusOK:
+					atomic.AddInt64(&succeeded, 1)
+				case fiber.StatusBadRequest:
+					atomic.AddInt64(&rejected, 1)
+				default:
+					t.Errorf("unexpected status %d for %+v", status, tc)
+				}
+			}(tc)
+		}
+		wg.Wait()
+
+		assert.Equal(t, int64(requestCount), succeeded+rejected)
+		assert.Positive(t, succeeded)
+		assertConserved(t)
+
+		var transfers int
+		err := db.Model(&models.LedgerEntry{}).Where("reason = ?", ledger.ReasonTransfer).Count(&transfers).Error
+		assert.NoError(t, err)
+		assert.Equal(t, int(succeeded)*2, transfers)
+	})
+
+	t.Run("Parallel spending cannot overdraw", func(t *testing.T) {
+		var spender models.User
+		require.NoError(t, db.Where("username = ?", usernames[0]).First(&spender).Error)
+
+		var wg sync.WaitGroup
+		var succeeded int64
+		// Ask for more single coin transfers than the spender can afford
+		for i := 0; i < spender.Coins+50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if transfer(spender.Username, usernames[1+i%(userCount-1)], 1) == fiber.StatusOK {
+					atomic.AddInt64(&succeeded, 1)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		var updated models.User
+		require.NoError(t, db.Where("username = ?", spender.Username).First(&updated).Error)
+		assert.Equal(t, 0, updated.Coins)
+		assert.Equal(t, int64(spender.Coins), succeeded)
+		assertConserved(t)
+	})
 }